@@ -6,8 +6,16 @@ func Commands() []cli.Command {
 	command := cli.Command{
 		Name:   "sidecar",
 		Usage:  "run the sidecar",
+		Flags:  Flags(),
 		Action: run,
 	}
 
-	return []cli.Command{command}
+	validateCommand := cli.Command{
+		Name:   "validate",
+		Usage:  "check the configuration of the sidecar without running it",
+		Flags:  Flags(),
+		Action: validate,
+	}
+
+	return []cli.Command{command, validateCommand}
 }
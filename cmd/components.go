@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/security/secret"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/cmd/config"
+	"github.com/w-h-a/sidecar/state"
+	"github.com/w-h-a/sidecar/store/encrypted"
+)
+
+type componentSet struct {
+	config  *config.Components
+	stores  map[string]store.Store
+	brokers map[string]broker.Broker
+	secrets map[string]secret.Secret
+}
+
+// makeComponents builds every component in cfg. Components that
+// are configured exactly as they are in prev are reused rather
+// than rebuilt so that their state and connections survive. The
+// secret stores are built first and the other components are
+// built with their secret references resolved.
+func makeComponents(cfg *config.Components, prev *componentSet) (*componentSet, error) {
+	if prev == nil {
+		prev = &componentSet{
+			config:  &config.Components{},
+			stores:  map[string]store.Store{},
+			brokers: map[string]broker.Broker{},
+			secrets: map[string]secret.Secret{},
+		}
+	}
+
+	c := &componentSet{
+		stores:  map[string]store.Store{},
+		brokers: map[string]broker.Broker{},
+		secrets: map[string]secret.Secret{},
+	}
+
+	// secrets are built first so that the other
+	// components can be configured from them
+	for _, s := range cfg.Secrets {
+		if len(s.SecretRefs) > 0 {
+			return nil, fmt.Errorf("secret store %s cannot refer to secrets", s.Name)
+		}
+
+		if unchanged(prev.config.Secrets, s) {
+			c.secrets[s.Name] = prev.secrets[s.Name]
+			continue
+		}
+
+		sc, err := GetSecretBuilder(s.Type)
+		if err != nil {
+			return nil, err
+		} else if sc == nil {
+			return nil, fmt.Errorf("secret store %s requires a type", s.Name)
+		}
+
+		c.secrets[s.Name] = MakeSecret(sc, []string{s.Address}, s.Options["prefix"])
+	}
+
+	if err := resolveAwsCredentials(c.secrets); err != nil {
+		return nil, err
+	}
+
+	resolved, err := resolveSecretRefs(cfg, c.secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	c.config = resolved
+
+	for _, s := range resolved.Stores {
+		if unchanged(prev.config.Stores, s) {
+			c.stores[s.Name] = prev.stores[s.Name]
+			continue
+		}
+
+		st, err := GetStoreBuilder(s.Type)
+		if err != nil {
+			return nil, err
+		} else if st == nil {
+			return nil, fmt.Errorf("store %s requires a type", s.Name)
+		}
+
+		c.stores[s.Name] = MakeStore(st, []string{s.Address}, s.Database, s.Table)
+
+		if s.Encryption != nil {
+			if c.stores[s.Name], err = encrypt(c.stores[s.Name], s.Encryption); err != nil {
+				return nil, fmt.Errorf("store %s: %v", s.Name, err)
+			}
+		}
+
+		if s.Outbox {
+			ob, ok := c.stores[s.Name].(state.Outboxer)
+			if !ok {
+				return nil, fmt.Errorf("store %s of type %s cannot keep an outbox", s.Name, s.Type)
+			}
+
+			if err := ob.OpenOutbox(); err != nil {
+				return nil, fmt.Errorf("store %s: failed to open outbox: %v", s.Name, err)
+			}
+		}
+	}
+
+	for _, s := range resolved.Producers {
+		if unchanged(prev.config.Producers, s) {
+			c.brokers[s.Name] = prev.brokers[s.Name]
+			continue
+		}
+
+		bk, err := GetBrokerBuilder(s.Type)
+		if err != nil {
+			return nil, err
+		} else if bk == nil {
+			return nil, fmt.Errorf("producer %s requires a type", s.Name)
+		}
+
+		c.brokers[s.Name] = MakeProducer(bk, []string{s.Address}, s.Topic)
+	}
+
+	for _, s := range resolved.Consumers {
+		if unchanged(prev.config.Consumers, s) {
+			c.brokers[s.Name] = prev.brokers[s.Name]
+			continue
+		}
+
+		bk, err := GetBrokerBuilder(s.Type)
+		if err != nil {
+			return nil, err
+		} else if bk == nil {
+			return nil, fmt.Errorf("consumer %s requires a type", s.Name)
+		}
+
+		c.brokers[s.Name] = MakeConsumer(bk, []string{s.Address}, s.Name, s.Type == "memory")
+	}
+
+	return c, nil
+}
+
+// displaced returns the components of prev that next does not reuse
+func displaced(prev, next *componentSet) []interface{} {
+	components := []interface{}{}
+
+	for name, st := range prev.stores {
+		if next.stores[name] != st {
+			components = append(components, st)
+		}
+	}
+
+	for name, bk := range prev.brokers {
+		if next.brokers[name] != bk {
+			components = append(components, bk)
+		}
+	}
+
+	for name, sc := range prev.secrets {
+		if next.secrets[name] != sc {
+			components = append(components, sc)
+		}
+	}
+
+	return components
+}
+
+// closeComponents closes the components that hold connections or files
+func closeComponents(components []interface{}) {
+	for _, c := range components {
+		closer, ok := c.(io.Closer)
+		if !ok {
+			continue
+		}
+
+		if err := closer.Close(); err != nil {
+			log.Errorf("failed to close component %v: %v", c, err)
+		}
+	}
+}
+
+// consumerChanges returns the consumers that have to be unsubscribed
+// and the consumers that have to be subscribed when moving from prev
+// to next. A consumer whose configuration changed appears in both.
+func consumerChanges(prev, next *config.Components) (removed []string, added []string) {
+	for _, c := range prev.Consumers {
+		if !unchanged(next.Consumers, c) {
+			removed = append(removed, c.Name)
+		}
+	}
+
+	for _, c := range next.Consumers {
+		if !unchanged(prev.Consumers, c) {
+			added = append(added, c.Name)
+		}
+	}
+
+	return removed, added
+}
+
+// encrypt wraps the store so that its values are encrypted with the
+// resolved keys, each of which is named by its secret reference
+func encrypt(st store.Store, e *config.Encryption) (store.Store, error) {
+	keys := []encrypted.Key{}
+
+	for _, r := range e.Refs() {
+		ref, err := config.ParseSecretRef(r)
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(e.Secrets[r])
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not base64", ref)
+		}
+
+		keys = append(keys, encrypted.Key{
+			Id:     ref.String(),
+			Secret: secret,
+		})
+	}
+
+	return encrypted.NewStore(st, keys, encrypted.EncryptedWithPlaintext(e.Plaintext))
+}
+
+func unchanged(cs []config.Component, c config.Component) bool {
+	for _, other := range cs {
+		if other.Name == c.Name {
+			return reflect.DeepEqual(other, c)
+		}
+	}
+
+	return false
+}
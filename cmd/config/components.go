@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Components struct {
+	Stores    []Component `json:"stores,omitempty" yaml:"stores,omitempty"`
+	Producers []Component `json:"producers,omitempty" yaml:"producers,omitempty"`
+	Consumers []Component `json:"consumers,omitempty" yaml:"consumers,omitempty"`
+	Secrets   []Component `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+}
+
+type Component struct {
+	Name     string            `json:"name" yaml:"name"`
+	Type     string            `json:"type" yaml:"type"`
+	Address  string            `json:"address,omitempty" yaml:"address,omitempty"`
+	Database string            `json:"database,omitempty" yaml:"database,omitempty"`
+	Table    string            `json:"table,omitempty" yaml:"table,omitempty"`
+	Topic    string            `json:"topic,omitempty" yaml:"topic,omitempty"`
+	Options  map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+	// SecretRefs maps a setting (e.g., address) to the <secretId>:<key>
+	// of the secret that holds its value
+	SecretRefs map[string]string `json:"secretRefs,omitempty" yaml:"secretRefs,omitempty"`
+	// Encryption encrypts the values of a store at rest
+	Encryption *Encryption `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+	// Outbox keeps the events of the transactions of a store in an
+	// outbox that is relayed to the producers
+	Outbox bool `json:"outbox,omitempty" yaml:"outbox,omitempty"`
+}
+
+// Encryption names the <secretId>:<key> of the secret that holds the
+// base64 AES key that encrypts the values of a store. The previous keys
+// only decrypt the values that they encrypted before the key rotated.
+// Values that are not encrypted fail to be read unless Plaintext is set
+// while a store that has values from before its encryption is migrated.
+type Encryption struct {
+	Key          string   `json:"key" yaml:"key"`
+	PreviousKeys []string `json:"previousKeys,omitempty" yaml:"previousKeys,omitempty"`
+	Plaintext    bool     `json:"plaintext,omitempty" yaml:"plaintext,omitempty"`
+	// Secrets maps each key to the value of its secret once resolved
+	Secrets map[string]string `json:"-" yaml:"-"`
+}
+
+// Refs returns the key and then the previous keys
+func (e *Encryption) Refs() []string {
+	return append([]string{e.Key}, e.PreviousKeys...)
+}
+
+// LoadComponents reads the manifest at path. yaml is a superset of
+// json, so either format is accepted. When no path is given, the
+// components are built from the env vars instead.
+func LoadComponents(path string) (*Components, error) {
+	if len(path) == 0 {
+		return ComponentsFromEnv(), nil
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read components manifest %s: %v", path, err)
+	}
+
+	components := &Components{}
+
+	if err := yaml.Unmarshal(bs, components); err != nil {
+		return nil, fmt.Errorf("failed to parse components manifest %s: %v", path, err)
+	}
+
+	collectSecretRefs(components)
+
+	for i := range components.Stores {
+		if len(components.Stores[i].Table) == 0 && len(components.Stores[i].SecretRefs["table"]) == 0 {
+			components.Stores[i].Table = components.Stores[i].Name
+		}
+	}
+
+	for i := range components.Producers {
+		if len(components.Producers[i].Topic) == 0 && len(components.Producers[i].SecretRefs["topic"]) == 0 {
+			components.Producers[i].Topic = components.Producers[i].Name
+		}
+	}
+
+	if err := checkNames(components); err != nil {
+		return nil, fmt.Errorf("invalid components manifest %s: %v", path, err)
+	}
+
+	return components, nil
+}
+
+func ComponentsFromEnv() *Components {
+	components := &Components{}
+
+	for _, s := range Stores {
+		if len(s) == 0 {
+			continue
+		}
+
+		// each store may override the shared settings with env
+		// vars of its own name (e.g., SIDECAR_STORE_<NAME>_TYPE)
+		typ := Override("store", s, "TYPE", Store)
+		if len(typ) == 0 {
+			continue
+		}
+
+		store := Component{
+			Name:     s,
+			Type:     typ,
+			Address:  Override("store", s, "ADDRESS", StoreAddress),
+			Database: Override("store", s, "DB", DB),
+			Table:    s,
+			Outbox:   Override("store", s, "OUTBOX", "") == "true",
+		}
+
+		if key := Override("store", s, "ENCRYPTION_KEY", ""); len(key) > 0 {
+			store.Encryption = &Encryption{
+				Key:       key,
+				Plaintext: Override("store", s, "ENCRYPTION_PLAINTEXT", "") == "true",
+			}
+
+			for _, prev := range Split(Override("store", s, "ENCRYPTION_PREVIOUS_KEYS", "")) {
+				if len(prev) > 0 {
+					store.Encryption.PreviousKeys = append(store.Encryption.PreviousKeys, prev)
+				}
+			}
+		}
+
+		components.Stores = append(components.Stores, store)
+	}
+
+	if len(Broker) > 0 {
+		for _, s := range Producers {
+			if len(s) == 0 {
+				continue
+			}
+
+			components.Producers = append(components.Producers, Component{
+				Name:    s,
+				Type:    Broker,
+				Address: BrokerAddress,
+				Topic:   s,
+			})
+		}
+
+		for _, s := range Consumers {
+			if len(s) == 0 {
+				continue
+			}
+
+			components.Consumers = append(components.Consumers, Component{
+				Name:    s,
+				Type:    Broker,
+				Address: BrokerAddress,
+			})
+		}
+	}
+
+	for _, s := range Secrets {
+		if len(s) == 0 {
+			continue
+		}
+
+		typ := Override("secret", s, "TYPE", Secret)
+		if len(typ) == 0 {
+			continue
+		}
+
+		components.Secrets = append(components.Secrets, Component{
+			Name:    s,
+			Type:    typ,
+			Address: Override("secret", s, "ADDRESS", SecretAddress),
+			Options: map[string]string{
+				"prefix": Override("secret", s, "PREFIX", SecretPrefix),
+			},
+		})
+	}
+
+	// without a list of secret stores, the single
+	// secret store is named after its type
+	if len(components.Secrets) == 0 && len(Secret) > 0 {
+		components.Secrets = append(components.Secrets, Component{
+			Name:    Secret,
+			Type:    Secret,
+			Address: SecretAddress,
+			Options: map[string]string{
+				"prefix": SecretPrefix,
+			},
+		})
+	}
+
+	collectSecretRefs(components)
+
+	return components
+}
+
+func checkNames(components *Components) error {
+	stores := map[string]bool{}
+
+	for _, c := range components.Stores {
+		if len(c.Name) == 0 {
+			return fmt.Errorf("store of type %s requires a name", c.Type)
+		}
+		if stores[c.Name] {
+			return fmt.Errorf("store %s is defined more than once", c.Name)
+		}
+		if c.Encryption != nil && len(c.Encryption.Key) == 0 {
+			return fmt.Errorf("store %s requires an encryption key", c.Name)
+		}
+		stores[c.Name] = true
+	}
+
+	// producers and consumers share one set of brokers
+	brokers := map[string]bool{}
+
+	for _, c := range append(append([]Component{}, components.Producers...), components.Consumers...) {
+		if len(c.Name) == 0 {
+			return fmt.Errorf("broker of type %s requires a name", c.Type)
+		}
+		if brokers[c.Name] {
+			return fmt.Errorf("broker %s is defined more than once", c.Name)
+		}
+		if c.Encryption != nil {
+			return fmt.Errorf("broker %s cannot be encrypted", c.Name)
+		}
+		if c.Outbox {
+			return fmt.Errorf("broker %s cannot keep an outbox", c.Name)
+		}
+		brokers[c.Name] = true
+	}
+
+	secrets := map[string]bool{}
+
+	for _, c := range components.Secrets {
+		if len(c.Name) == 0 {
+			return fmt.Errorf("secret store of type %s requires a name", c.Type)
+		}
+		if secrets[c.Name] {
+			return fmt.Errorf("secret store %s is defined more than once", c.Name)
+		}
+		if c.Encryption != nil {
+			return fmt.Errorf("secret store %s cannot be encrypted", c.Name)
+		}
+		if c.Outbox {
+			return fmt.Errorf("secret store %s cannot keep an outbox", c.Name)
+		}
+		secrets[c.Name] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComponentsFromEnv(t *testing.T) {
+	testCases := []struct {
+		name   string
+		env    map[string]string
+		stores []Component
+	}{
+		{
+			name: "shared settings",
+			env: map[string]string{
+				"STORE": "memory",
+				"DB":    "mydb",
+			},
+			stores: []Component{
+				{Name: "app", Type: "memory", Database: "mydb", Table: "app"},
+				{Name: "orders", Type: "memory", Database: "mydb", Table: "orders"},
+				{Name: "cache", Type: "memory", Database: "mydb", Table: "cache"},
+			},
+		},
+		{
+			name: "mixed backends",
+			env: map[string]string{
+				"STORE":                                     "memory",
+				"DB":                                        "mydb",
+				"SIDECAR_STORE_ORDERS_TYPE":                 "sqlite",
+				"SIDECAR_STORE_ORDERS_ADDRESS":              "/var/lib/sidecar/orders.db",
+				"SIDECAR_STORE_CACHE_TYPE":                  "redis",
+				"SIDECAR_STORE_CACHE_ADDRESS":               "localhost:6379",
+				"SIDECAR_STORE_CACHE_DB":                    "cachedb",
+				"SIDECAR_STORE_CACHE_OUTBOX":                "true",
+				"SIDECAR_STORE_ORDERS_ENCRYPTION_KEY":       "env:key",
+				"SIDECAR_STORE_ORDERS_ENCRYPTION_PLAINTEXT": "true",
+			},
+			stores: []Component{
+				{Name: "app", Type: "memory", Database: "mydb", Table: "app"},
+				{Name: "orders", Type: "sqlite", Address: "/var/lib/sidecar/orders.db", Database: "mydb", Table: "orders", Encryption: &Encryption{Key: "env:key", Plaintext: true}},
+				{Name: "cache", Type: "redis", Address: "localhost:6379", Database: "cachedb", Table: "cache", Outbox: true},
+			},
+		},
+		{
+			name: "settings of other components with the name of a store",
+			env: map[string]string{
+				"STORE":        "memory",
+				"DB":           "mydb",
+				"APP_DB":       "secretdb",
+				"APP_STORE":    "redis",
+				"ORDERS_STORE": "sqlite",
+			},
+			stores: []Component{
+				{Name: "app", Type: "memory", Database: "mydb", Table: "app"},
+				{Name: "orders", Type: "memory", Database: "mydb", Table: "orders"},
+				{Name: "cache", Type: "memory", Database: "mydb", Table: "cache"},
+			},
+		},
+		{
+			name: "stores without a type",
+			env: map[string]string{
+				"SIDECAR_STORE_ORDERS_TYPE": "file",
+			},
+			stores: []Component{
+				{Name: "orders", Type: "file", Table: "orders"},
+			},
+		},
+	}
+
+	keys := []string{"STORE", "STORE_ADDRESS", "DB"}
+
+	for _, testCase := range testCases {
+		for key := range testCase.env {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// the env vars are restored once the test is done
+			for _, key := range keys {
+				t.Setenv(key, testCase.env[key])
+
+				if _, ok := testCase.env[key]; !ok {
+					os.Unsetenv(key)
+				}
+			}
+
+			Store = testCase.env["STORE"]
+			StoreAddress = testCase.env["STORE_ADDRESS"]
+			DB = testCase.env["DB"]
+			Stores = List{"app", "orders", "cache"}
+
+			components := ComponentsFromEnv()
+
+			require.Equal(t, testCase.stores, components.Stores)
+		})
+	}
+}
@@ -1,32 +1,41 @@
 package config
 
-import "os"
+import "time"
 
+// these are populated from the flags of the sidecar
+// command, each of which defaults to its env var
 var (
-	Namespace          = os.Getenv("NAMESPACE")
-	Name               = os.Getenv("NAME")
-	Version            = os.Getenv("VERSION")
-	HttpAddress        = os.Getenv("HTTP_ADDRESS")
-	GrpcAddress        = os.Getenv("GRPC_ADDRESS")
-	ServiceName        = os.Getenv("SERVICE_NAME")
-	ServicePort        = os.Getenv("SERVICE_PORT")
-	ServiceProtocol    = os.Getenv("SERVICE_PROTOCOL")
-	Store              = os.Getenv("STORE")
-	StoreAddress       = os.Getenv("STORE_ADDRESS")
-	DB                 = os.Getenv("DB")
-	Stores             = Split(os.Getenv("STORES"))
-	Broker             = os.Getenv("BROKER")
-	BrokerAddress      = os.Getenv("BROKER_ADDRESS")
-	Producers          = Split(os.Getenv("PRODUCERS"))
-	Consumers          = Split(os.Getenv("CONSUMERS"))
-	Secret             = os.Getenv("SECRET")
-	SecretAddress      = os.Getenv("SECRET_ADDRESS")
-	SecretPrefix       = os.Getenv("SECRET_PREFIX")
-	TraceExporter      = os.Getenv("TRACE_EXPORTER")
-	TraceAddress       = os.Getenv("TRACE_ADDRESS")
-	TraceProtocol      = os.Getenv("TRACE_PROTOCOL")
-	TraceSecure        = os.Getenv("TRACE_SECURE")
-	TraceHeaders       = Split(os.Getenv("TRACE_HEADERS"))
-	AwsAccessKeyId     = os.Getenv("AWS_ACCESS_KEY_ID")
-	AwsSecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	Namespace              string
+	Name                   string
+	Version                string
+	HttpAddress            string
+	GrpcAddress            string
+	ServiceName            string
+	ServicePort            string
+	ServiceProtocol        string
+	ComponentsPath         string
+	PluggableComponentsDir string
+	Store                  string
+	StoreAddress           string
+	DB                     string
+	Stores                 List
+	ReapInterval           time.Duration
+	OutboxInterval         time.Duration
+	BulkParallelism        int
+	QueryScanLimit         int
+	Broker                 string
+	BrokerAddress          string
+	Producers              List
+	Consumers              List
+	Secret                 string
+	Secrets                List
+	SecretAddress          string
+	SecretPrefix           string
+	TraceExporter          string
+	TraceAddress           string
+	TraceProtocol          string
+	TraceSecure            string
+	TraceHeaders           List
+	AwsAccessKeyId         string
+	AwsSecretAccessKey     string
 )
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SecretRefPrefix marks a setting whose value is held in a secret store,
+// as in secretRef:ssm:/db/url for the key /db/url of the secret store
+// named ssm.
+const SecretRefPrefix = "secretRef:"
+
+type SecretRef struct {
+	SecretId string
+	Key      string
+}
+
+func (r SecretRef) String() string {
+	return r.SecretId + ":" + r.Key
+}
+
+// ParseSecretRef parses a reference of form <secretId>:<key>, with or
+// without SecretRefPrefix.
+func ParseSecretRef(ref string) (SecretRef, error) {
+	secretId, key, ok := strings.Cut(strings.TrimPrefix(ref, SecretRefPrefix), ":")
+	if !ok || len(secretId) == 0 || len(key) == 0 {
+		return SecretRef{}, fmt.Errorf("secret reference %s is not of form <secretId>:<key>", ref)
+	}
+
+	return SecretRef{SecretId: secretId, Key: key}, nil
+}
+
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretRefPrefix)
+}
+
+// Field returns a pointer to the setting of the component that a
+// secret reference may fill in.
+func (c *Component) Field(name string) (*string, error) {
+	switch name {
+	case "address":
+		return &c.Address, nil
+	case "database":
+		return &c.Database, nil
+	case "table":
+		return &c.Table, nil
+	case "topic":
+		return &c.Topic, nil
+	default:
+		return nil, fmt.Errorf("%s cannot refer to a secret; use one of address, database, table, or topic", name)
+	}
+}
+
+// RefFields returns the names of the settings of the component that
+// refer to secrets in a stable order.
+func (c *Component) RefFields() []string {
+	fields := []string{}
+
+	for field := range c.SecretRefs {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	return fields
+}
+
+// collectSecretRefs moves settings written inline as secret references
+// (e.g., address: secretRef:ssm:/db/url) into SecretRefs so that every
+// reference is resolved the same way.
+func collectSecretRefs(components *Components) {
+	for _, cs := range [][]Component{components.Stores, components.Producers, components.Consumers, components.Secrets} {
+		for i := range cs {
+			for _, name := range []string{"address", "database", "table", "topic"} {
+				field, _ := cs[i].Field(name)
+
+				if !IsSecretRef(*field) {
+					continue
+				}
+
+				if cs[i].SecretRefs == nil {
+					cs[i].SecretRefs = map[string]string{}
+				}
+
+				cs[i].SecretRefs[name] = strings.TrimPrefix(*field, SecretRefPrefix)
+
+				*field = ""
+			}
+		}
+	}
+}
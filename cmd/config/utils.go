@@ -1,6 +1,22 @@
 package config
 
-import "strings"
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// List is a comma separated flag value
+type List []string
+
+func (l *List) Set(value string) error {
+	*l = Split(value)
+	return nil
+}
+
+func (l *List) String() string {
+	return strings.Join(*l, ",")
+}
 
 func Split(str string) []string {
 	s := []string{}
@@ -9,3 +25,20 @@ func Split(str string) []string {
 
 	return s
 }
+
+var nonAlphanumeric = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+// Override looks up the env var for key of the component of the kind
+// and name (e.g., SIDECAR_STORE_SCRATCH_TYPE for the type of the scratch
+// store) and falls back to def when it is not set. The env vars are
+// prefixed so that the name of a component cannot make them collide
+// with other settings.
+func Override(kind, name, key, def string) string {
+	prefix := strings.ToUpper("SIDECAR_" + kind + "_" + nonAlphanumeric.ReplaceAllString(name, "_"))
+
+	if v, ok := os.LookupEnv(prefix + "_" + key); ok {
+		return v
+	}
+
+	return def
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/w-h-a/sidecar/cmd/config"
+)
+
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:        "namespace",
+			Usage:       "namespace of the sidecar",
+			EnvVar:      "NAMESPACE",
+			Destination: &config.Namespace,
+		},
+		cli.StringFlag{
+			Name:        "name",
+			Usage:       "name of the sidecar",
+			EnvVar:      "NAME",
+			Destination: &config.Name,
+		},
+		cli.StringFlag{
+			Name:        "version",
+			Usage:       "version of the sidecar",
+			EnvVar:      "VERSION",
+			Destination: &config.Version,
+		},
+		cli.StringFlag{
+			Name:        "http-address",
+			Usage:       "address of the sidecar's http server (e.g., :3501)",
+			EnvVar:      "HTTP_ADDRESS",
+			Destination: &config.HttpAddress,
+		},
+		cli.StringFlag{
+			Name:        "grpc-address",
+			Usage:       "address of the sidecar's grpc server (e.g., :50001)",
+			EnvVar:      "GRPC_ADDRESS",
+			Destination: &config.GrpcAddress,
+		},
+		cli.StringFlag{
+			Name:        "service-name",
+			Usage:       "host name of the service the sidecar is attached to",
+			EnvVar:      "SERVICE_NAME",
+			Destination: &config.ServiceName,
+		},
+		cli.StringFlag{
+			Name:        "service-port",
+			Usage:       "port of the service the sidecar is attached to",
+			EnvVar:      "SERVICE_PORT",
+			Destination: &config.ServicePort,
+		},
+		cli.StringFlag{
+			Name:        "service-protocol",
+			Usage:       "protocol of the service the sidecar is attached to (http or grpc)",
+			EnvVar:      "SERVICE_PROTOCOL",
+			Destination: &config.ServiceProtocol,
+		},
+		cli.StringFlag{
+			Name:        "components",
+			Usage:       "path to a yaml or json manifest of stores, producers, consumers, and secrets, which is reloaded on SIGHUP or when it changes; components from env vars are never reloaded",
+			EnvVar:      "COMPONENTS",
+			Destination: &config.ComponentsPath,
+		},
+		cli.StringFlag{
+			Name:        "pluggable-components-dir",
+			Usage:       "directory of the unix sockets that pluggable components serve on",
+			EnvVar:      "PLUGGABLE_COMPONENTS_DIR",
+			Destination: &config.PluggableComponentsDir,
+		},
+		cli.StringFlag{
+			Name:        "store",
+			Usage:       "type of the state stores",
+			EnvVar:      "STORE",
+			Destination: &config.Store,
+		},
+		cli.StringFlag{
+			Name:        "store-address",
+			Usage:       "address of the state stores",
+			EnvVar:      "STORE_ADDRESS",
+			Destination: &config.StoreAddress,
+		},
+		cli.StringFlag{
+			Name:        "db",
+			Usage:       "database of the state stores",
+			EnvVar:      "DB",
+			Destination: &config.DB,
+		},
+		cli.GenericFlag{
+			Name:   "stores",
+			Usage:  "comma separated list of state store ids",
+			EnvVar: "STORES",
+			Value:  &config.Stores,
+		},
+		cli.DurationFlag{
+			Name:        "reap-interval",
+			Usage:       "interval at which expired records are deleted from the state stores (e.g., 1m); 0 turns it off",
+			EnvVar:      "REAP_INTERVAL",
+			Value:       time.Minute,
+			Destination: &config.ReapInterval,
+		},
+		cli.DurationFlag{
+			Name:        "outbox-interval",
+			Usage:       "interval at which the events in the outboxes of the state stores are published (e.g., 1s); 0 turns it off",
+			EnvVar:      "OUTBOX_INTERVAL",
+			Value:       time.Second,
+			Destination: &config.OutboxInterval,
+		},
+		cli.IntFlag{
+			Name:        "bulk-parallelism",
+			Usage:       "most reads or deletes of one bulk get or delete of state that run at once",
+			EnvVar:      "BULK_PARALLELISM",
+			Value:       10,
+			Destination: &config.BulkParallelism,
+		},
+		cli.IntFlag{
+			Name:        "query-scan-limit",
+			Usage:       "most records that a query of state reads from a store that cannot evaluate queries; larger stores reject such queries",
+			EnvVar:      "QUERY_SCAN_LIMIT",
+			Value:       10000,
+			Destination: &config.QueryScanLimit,
+		},
+		cli.StringFlag{
+			Name:        "broker",
+			Usage:       "type of the brokers",
+			EnvVar:      "BROKER",
+			Destination: &config.Broker,
+		},
+		cli.StringFlag{
+			Name:        "broker-address",
+			Usage:       "address of the brokers",
+			EnvVar:      "BROKER_ADDRESS",
+			Destination: &config.BrokerAddress,
+		},
+		cli.GenericFlag{
+			Name:   "producers",
+			Usage:  "comma separated list of topics to publish to",
+			EnvVar: "PRODUCERS",
+			Value:  &config.Producers,
+		},
+		cli.GenericFlag{
+			Name:   "consumers",
+			Usage:  "comma separated list of <group>-<topic> consumer groups",
+			EnvVar: "CONSUMERS",
+			Value:  &config.Consumers,
+		},
+		cli.StringFlag{
+			Name:        "secret",
+			Usage:       "type of the secret stores",
+			EnvVar:      "SECRET",
+			Destination: &config.Secret,
+		},
+		cli.GenericFlag{
+			Name:   "secrets",
+			Usage:  "comma separated list of secret store ids",
+			EnvVar: "SECRETS",
+			Value:  &config.Secrets,
+		},
+		cli.StringFlag{
+			Name:        "secret-address",
+			Usage:       "address of the secret stores",
+			EnvVar:      "SECRET_ADDRESS",
+			Destination: &config.SecretAddress,
+		},
+		cli.StringFlag{
+			Name:        "secret-prefix",
+			Usage:       "prefix of the keys in the secret stores",
+			EnvVar:      "SECRET_PREFIX",
+			Destination: &config.SecretPrefix,
+		},
+		cli.StringFlag{
+			Name:        "trace-exporter",
+			Usage:       "type of the trace exporter",
+			EnvVar:      "TRACE_EXPORTER",
+			Destination: &config.TraceExporter,
+		},
+		cli.StringFlag{
+			Name:        "trace-address",
+			Usage:       "address of the trace exporter",
+			EnvVar:      "TRACE_ADDRESS",
+			Destination: &config.TraceAddress,
+		},
+		cli.StringFlag{
+			Name:        "trace-protocol",
+			Usage:       "protocol of the trace exporter",
+			EnvVar:      "TRACE_PROTOCOL",
+			Destination: &config.TraceProtocol,
+		},
+		cli.StringFlag{
+			Name:        "trace-secure",
+			Usage:       "export traces over a secure connection when set",
+			EnvVar:      "TRACE_SECURE",
+			Destination: &config.TraceSecure,
+		},
+		cli.GenericFlag{
+			Name:   "trace-headers",
+			Usage:  "comma separated list of key=value headers sent with traces",
+			EnvVar: "TRACE_HEADERS",
+			Value:  &config.TraceHeaders,
+		},
+		cli.StringFlag{
+			Name:        "aws-access-key-id",
+			Usage:       "aws access key id for the snssqs, ssm, and dynamodb components",
+			EnvVar:      "AWS_ACCESS_KEY_ID",
+			Destination: &config.AwsAccessKeyId,
+		},
+		cli.StringFlag{
+			Name:        "aws-secret-access-key",
+			Usage:       "aws secret access key for the snssqs, ssm, and dynamodb components",
+			EnvVar:      "AWS_SECRET_ACCESS_KEY",
+			Destination: &config.AwsSecretAccessKey,
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+	"github.com/w-h-a/sidecar/cmd/config"
+)
+
+func TestFlags(t *testing.T) {
+	testCases := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		assert func(t *testing.T)
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{},
+			args: []string{},
+			assert: func(t *testing.T) {
+				require.Equal(t, "", config.HttpAddress)
+				require.Equal(t, "", config.ComponentsPath)
+				require.Equal(t, time.Minute, config.ReapInterval)
+				require.Equal(t, 10, config.BulkParallelism)
+				require.Equal(t, 10000, config.QueryScanLimit)
+			},
+		},
+		{
+			name: "env vars",
+			env: map[string]string{
+				"HTTP_ADDRESS":     ":3501",
+				"COMPONENTS":       "env.yml",
+				"REAP_INTERVAL":    "5m",
+				"BULK_PARALLELISM": "4",
+				"STORES":           "orders,carts",
+			},
+			args: []string{},
+			assert: func(t *testing.T) {
+				require.Equal(t, ":3501", config.HttpAddress)
+				require.Equal(t, "env.yml", config.ComponentsPath)
+				require.Equal(t, 5*time.Minute, config.ReapInterval)
+				require.Equal(t, 4, config.BulkParallelism)
+				require.Equal(t, config.List{"orders", "carts"}, config.Stores)
+			},
+		},
+		{
+			name: "flags override env vars",
+			env: map[string]string{
+				"HTTP_ADDRESS":     ":3501",
+				"COMPONENTS":       "env.yml",
+				"REAP_INTERVAL":    "5m",
+				"BULK_PARALLELISM": "4",
+				"STORES":           "orders,carts",
+			},
+			args: []string{
+				"--http-address", ":4501",
+				"--components", "flag.yml",
+				"--reap-interval", "0",
+				"--bulk-parallelism", "2",
+				"--stores", "users",
+			},
+			assert: func(t *testing.T) {
+				require.Equal(t, ":4501", config.HttpAddress)
+				require.Equal(t, "flag.yml", config.ComponentsPath)
+				require.Equal(t, time.Duration(0), config.ReapInterval)
+				require.Equal(t, 2, config.BulkParallelism)
+				require.Equal(t, config.List{"users"}, config.Stores)
+			},
+		},
+		{
+			name: "flags without env vars",
+			env:  map[string]string{},
+			args: []string{
+				"--components", "flag.yml",
+			},
+			assert: func(t *testing.T) {
+				require.Equal(t, "flag.yml", config.ComponentsPath)
+				require.Equal(t, "", config.HttpAddress)
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// the env vars are restored once the test is done
+			for _, key := range []string{"HTTP_ADDRESS", "COMPONENTS", "REAP_INTERVAL", "BULK_PARALLELISM", "STORES"} {
+				t.Setenv(key, testCase.env[key])
+
+				if _, ok := testCase.env[key]; !ok {
+					os.Unsetenv(key)
+				}
+			}
+
+			config.HttpAddress = ""
+			config.ComponentsPath = ""
+			config.Stores = nil
+
+			app := cli.NewApp()
+
+			app.Writer = io.Discard
+
+			app.Commands = []cli.Command{
+				{
+					Name:   "sidecar",
+					Flags:  Flags(),
+					Action: func(ctx *cli.Context) {},
+				},
+			}
+
+			require.NoError(t, app.Run(append([]string{"cli", "sidecar"}, testCase.args...)))
+
+			testCase.assert(t)
+		})
+	}
+}
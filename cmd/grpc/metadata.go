@@ -0,0 +1,37 @@
+package grpc
+
+import (
+	"context"
+
+	"github.com/w-h-a/pkg/telemetry/tracev2"
+	"github.com/w-h-a/sidecar/metadata"
+	pbMetadata "github.com/w-h-a/sidecar/proto/metadata"
+)
+
+type MetadataHandler interface {
+	Get(ctx context.Context, req *pbMetadata.GetMetadataRequest, rsp *pbMetadata.GetMetadataResponse) error
+}
+
+type Metadata struct {
+	MetadataHandler
+}
+
+type metadataHandler struct {
+	describe func() *metadata.Metadata
+	tracer   tracev2.Trace
+}
+
+func (h *metadataHandler) Get(ctx context.Context, req *pbMetadata.GetMetadataRequest, rsp *pbMetadata.GetMetadataResponse) error {
+	_, spanId := h.tracer.Start(ctx, "grpc.MetadataHandler")
+	defer h.tracer.Finish(spanId)
+
+	rsp.Metadata = SerializeMetadata(h.describe())
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	return nil
+}
+
+func NewMetadataHandler(d func() *metadata.Metadata, t tracev2.Trace) MetadataHandler {
+	return &Metadata{&metadataHandler{d, t}}
+}
@@ -0,0 +1,133 @@
+package grpc
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	grpchandler "github.com/w-h-a/pkg/serverv2/grpc"
+	"github.com/w-h-a/pkg/utils/errorutils"
+	"github.com/w-h-a/pkg/utils/metadatautils"
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// NewServer serves the methods of the handlers by the names that pkg's
+// clients call them by. Unlike the server of pkg, it serves methods
+// that stream, and the statuses that handlers return reach the caller.
+func NewServer(handlers ...interface{}) *gogrpc.Server {
+	hs := map[string]*grpchandler.Handler{}
+
+	for _, h := range handlers {
+		handler := grpchandler.NewHandler(h)
+		hs[handler.Name] = handler
+	}
+
+	return gogrpc.NewServer(
+		gogrpc.UnknownServiceHandler(dispatch(hs)),
+		gogrpc.StreamInterceptor(statusInterceptor),
+	)
+}
+
+// dispatch calls the method of the handler that the call names. A method
+// that streams is called with the stream instead of a request and a
+// response.
+func dispatch(handlers map[string]*grpchandler.Handler) gogrpc.StreamHandler {
+	return func(_ interface{}, stream gogrpc.ServerStream) error {
+		fullMethod, _ := gogrpc.MethodFromServerStream(stream)
+
+		handlerName, methodName, err := grpchandler.ToHandlerMethod(fullMethod)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		handler, ok := handlers[handlerName]
+		if !ok {
+			return status.Errorf(codes.Unimplemented, "unknown handler %s", handlerName)
+		}
+
+		method, ok := handler.Methods[methodName]
+		if !ok {
+			return status.Errorf(codes.Unimplemented, "unknown method %s.%s", handlerName, methodName)
+		}
+
+		ctx, cancel := incomingContext(stream.Context())
+		defer cancel()
+
+		args := []reflect.Value{handler.Receiver, reflect.ValueOf(ctx)}
+
+		if method.Stream {
+			args = append(args, reflect.ValueOf(stream))
+			return call(method, args)
+		}
+
+		req := reflect.New(method.ReqType.Elem())
+		rsp := reflect.New(method.RspType.Elem())
+
+		if err := stream.RecvMsg(req.Interface()); err != nil {
+			return err
+		}
+
+		if err := call(method, append(args, req, rsp)); err != nil {
+			return err
+		}
+
+		return stream.SendMsg(rsp.Interface())
+	}
+}
+
+func call(method *grpchandler.Method, args []reflect.Value) error {
+	if e := method.Value.Call(args)[0].Interface(); e != nil {
+		return e.(error)
+	}
+
+	return nil
+}
+
+// incomingContext carries the metadata of the call and, when the caller
+// sets one, its timeout the way the server of pkg does
+func incomingContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	grpcMetadata, _ := metadata.FromIncomingContext(ctx)
+
+	md := metadatautils.Metadata{}
+
+	for k, v := range grpcMetadata {
+		md[k] = strings.Join(v, ", ")
+	}
+
+	timeout := md["timeout"]
+	delete(md, "timeout")
+
+	ctx = metadatautils.NewContext(ctx, md)
+
+	if n, err := strconv.ParseUint(timeout, 10, 64); err == nil {
+		return context.WithTimeout(ctx, time.Duration(n))
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// statusInterceptor passes the statuses of handlers through and maps
+// the errors of pkg to codes with pkg's ToErrorCode, except for a
+// conflict, which it does not know
+func statusInterceptor(srv interface{}, stream gogrpc.ServerStream, info *gogrpc.StreamServerInfo, handler gogrpc.StreamHandler) error {
+	err := handler(srv, stream)
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	if e, ok := err.(*errorutils.Error); ok && e.Code == http.StatusConflict {
+		return status.Error(codes.Aborted, err.Error())
+	}
+
+	return status.Error(grpchandler.ToErrorCode(err), err.Error())
+}
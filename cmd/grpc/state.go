@@ -3,20 +3,31 @@ package grpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
-	pb "github.com/w-h-a/pkg/proto/sidecar"
 	"github.com/w-h-a/pkg/sidecar"
 	"github.com/w-h-a/pkg/store"
 	"github.com/w-h-a/pkg/telemetry/tracev2"
 	"github.com/w-h-a/pkg/utils/errorutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"github.com/w-h-a/sidecar/state"
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type StateHandler interface {
-	Post(ctx context.Context, req *pb.PostStateRequest, rsp *pb.PostStateResponse) error
-	List(ctx context.Context, req *pb.ListStateRequest, rsp *pb.ListStateResponse) error
-	Get(ctx context.Context, req *pb.GetStateRequest, rsp *pb.GetStateResponse) error
-	Delete(ctx context.Context, req *pb.DeleteStateRequest, rsp *pb.DeleteStateResponse) error
+	Post(ctx context.Context, req *pbState.PostStateRequest, rsp *pbState.PostStateResponse) error
+	List(ctx context.Context, req *pbState.ListStateRequest, rsp *pbState.ListStateResponse) error
+	Get(ctx context.Context, req *pbState.GetStateRequest, rsp *pbState.GetStateResponse) error
+	Delete(ctx context.Context, req *pbState.DeleteStateRequest, rsp *pbState.DeleteStateResponse) error
+	Transact(ctx context.Context, req *pbState.TransactStateRequest, rsp *pbState.TransactStateResponse) error
+	BulkGet(ctx context.Context, req *pbState.BulkGetStateRequest, rsp *pbState.BulkGetStateResponse) error
+	Query(ctx context.Context, req *pbState.QueryStateRequest, rsp *pbState.QueryStateResponse) error
+	BulkDelete(ctx context.Context, req *pbState.BulkDeleteStateRequest, rsp *pbState.BulkDeleteStateResponse) error
+	BulkDeleteStream(ctx context.Context, stream gogrpc.ServerStream) error
 }
 
 type State struct {
@@ -25,10 +36,11 @@ type State struct {
 
 type stateHandler struct {
 	service sidecar.Sidecar
+	state   *state.State
 	tracer  tracev2.Trace
 }
 
-func (h *stateHandler) Post(ctx context.Context, req *pb.PostStateRequest, rsp *pb.PostStateResponse) error {
+func (h *stateHandler) Post(ctx context.Context, req *pbState.PostStateRequest, rsp *pbState.PostStateResponse) error {
 	newCtx, spanId := h.tracer.Start(ctx, "grpc.PostStateHandler")
 	defer h.tracer.Finish(spanId)
 
@@ -39,14 +51,61 @@ func (h *stateHandler) Post(ctx context.Context, req *pb.PostStateRequest, rsp *
 		"records": string(records),
 	})
 
-	state := &sidecar.State{
-		StoreId: req.StoreId,
-		Records: DeserializeRecords(req.Records),
+	values := make([][]byte, len(req.Records))
+
+	for i, pair := range req.Records {
+		if pair.TtlInSeconds < 0 {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected the ttl of record %s to be a non-negative number of seconds", pair.Key))
+			return errorutils.BadRequest("sidecar", "expected the ttl of record %s to be a non-negative number of seconds", pair.Key)
+		}
+
+		value, err := DeserializeValue(pair)
+		if err != nil {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to decode the value of record %s: %v", pair.Key, err))
+			return errorutils.BadRequest("sidecar", "failed to decode the value of record %s: %v", pair.Key, err)
+		}
+
+		values[i] = value
+	}
+
+	var err error
+
+	// plain records are saved by the sidecar and the others are written
+	// together, so that a store that is a transactor writes every record
+	// or none of them
+	if plain(req.Records) {
+		state := &sidecar.State{
+			StoreId: req.StoreId,
+			Records: DeserializeRecords(req.Records),
+		}
+
+		err = h.service.SaveStateToStore(newCtx, state)
+	} else {
+		ops := []state.Operation{}
+
+		for i, pair := range req.Records {
+			ops = append(ops, state.Operation{
+				Record: &store.Record{
+					Key:    pair.Key,
+					Value:  values[i],
+					Expiry: time.Duration(pair.TtlInSeconds) * time.Second,
+				},
+				Etag: pair.Etag,
+			})
+		}
+
+		err = h.state.WriteAll(req.StoreId, ops)
 	}
 
-	if err := h.service.SaveStateToStore(newCtx, state); err != nil && err == sidecar.ErrComponentNotFound {
+	if err != nil && err == sidecar.ErrComponentNotFound {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
 		return errorutils.NotFound("sidecar", "%v: %s", err, req.StoreId)
+	} else if err != nil && err == state.ErrEtagMismatch {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s: %v", req.StoreId, err))
+		return status.Errorf(codes.Aborted, "failed to save state to store %s: %v", req.StoreId, err)
+	} else if err != nil && err == state.ErrNotSwappable {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s: %v", req.StoreId, err))
+		return status.Errorf(codes.Unimplemented, "failed to save state to store %s: %v", req.StoreId, err)
 	} else if err != nil {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s: %v", req.StoreId, err))
 		return errorutils.InternalServerError("sidecar", "failed to save state to store %s: %v", req.StoreId, err)
@@ -57,31 +116,70 @@ func (h *stateHandler) Post(ctx context.Context, req *pb.PostStateRequest, rsp *
 	return nil
 }
 
-func (h *stateHandler) List(ctx context.Context, req *pb.ListStateRequest, rsp *pb.ListStateResponse) error {
+func (h *stateHandler) List(ctx context.Context, req *pbState.ListStateRequest, rsp *pbState.ListStateResponse) error {
 	newCtx, spanId := h.tracer.Start(ctx, "grpc.ListStateHandler")
 	defer h.tracer.Finish(spanId)
 
+	var updatedSince time.Time
+
+	var since string
+
+	if req.UpdatedSince != nil {
+		updatedSince = req.UpdatedSince.AsTime()
+		since = updatedSince.Format(time.RFC3339Nano)
+	}
+
 	h.tracer.AddMetadata(spanId, map[string]string{
-		"storeId": req.StoreId,
+		"storeId":      req.StoreId,
+		"prefix":       req.Prefix,
+		"limit":        fmt.Sprintf("%d", req.Limit),
+		"cursor":       req.Cursor,
+		"updatedSince": since,
 	})
 
-	recs, err := h.service.ListStateFromStore(newCtx, req.StoreId)
+	var recs []*store.Record
+
+	var err error
+
+	// without paging we list the way that the sidecar always has
+	if len(req.Prefix) == 0 && req.Limit == 0 && len(req.Cursor) == 0 && updatedSince.IsZero() {
+		recs, err = h.service.ListStateFromStore(newCtx, req.StoreId)
+	} else {
+		var page *state.Page
+		if page, err = h.state.List(req.StoreId, req.Prefix, req.Cursor, updatedSince, uint(req.Limit)); err == nil {
+			recs = page.Records
+			rsp.NextCursor = page.NextCursor
+		}
+	}
+
 	if err != nil && err == sidecar.ErrComponentNotFound {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
 		return errorutils.NotFound("sidecar", "%v: %s", err, req.StoreId)
+	} else if err != nil && err == state.ErrInvalidCursor {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.Cursor))
+		return errorutils.BadRequest("sidecar", "%v: %s", err, req.Cursor)
+	} else if err != nil && err == state.ErrNoMetadata {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
+		return status.Errorf(codes.Unimplemented, "%s: %s", err.Error(), req.StoreId)
 	} else if err != nil {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to retrieve state from store %s: %v", req.StoreId, err))
 		return errorutils.InternalServerError("sidecar", "failed to retrieve state from store %s: %v", req.StoreId, err)
 	}
 
-	rsp.Records = SerializeRecords(recs)
+	stamped, err := h.state.Stamp(req.StoreId, recs)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read the metadata of state from store %s: %v", req.StoreId, err))
+		return errorutils.InternalServerError("sidecar", "failed to read the metadata of state from store %s: %v", req.StoreId, err)
+	}
+
+	rsp.Records = SerializeRecords(stamped)
 
 	h.tracer.UpdateStatus(spanId, 2, "success")
 
 	return nil
 }
 
-func (h *stateHandler) Get(ctx context.Context, req *pb.GetStateRequest, rsp *pb.GetStateResponse) error {
+func (h *stateHandler) Get(ctx context.Context, req *pbState.GetStateRequest, rsp *pbState.GetStateResponse) error {
 	newCtx, spanId := h.tracer.Start(ctx, "grpc.GetStateHandler")
 	defer h.tracer.Finish(spanId)
 
@@ -102,25 +200,46 @@ func (h *stateHandler) Get(ctx context.Context, req *pb.GetStateRequest, rsp *pb
 		return errorutils.InternalServerError("sidecar", "failed to retrieve state from store %s and key %s: %v", req.StoreId, req.Key, err)
 	}
 
-	rsp.Records = SerializeRecords(recs)
+	stamped, err := h.state.Stamp(req.StoreId, recs)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read the metadata of state from store %s: %v", req.StoreId, err))
+		return errorutils.InternalServerError("sidecar", "failed to read the metadata of state from store %s: %v", req.StoreId, err)
+	}
+
+	rsp.Records = SerializeRecords(stamped)
 
 	h.tracer.UpdateStatus(spanId, 2, "success")
 
 	return nil
 }
 
-func (h *stateHandler) Delete(ctx context.Context, req *pb.DeleteStateRequest, rsp *pb.DeleteStateResponse) error {
+func (h *stateHandler) Delete(ctx context.Context, req *pbState.DeleteStateRequest, rsp *pbState.DeleteStateResponse) error {
 	newCtx, spanId := h.tracer.Start(ctx, "grpc.DeleteStateHandler")
 	defer h.tracer.Finish(spanId)
 
 	h.tracer.AddMetadata(spanId, map[string]string{
 		"storeId": req.StoreId,
 		"key":     req.Key,
+		"etag":    req.Etag,
 	})
 
-	if err := h.service.RemoveStateFromStore(newCtx, req.StoreId, req.Key); err != nil && err == sidecar.ErrComponentNotFound {
+	var err error
+
+	if len(req.Etag) == 0 {
+		err = h.service.RemoveStateFromStore(newCtx, req.StoreId, req.Key)
+	} else {
+		err = h.state.Delete(req.StoreId, req.Key, req.Etag)
+	}
+
+	if err != nil && err == sidecar.ErrComponentNotFound {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
 		return errorutils.NotFound("sidecar", "%v: %s", err, req.StoreId)
+	} else if err != nil && err == state.ErrEtagMismatch {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to remove state from store %s and key %s: %v", req.StoreId, req.Key, err))
+		return status.Errorf(codes.Aborted, "failed to remove state from store %s and key %s: %v", req.StoreId, req.Key, err)
+	} else if err != nil && err == state.ErrNotSwappable {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to remove state from store %s and key %s: %v", req.StoreId, req.Key, err))
+		return status.Errorf(codes.Unimplemented, "failed to remove state from store %s and key %s: %v", req.StoreId, req.Key, err)
 	} else if err != nil {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to remove state from store %s and key %s: %v", req.StoreId, req.Key, err))
 		return errorutils.InternalServerError("sidecar", "failed to remove state from store %s and key %s: %v", req.StoreId, req.Key, err)
@@ -131,6 +250,235 @@ func (h *stateHandler) Delete(ctx context.Context, req *pb.DeleteStateRequest, r
 	return nil
 }
 
-func NewStateHandler(s sidecar.Sidecar, t tracev2.Trace) StateHandler {
-	return &State{&stateHandler{s, t}}
+func (h *stateHandler) Transact(ctx context.Context, req *pbState.TransactStateRequest, rsp *pbState.TransactStateResponse) error {
+	_, spanId := h.tracer.Start(ctx, "grpc.TransactStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	operations, _ := json.Marshal(req.Operations)
+
+	events, _ := json.Marshal(req.Events)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId":    req.StoreId,
+		"operations": string(operations),
+		"events":     string(events),
+	})
+
+	ops, err := DeserializeOperations(req.Operations)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		return errorutils.BadRequest("sidecar", "%v", err)
+	}
+
+	err = h.state.TransactWithEvents(req.StoreId, ops, DeserializeEvents(req.Events))
+	if err != nil && err == sidecar.ErrComponentNotFound {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
+		return errorutils.NotFound("sidecar", "%v: %s", err, req.StoreId)
+	} else if err != nil && (err == state.ErrNotTransactional || err == state.ErrNoOutbox) {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
+		return status.Errorf(codes.Unimplemented, "%v: %s", err, req.StoreId)
+	} else if err != nil && errors.Is(err, state.ErrInvalidEvent) {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		return errorutils.BadRequest("sidecar", "%v", err)
+	} else if err != nil && err == state.ErrEtagMismatch {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to apply transaction to store %s: %v", req.StoreId, err))
+		return status.Errorf(codes.Aborted, "failed to apply transaction to store %s: %v", req.StoreId, err)
+	} else if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to apply transaction to store %s: %v", req.StoreId, err))
+		return errorutils.InternalServerError("sidecar", "failed to apply transaction to store %s: %v", req.StoreId, err)
+	}
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	return nil
+}
+
+func (h *stateHandler) BulkGet(ctx context.Context, req *pbState.BulkGetStateRequest, rsp *pbState.BulkGetStateResponse) error {
+	_, spanId := h.tracer.Start(ctx, "grpc.BulkGetStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	keys, _ := json.Marshal(req.Keys)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId": req.StoreId,
+		"keys":    string(keys),
+	})
+
+	for i, key := range req.Keys {
+		if len(key) == 0 {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected key %d to not be empty", i))
+			return errorutils.BadRequest("sidecar", "expected key %d to not be empty", i)
+		}
+	}
+
+	bulk, err := h.state.BulkGet(req.StoreId, req.Keys)
+	if err != nil && err == sidecar.ErrComponentNotFound {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
+		return errorutils.NotFound("sidecar", "%v: %s", err, req.StoreId)
+	} else if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to retrieve state from store %s: %v", req.StoreId, err))
+		return errorutils.InternalServerError("sidecar", "failed to retrieve state from store %s: %v", req.StoreId, err)
+	}
+
+	stamped, err := h.state.Stamp(req.StoreId, bulk.Records)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read the metadata of state from store %s: %v", req.StoreId, err))
+		return errorutils.InternalServerError("sidecar", "failed to read the metadata of state from store %s: %v", req.StoreId, err)
+	}
+
+	rsp.Records = SerializeRecords(stamped)
+
+	rsp.Missing = bulk.Missing
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	return nil
+}
+
+func (h *stateHandler) Query(ctx context.Context, req *pbState.QueryStateRequest, rsp *pbState.QueryStateResponse) error {
+	_, spanId := h.tracer.Start(ctx, "grpc.QueryStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	filter, _ := json.Marshal(req.Filter)
+
+	sort, _ := json.Marshal(req.Sort)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId": req.StoreId,
+		"filter":  string(filter),
+		"sort":    string(sort),
+		"limit":   fmt.Sprintf("%d", req.Limit),
+		"cursor":  req.Cursor,
+	})
+
+	sorts, err := DeserializeSorts(req.Sort)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		return errorutils.BadRequest("sidecar", "%v", err)
+	}
+
+	page, err := h.state.Query(req.StoreId, DeserializeFilter(req.Filter), sorts, req.Cursor, uint(req.Limit))
+	if err != nil && err == sidecar.ErrComponentNotFound {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
+		return errorutils.NotFound("sidecar", "%v: %s", err, req.StoreId)
+	} else if err != nil && err == state.ErrInvalidCursor {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.Cursor))
+		return errorutils.BadRequest("sidecar", "%v: %s", err, req.Cursor)
+	} else if err != nil && errors.Is(err, state.ErrInvalidQuery) {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		return errorutils.BadRequest("sidecar", "%v", err)
+	} else if err != nil && err == state.ErrQueryTooLarge {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
+		return status.Errorf(codes.Unimplemented, "%v: %s", err, req.StoreId)
+	} else if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to query state from store %s: %v", req.StoreId, err))
+		return errorutils.InternalServerError("sidecar", "failed to query state from store %s: %v", req.StoreId, err)
+	}
+
+	stamped, err := h.state.Stamp(req.StoreId, page.Records)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read the metadata of state from store %s: %v", req.StoreId, err))
+		return errorutils.InternalServerError("sidecar", "failed to read the metadata of state from store %s: %v", req.StoreId, err)
+	}
+
+	rsp.Records = SerializeRecords(stamped)
+
+	rsp.NextCursor = page.NextCursor
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	return nil
+}
+
+func (h *stateHandler) BulkDelete(ctx context.Context, req *pbState.BulkDeleteStateRequest, rsp *pbState.BulkDeleteStateResponse) error {
+	_, spanId := h.tracer.Start(ctx, "grpc.BulkDeleteStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	deleted, err := h.bulkDelete(spanId, req, nil)
+	if err != nil {
+		return err
+	}
+
+	rsp.Deleted = int64(deleted)
+
+	rsp.Done = true
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	return nil
+}
+
+// BulkDeleteStream receives one request and sends the count of records
+// deleted so far after every batch until it sends the one that is done
+func (h *stateHandler) BulkDeleteStream(ctx context.Context, stream gogrpc.ServerStream) error {
+	_, spanId := h.tracer.Start(ctx, "grpc.BulkDeleteStreamStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	req := &pbState.BulkDeleteStateRequest{}
+
+	if err := stream.RecvMsg(req); err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to receive request: %v", err))
+		return errorutils.BadRequest("sidecar", "failed to receive request: %v", err)
+	}
+
+	var sendErr error
+
+	deleted, err := h.bulkDelete(spanId, req, func(deleted int) {
+		if sendErr == nil {
+			sendErr = stream.SendMsg(&pbState.BulkDeleteStateResponse{Deleted: int64(deleted)})
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if sendErr == nil {
+		sendErr = stream.SendMsg(&pbState.BulkDeleteStateResponse{Deleted: int64(deleted), Done: true})
+	}
+
+	if sendErr != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to send progress: %v", sendErr))
+		return errorutils.InternalServerError("sidecar", "failed to send progress: %v", sendErr)
+	}
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	return nil
+}
+
+func (h *stateHandler) bulkDelete(spanId string, req *pbState.BulkDeleteStateRequest, progress func(int)) (int, error) {
+	keys, _ := json.Marshal(req.Keys)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId": req.StoreId,
+		"keys":    string(keys),
+		"prefix":  req.Prefix,
+	})
+
+	if (len(req.Keys) == 0) == (len(req.Prefix) == 0) {
+		h.tracer.UpdateStatus(spanId, 1, "expected either keys or a prefix")
+		return 0, errorutils.BadRequest("sidecar", "expected either keys or a prefix")
+	}
+
+	for i, key := range req.Keys {
+		if len(key) == 0 {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected key %d to not be empty", i))
+			return 0, errorutils.BadRequest("sidecar", "expected key %d to not be empty", i)
+		}
+	}
+
+	deleted, err := h.state.BulkDelete(req.StoreId, req.Keys, req.Prefix, progress)
+	if err != nil && err == sidecar.ErrComponentNotFound {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), req.StoreId))
+		return deleted, errorutils.NotFound("sidecar", "%v: %s", err, req.StoreId)
+	} else if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to remove state from store %s after %d records: %v", req.StoreId, deleted, err))
+		return deleted, errorutils.InternalServerError("sidecar", "failed to remove state from store %s after %d records: %v", req.StoreId, deleted, err)
+	}
+
+	return deleted, nil
+}
+
+func NewStateHandler(s sidecar.Sidecar, st *state.State, t tracev2.Trace) StateHandler {
+	return &State{&stateHandler{s, st, t}}
 }
@@ -1,21 +1,30 @@
 package grpc
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	pb "github.com/w-h-a/pkg/proto/sidecar"
 	pbTrace "github.com/w-h-a/pkg/proto/trace"
 	"github.com/w-h-a/pkg/sidecar"
 	"github.com/w-h-a/pkg/store"
 	"github.com/w-h-a/pkg/telemetry/traceexporter"
+	"github.com/w-h-a/sidecar/metadata"
+	pbMetadata "github.com/w-h-a/sidecar/proto/metadata"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"github.com/w-h-a/sidecar/state"
 	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-func DeserializeRecords(pairs []*pb.KeyVal) []sidecar.Record {
+func DeserializeRecords(pairs []*pbState.KeyVal) []sidecar.Record {
 	records := []sidecar.Record{}
 
 	for _, pair := range pairs {
 		record := sidecar.Record{
 			Key:   pair.Key,
-			Value: pair.Value.Value,
+			Value: pair.Value.GetValue(),
 		}
 		records = append(records, record)
 	}
@@ -23,26 +32,187 @@ func DeserializeRecords(pairs []*pb.KeyVal) []sidecar.Record {
 	return records
 }
 
-func SerializeRecords(recs []*store.Record) []*pb.KeyVal {
-	pairs := []*pb.KeyVal{}
+// DeserializeValue returns the bytes that store the value of the record
+// with its content type
+func DeserializeValue(pair *pbState.KeyVal) ([]byte, error) {
+	return state.Encode(&state.Value{
+		Data:        pair.Value.GetValue(),
+		ContentType: pair.ContentType,
+	})
+}
+
+// DeserializeOperations checks the operations of a transaction and
+// turns them into the operations of the state package
+func DeserializeOperations(ops []*pbState.TransactionOperation) ([]state.Operation, error) {
+	operations := []state.Operation{}
+
+	for i, op := range ops {
+		if op.Operation != "upsert" && op.Operation != "delete" {
+			return nil, fmt.Errorf("expected operation %d to be upsert or delete", i)
+		}
+
+		if op.Record == nil || len(op.Record.Key) == 0 {
+			return nil, fmt.Errorf("expected operation %d to have a record with a key", i)
+		}
 
-	for _, record := range recs {
-		pair := &pb.KeyVal{
-			Key:   record.Key,
-			Value: &anypb.Any{Value: record.Value},
+		if op.Record.TtlInSeconds < 0 {
+			return nil, fmt.Errorf("expected the ttl of record %s to be a non-negative number of seconds", op.Record.Key)
 		}
+
+		value, err := DeserializeValue(op.Record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the value of record %s: %v", op.Record.Key, err)
+		}
+
+		operations = append(operations, state.Operation{
+			Delete: op.Operation == "delete",
+			Record: &store.Record{
+				Key:    op.Record.Key,
+				Value:  value,
+				Expiry: time.Duration(op.Record.TtlInSeconds) * time.Second,
+			},
+			Etag: op.Record.Etag,
+		})
+	}
+
+	return operations, nil
+}
+
+// DeserializeEvents turns the events of a transaction into the events
+// of the state package, which checks them
+func DeserializeEvents(evs []*pbState.OutboxEvent) []*state.Event {
+	events := []*state.Event{}
+
+	for _, ev := range evs {
+		events = append(events, &state.Event{
+			EventName: ev.EventName,
+			Payload:   ev.Payload,
+		})
+	}
+
+	return events
+}
+
+// DeserializeFilter turns the filter of a query into the filter of the
+// state package, which checks it
+func DeserializeFilter(f *pbState.QueryFilter) *state.Filter {
+	if f == nil {
+		return nil
+	}
+
+	filter := &state.Filter{
+		Op:   strings.ToUpper(f.Op),
+		Path: f.Path,
+	}
+
+	for _, value := range f.Values {
+		filter.Values = append(filter.Values, value.AsInterface())
+	}
+
+	for _, sub := range f.Filters {
+		filter.Filters = append(filter.Filters, DeserializeFilter(sub))
+	}
+
+	return filter
+}
+
+func DeserializeSorts(sorts []*pbState.QuerySort) ([]state.Sort, error) {
+	ss := []state.Sort{}
+
+	for _, srt := range sorts {
+		order := strings.ToUpper(srt.Order)
+
+		if order != "" && order != "ASC" && order != "DESC" {
+			return nil, fmt.Errorf("expected the order of sort %s to be ASC or DESC", srt.Path)
+		}
+
+		ss = append(ss, state.Sort{
+			Path:       srt.Path,
+			Descending: order == "DESC",
+		})
+	}
+
+	return ss, nil
+}
+
+func SerializeRecords(recs []*state.Stamped) []*pbState.KeyVal {
+	pairs := []*pbState.KeyVal{}
+
+	for _, stamped := range recs {
+		record := stamped.Record
+
+		value := state.Decode(record.Value)
+
+		pair := &pbState.KeyVal{
+			Key:         record.Key,
+			Value:       &anypb.Any{Value: value.Data},
+			Etag:        state.Etag(record.Value, stamped.Meta),
+			ContentType: value.ContentType,
+		}
+
+		if meta := stamped.Meta; meta != nil {
+			pair.CreatedAt = timestamppb.New(meta.CreatedAt)
+			pair.UpdatedAt = timestamppb.New(meta.UpdatedAt)
+			pair.Version = meta.Version
+		}
+
 		pairs = append(pairs, pair)
 	}
 
 	return pairs
 }
 
+// plain tells whether the sidecar can save the records as they are,
+// which it cannot do with records that have etags, ttls, or content types
+func plain(pairs []*pbState.KeyVal) bool {
+	for _, pair := range pairs {
+		if len(pair.Etag) > 0 || pair.TtlInSeconds != 0 || len(pair.ContentType) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
 func SerializeSecret(secret *sidecar.Secret) *pb.Secret {
 	return &pb.Secret{
 		Data: secret.Data,
 	}
 }
 
+func SerializeMetadata(m *metadata.Metadata) *pbMetadata.Metadata {
+	return &pbMetadata.Metadata{
+		Namespace: m.Namespace,
+		Name:      m.Name,
+		Version:   m.Version,
+		App: &pbMetadata.App{
+			Port:     m.App.Port,
+			Protocol: m.App.Protocol,
+		},
+		Stores:        SerializeComponents(m.Stores),
+		Producers:     SerializeComponents(m.Producers),
+		Consumers:     SerializeComponents(m.Consumers),
+		Secrets:       SerializeComponents(m.Secrets),
+		TraceExporter: m.TraceExporter,
+	}
+}
+
+func SerializeComponents(cs []metadata.Component) []*pbMetadata.Component {
+	components := []*pbMetadata.Component{}
+
+	for _, c := range cs {
+		component := &pbMetadata.Component{
+			Name:  c.Name,
+			Type:  c.Type,
+			Topic: c.Topic,
+			Group: c.Group,
+		}
+		components = append(components, component)
+	}
+
+	return components
+}
+
 func SerializeSpan(s *traceexporter.SpanData) *pbTrace.Span {
 	return &pbTrace.Span{
 		Name:     s.Name,
@@ -0,0 +1,34 @@
+package http
+
+import (
+	gohttp "net/http"
+
+	"github.com/w-h-a/pkg/telemetry/tracev2"
+	"github.com/w-h-a/pkg/utils/httputils"
+	"github.com/w-h-a/pkg/utils/metadatautils"
+	"github.com/w-h-a/sidecar/metadata"
+)
+
+type MetadataHandler interface {
+	HandleGet(w gohttp.ResponseWriter, r *gohttp.Request)
+}
+
+type metadataHandler struct {
+	describe func() *metadata.Metadata
+	tracer   tracev2.Trace
+}
+
+func (h *metadataHandler) HandleGet(w gohttp.ResponseWriter, r *gohttp.Request) {
+	ctx := metadatautils.RequestToContext(r)
+
+	_, spanId := h.tracer.Start(ctx, "http.MetadataHandler")
+	defer h.tracer.Finish(spanId)
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	httputils.OkResponse(w, h.describe())
+}
+
+func NewMetadataHandler(d func() *metadata.Metadata, t tracev2.Trace) MetadataHandler {
+	return &metadataHandler{d, t}
+}
@@ -1,9 +1,15 @@
 package http
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	gohttp "net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/w-h-a/pkg/sidecar"
@@ -12,17 +18,24 @@ import (
 	"github.com/w-h-a/pkg/utils/errorutils"
 	"github.com/w-h-a/pkg/utils/httputils"
 	"github.com/w-h-a/pkg/utils/metadatautils"
+	"github.com/w-h-a/sidecar/state"
 )
 
 type StateHandler interface {
 	HandlePost(w gohttp.ResponseWriter, r *gohttp.Request)
 	HandleList(w gohttp.ResponseWriter, r *gohttp.Request)
 	HandleGet(w gohttp.ResponseWriter, r *gohttp.Request)
+	HandlePut(w gohttp.ResponseWriter, r *gohttp.Request)
 	HandleDelete(w gohttp.ResponseWriter, r *gohttp.Request)
+	HandleTransact(w gohttp.ResponseWriter, r *gohttp.Request)
+	HandleBulkGet(w gohttp.ResponseWriter, r *gohttp.Request)
+	HandleQuery(w gohttp.ResponseWriter, r *gohttp.Request)
+	HandleBulkDelete(w gohttp.ResponseWriter, r *gohttp.Request)
 }
 
 type stateHandler struct {
 	service sidecar.Sidecar
+	state   *state.State
 	tracer  tracev2.Trace
 }
 
@@ -44,7 +57,7 @@ func (h *stateHandler) HandlePost(w gohttp.ResponseWriter, r *gohttp.Request) {
 		return
 	}
 
-	var records []sidecar.Record
+	var records []Record
 
 	decoder := json.NewDecoder(r.Body)
 
@@ -54,6 +67,38 @@ func (h *stateHandler) HandlePost(w gohttp.ResponseWriter, r *gohttp.Request) {
 		return
 	}
 
+	// if-match is the etag of the one record that is written
+	if ifMatch := r.Header.Get("If-Match"); len(ifMatch) > 0 {
+		if len(records) != 1 {
+			h.tracer.UpdateStatus(spanId, 1, "expected one record with the If-Match header")
+			httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected one record with the If-Match header"))
+			return
+		}
+
+		if len(records[0].Etag) == 0 {
+			records[0].Etag = parseEtag(ifMatch)
+		}
+	}
+
+	values := make([][]byte, len(records))
+
+	for i, record := range records {
+		if record.TtlInSeconds < 0 {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected the ttl of record %s to be a non-negative number of seconds", record.Key))
+			httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected the ttl of record %s to be a non-negative number of seconds", record.Key))
+			return
+		}
+
+		value, err := DeserializeValue(record)
+		if err != nil {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to decode the value of record %s: %v", record.Key, err))
+			httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "failed to decode the value of record %s: %v", record.Key, err))
+			return
+		}
+
+		values[i] = value
+	}
+
 	bytes, _ := json.Marshal(records)
 
 	h.tracer.AddMetadata(spanId, map[string]string{
@@ -61,15 +106,47 @@ func (h *stateHandler) HandlePost(w gohttp.ResponseWriter, r *gohttp.Request) {
 		"records": string(bytes),
 	})
 
-	state := &sidecar.State{
-		StoreId: storeId,
-		Records: records,
+	var err error
+
+	// plain records are saved by the sidecar and the others are written
+	// together, so that a store that is a transactor writes every record
+	// or none of them
+	if plain(records) {
+		state := &sidecar.State{
+			StoreId: storeId,
+			Records: DeserializeRecords(records),
+		}
+
+		err = h.service.SaveStateToStore(newCtx, state)
+	} else {
+		ops := []state.Operation{}
+
+		for i, record := range records {
+			ops = append(ops, state.Operation{
+				Record: &store.Record{
+					Key:    record.Key,
+					Value:  values[i],
+					Expiry: time.Duration(record.TtlInSeconds) * time.Second,
+				},
+				Etag: record.Etag,
+			})
+		}
+
+		err = h.state.WriteAll(storeId, ops)
 	}
 
-	if err := h.service.SaveStateToStore(newCtx, state); err != nil && err == sidecar.ErrComponentNotFound {
+	if err != nil && err == sidecar.ErrComponentNotFound {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
 		httputils.ErrResponse(w, errorutils.NotFound("sidecar", "%s: %s", err.Error(), storeId))
 		return
+	} else if err != nil && err == state.ErrEtagMismatch {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("failed to save state to store %s: %v", storeId, err), gohttp.StatusConflict))
+		return
+	} else if err != nil && err == state.ErrNotSwappable {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("failed to save state to store %s: %v", storeId, err), gohttp.StatusNotImplemented))
+		return
 	} else if err != nil {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s: %v", storeId, err))
 		httputils.ErrResponse(w, errorutils.InternalServerError("failed to save state to store %s: %v", storeId, err))
@@ -86,29 +163,95 @@ func (h *stateHandler) HandleList(w gohttp.ResponseWriter, r *gohttp.Request) {
 
 	storeId := params["storeId"]
 
+	query := r.URL.Query()
+
+	prefix := query.Get("prefix")
+
+	cursor := query.Get("cursor")
+
+	since := query.Get("updatedSince")
+
 	ctx := metadatautils.RequestToContext(r)
 
 	newCtx, spanId := h.tracer.Start(ctx, "http.ListStateHandler")
 	defer h.tracer.Finish(spanId)
 
-	recs, err := h.service.ListStateFromStore(newCtx, storeId)
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId":      storeId,
+		"prefix":       prefix,
+		"limit":        query.Get("limit"),
+		"cursor":       cursor,
+		"updatedSince": since,
+	})
+
+	var limit uint64
+
+	if l := query.Get("limit"); len(l) > 0 {
+		var err error
+		if limit, err = strconv.ParseUint(l, 10, 32); err != nil {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected limit to be a non-negative integer: %s", l))
+			httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected limit to be a non-negative integer: %s", l))
+			return
+		}
+	}
+
+	var updatedSince time.Time
+
+	if len(since) > 0 {
+		var err error
+		if updatedSince, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected updatedSince to be an RFC 3339 time: %s", since))
+			httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected updatedSince to be an RFC 3339 time: %s", since))
+			return
+		}
+	}
+
+	// a page is only returned when one is asked for so that the
+	// response of a plain list stays an array of records
+	paged := query.Has("limit") || query.Has("cursor")
+
+	var recs []*store.Record
+
+	var nextCursor string
+
+	var err error
+
+	if len(prefix) == 0 && !paged && updatedSince.IsZero() {
+		recs, err = h.service.ListStateFromStore(newCtx, storeId)
+	} else {
+		var page *state.Page
+		if page, err = h.state.List(storeId, prefix, cursor, updatedSince, uint(limit)); err == nil {
+			recs = page.Records
+			nextCursor = page.NextCursor
+		}
+	}
+
 	if err != nil && err == sidecar.ErrComponentNotFound {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
 		httputils.ErrResponse(w, errorutils.NotFound("sidecar", "%s: %s", err.Error(), storeId))
 		return
+	} else if err != nil && err == state.ErrInvalidCursor {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), cursor))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "%s: %s", err.Error(), cursor))
+		return
+	} else if err != nil && err == state.ErrNoMetadata {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("%s: %s", err.Error(), storeId), gohttp.StatusNotImplemented))
+		return
 	} else if err != nil {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to retrieve state from store %s: %v", storeId, err))
 		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to retrieve state from store %s: %v", storeId, err))
 		return
 	}
 
-	if len(recs) == 0 {
-		h.tracer.UpdateStatus(spanId, 2, "success")
-		httputils.OkResponse(w, []sidecar.Record{})
+	stamped, err := h.state.Stamp(storeId, recs)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read the metadata of state from store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to read the metadata of state from store %s: %v", storeId, err))
 		return
 	}
 
-	sidecarRecords, err := SerializeRecords(recs)
+	sidecarRecords, err := SerializeRecords(stamped)
 	if err != nil {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to serialize records: %v", err))
 		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to serialize records: %v", err))
@@ -117,6 +260,11 @@ func (h *stateHandler) HandleList(w gohttp.ResponseWriter, r *gohttp.Request) {
 
 	h.tracer.UpdateStatus(spanId, 2, "success")
 
+	if paged {
+		httputils.OkResponse(w, Page{Records: sidecarRecords, NextCursor: nextCursor})
+		return
+	}
+
 	httputils.OkResponse(w, sidecarRecords)
 }
 
@@ -127,6 +275,8 @@ func (h *stateHandler) HandleGet(w gohttp.ResponseWriter, r *gohttp.Request) {
 
 	key := params["key"]
 
+	raw := r.URL.Query().Get("raw") == "true"
+
 	ctx := metadatautils.RequestToContext(r)
 
 	newCtx, spanId := h.tracer.Start(ctx, "http.GetStateHandler")
@@ -135,6 +285,7 @@ func (h *stateHandler) HandleGet(w gohttp.ResponseWriter, r *gohttp.Request) {
 	h.tracer.AddMetadata(spanId, map[string]string{
 		"storeId": storeId,
 		"key":     key,
+		"raw":     strconv.FormatBool(raw),
 	})
 
 	recs, err := h.service.SingleStateFromStore(newCtx, storeId, key)
@@ -152,24 +303,148 @@ func (h *stateHandler) HandleGet(w gohttp.ResponseWriter, r *gohttp.Request) {
 		return
 	}
 
-	if len(recs) == 0 {
+	stamped, err := h.state.Stamp(storeId, recs)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read the metadata of state from store %s and key %s: %v", storeId, key, err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to read the metadata of state from store %s and key %s: %v", storeId, key, err))
+		return
+	}
+
+	// a raw read answers with the value itself and its content type
+	if raw {
+		if len(stamped) == 0 {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("there is no such record at store %s and key %s", storeId, key))
+			httputils.ErrResponse(w, errorutils.NotFound("sidecar", "there is no such record at store %s and key %s", storeId, key))
+			return
+		}
+
+		value := state.Decode(stamped[0].Record.Value)
+
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, state.Etag(stamped[0].Record.Value, stamped[0].Meta)))
+		w.Header().Set("Content-Type", value.ContentType)
+		w.WriteHeader(gohttp.StatusOK)
+		w.Write(value.Data)
+
 		h.tracer.UpdateStatus(spanId, 2, "success")
-		httputils.OkResponse(w, []sidecar.Record{})
+
 		return
 	}
 
-	sidecarRecords, err := SerializeRecords(recs)
+	if len(stamped) == 0 {
+		h.tracer.UpdateStatus(spanId, 2, "success")
+		httputils.OkResponse(w, []Record{})
+		return
+	}
+
+	sidecarRecords, err := SerializeRecords(stamped)
 	if err != nil {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to serialize records: %v", err))
 		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to serialize records: %v", err))
 		return
 	}
 
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, sidecarRecords[0].Etag))
+
 	h.tracer.UpdateStatus(spanId, 2, "success")
 
 	httputils.OkResponse(w, sidecarRecords)
 }
 
+func (h *stateHandler) HandlePut(w gohttp.ResponseWriter, r *gohttp.Request) {
+	params := mux.Vars(r)
+
+	storeId := params["storeId"]
+
+	key := params["key"]
+
+	etag := parseEtag(r.Header.Get("If-Match"))
+
+	contentType := r.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	ttl := r.URL.Query().Get("ttlInSeconds")
+
+	ctx := metadatautils.RequestToContext(r)
+
+	_, spanId := h.tracer.Start(ctx, "http.PutStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId":     storeId,
+		"key":         key,
+		"etag":        etag,
+		"contentType": contentType,
+		"ttl":         ttl,
+	})
+
+	var ttlInSeconds uint64
+
+	if len(ttl) > 0 {
+		var err error
+		if ttlInSeconds, err = strconv.ParseUint(ttl, 10, 32); err != nil {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected the ttl to be a non-negative number of seconds: %s", ttl))
+			httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected the ttl to be a non-negative number of seconds: %s", ttl))
+			return
+		}
+	}
+
+	defer r.Body.Close()
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read request: %v", err))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "failed to read request: %v", err))
+		return
+	}
+
+	value, err := state.Encode(&state.Value{
+		Data:        data,
+		ContentType: contentType,
+	})
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to encode the value of record %s: %v", key, err))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "failed to encode the value of record %s: %v", key, err))
+		return
+	}
+
+	rec := &store.Record{
+		Key:    key,
+		Value:  value,
+		Expiry: time.Duration(ttlInSeconds) * time.Second,
+	}
+
+	err = h.state.Write(storeId, rec, etag)
+	if err != nil && err == sidecar.ErrComponentNotFound {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
+		httputils.ErrResponse(w, errorutils.NotFound("sidecar", "%s: %s", err.Error(), storeId))
+		return
+	} else if err != nil && err == state.ErrEtagMismatch {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s and key %s: %v", storeId, key, err))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("failed to save state to store %s and key %s: %v", storeId, key, err), gohttp.StatusConflict))
+		return
+	} else if err != nil && err == state.ErrNotSwappable {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s and key %s: %v", storeId, key, err))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("failed to save state to store %s and key %s: %v", storeId, key, err), gohttp.StatusNotImplemented))
+		return
+	} else if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to save state to store %s and key %s: %v", storeId, key, err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to save state to store %s and key %s: %v", storeId, key, err))
+		return
+	}
+
+	// the etag of the record is read back and left out when another
+	// value was written in between
+	if stamped, err := h.state.Stamp(storeId, []*store.Record{rec}); err == nil && len(stamped) == 1 && bytes.Equal(stamped[0].Record.Value, value) {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, state.Etag(stamped[0].Record.Value, stamped[0].Meta)))
+	}
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	httputils.OkResponse(w, map[string]interface{}{})
+}
+
 func (h *stateHandler) HandleDelete(w gohttp.ResponseWriter, r *gohttp.Request) {
 	params := mux.Vars(r)
 
@@ -177,6 +452,8 @@ func (h *stateHandler) HandleDelete(w gohttp.ResponseWriter, r *gohttp.Request)
 
 	key := params["key"]
 
+	etag := parseEtag(r.Header.Get("If-Match"))
+
 	ctx := metadatautils.RequestToContext(r)
 
 	newCtx, spanId := h.tracer.Start(ctx, "http.DeleteStateHandler")
@@ -185,12 +462,29 @@ func (h *stateHandler) HandleDelete(w gohttp.ResponseWriter, r *gohttp.Request)
 	h.tracer.AddMetadata(spanId, map[string]string{
 		"storeId": storeId,
 		"key":     key,
+		"etag":    etag,
 	})
 
-	if err := h.service.RemoveStateFromStore(newCtx, storeId, key); err != nil && err == sidecar.ErrComponentNotFound {
+	var err error
+
+	if len(etag) == 0 {
+		err = h.service.RemoveStateFromStore(newCtx, storeId, key)
+	} else {
+		err = h.state.Delete(storeId, key, etag)
+	}
+
+	if err != nil && err == sidecar.ErrComponentNotFound {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
 		httputils.ErrResponse(w, errorutils.NotFound("sidecar", "%s: %s", err.Error(), storeId))
 		return
+	} else if err != nil && err == state.ErrEtagMismatch {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to remove state from store %s and key %s: %v", storeId, key, err))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("failed to remove state from store %s and key %s: %v", storeId, key, err), gohttp.StatusConflict))
+		return
+	} else if err != nil && err == state.ErrNotSwappable {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to remove state from store %s and key %s: %v", storeId, key, err))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("failed to remove state from store %s and key %s: %v", storeId, key, err), gohttp.StatusNotImplemented))
+		return
 	} else if err != nil {
 		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to remove state from store %s and key %s: %v", storeId, key, err))
 		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to remove state from store %s and key %s: %v", storeId, key, err))
@@ -202,6 +496,372 @@ func (h *stateHandler) HandleDelete(w gohttp.ResponseWriter, r *gohttp.Request)
 	httputils.OkResponse(w, map[string]interface{}{})
 }
 
-func NewStateHandler(s sidecar.Sidecar, t tracev2.Trace) StateHandler {
-	return &stateHandler{s, t}
+func (h *stateHandler) HandleTransact(w gohttp.ResponseWriter, r *gohttp.Request) {
+	params := mux.Vars(r)
+
+	storeId := params["storeId"]
+
+	ctx := metadatautils.RequestToContext(r)
+
+	_, spanId := h.tracer.Start(ctx, "http.TransactStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	defer r.Body.Close()
+
+	if r.Body == nil {
+		h.tracer.UpdateStatus(spanId, 1, "expected a body as array of operations or as transaction")
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected a body as array of operations or as transaction"))
+		return
+	}
+
+	var body json.RawMessage
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&body); err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to decode request: %v", err))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "failed to decode request: %v", err))
+		return
+	}
+
+	// the body is the array of the operations of a transaction
+	// without events or the transaction itself
+	var transaction Transaction
+
+	var err error
+
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &transaction.Operations)
+	} else {
+		err = json.Unmarshal(body, &transaction)
+	}
+
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to decode request: %v", err))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "failed to decode request: %v", err))
+		return
+	}
+
+	operations, _ := json.Marshal(transaction.Operations)
+
+	events, _ := json.Marshal(transaction.Events)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId":    storeId,
+		"operations": string(operations),
+		"events":     string(events),
+	})
+
+	ops, err := DeserializeOperations(transaction.Operations)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "%v", err))
+		return
+	}
+
+	evs, err := DeserializeEvents(transaction.Events)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "%v", err))
+		return
+	}
+
+	err = h.state.TransactWithEvents(storeId, ops, evs)
+	if err != nil && err == sidecar.ErrComponentNotFound {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
+		httputils.ErrResponse(w, errorutils.NotFound("sidecar", "%s: %s", err.Error(), storeId))
+		return
+	} else if err != nil && (err == state.ErrNotTransactional || err == state.ErrNoOutbox) {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("%s: %s", err.Error(), storeId), gohttp.StatusNotImplemented))
+		return
+	} else if err != nil && errors.Is(err, state.ErrInvalidEvent) {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "%v", err))
+		return
+	} else if err != nil && err == state.ErrEtagMismatch {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to apply transaction to store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("failed to apply transaction to store %s: %v", storeId, err), gohttp.StatusConflict))
+		return
+	} else if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to apply transaction to store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to apply transaction to store %s: %v", storeId, err))
+		return
+	}
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	httputils.OkResponse(w, map[string]interface{}{})
+}
+
+func (h *stateHandler) HandleBulkGet(w gohttp.ResponseWriter, r *gohttp.Request) {
+	params := mux.Vars(r)
+
+	storeId := params["storeId"]
+
+	ctx := metadatautils.RequestToContext(r)
+
+	_, spanId := h.tracer.Start(ctx, "http.BulkGetStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	defer r.Body.Close()
+
+	if r.Body == nil {
+		h.tracer.UpdateStatus(spanId, 1, "expected a body with an array of keys")
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected a body with an array of keys"))
+		return
+	}
+
+	var bulkGet BulkGet
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&bulkGet); err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to decode request: %v", err))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "failed to decode request: %v", err))
+		return
+	}
+
+	keys, _ := json.Marshal(bulkGet.Keys)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId": storeId,
+		"keys":    string(keys),
+	})
+
+	for i, key := range bulkGet.Keys {
+		if len(key) == 0 {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected key %d to not be empty", i))
+			httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected key %d to not be empty", i))
+			return
+		}
+	}
+
+	bulk, err := h.state.BulkGet(storeId, bulkGet.Keys)
+	if err != nil && err == sidecar.ErrComponentNotFound {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
+		httputils.ErrResponse(w, errorutils.NotFound("sidecar", "%s: %s", err.Error(), storeId))
+		return
+	} else if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to retrieve state from store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to retrieve state from store %s: %v", storeId, err))
+		return
+	}
+
+	stamped, err := h.state.Stamp(storeId, bulk.Records)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read the metadata of state from store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to read the metadata of state from store %s: %v", storeId, err))
+		return
+	}
+
+	sidecarRecords, err := SerializeRecords(stamped)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to serialize records: %v", err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to serialize records: %v", err))
+		return
+	}
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	httputils.OkResponse(w, Bulk{Records: sidecarRecords, Missing: bulk.Missing})
+}
+
+func (h *stateHandler) HandleQuery(w gohttp.ResponseWriter, r *gohttp.Request) {
+	params := mux.Vars(r)
+
+	storeId := params["storeId"]
+
+	ctx := metadatautils.RequestToContext(r)
+
+	_, spanId := h.tracer.Start(ctx, "http.QueryStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	defer r.Body.Close()
+
+	if r.Body == nil {
+		h.tracer.UpdateStatus(spanId, 1, "expected a body as query")
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected a body as query"))
+		return
+	}
+
+	var query Query
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&query); err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to decode request: %v", err))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "failed to decode request: %v", err))
+		return
+	}
+
+	bytes, _ := json.Marshal(query)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId": storeId,
+		"query":   string(bytes),
+	})
+
+	filter, err := DeserializeFilter(query.Filter)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "%v", err))
+		return
+	}
+
+	sorts, err := DeserializeSorts(query.Sort)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "%v", err))
+		return
+	}
+
+	page, err := h.state.Query(storeId, filter, sorts, query.Page.Cursor, uint(query.Page.Limit))
+	if err != nil && err == sidecar.ErrComponentNotFound {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
+		httputils.ErrResponse(w, errorutils.NotFound("sidecar", "%s: %s", err.Error(), storeId))
+		return
+	} else if err != nil && err == state.ErrInvalidCursor {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), query.Page.Cursor))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "%s: %s", err.Error(), query.Page.Cursor))
+		return
+	} else if err != nil && errors.Is(err, state.ErrInvalidQuery) {
+		h.tracer.UpdateStatus(spanId, 1, err.Error())
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "%v", err))
+		return
+	} else if err != nil && err == state.ErrQueryTooLarge {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
+		httputils.ErrResponse(w, errorutils.NewError("sidecar", fmt.Sprintf("%s: %s", err.Error(), storeId), gohttp.StatusNotImplemented))
+		return
+	} else if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to query state from store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to query state from store %s: %v", storeId, err))
+		return
+	}
+
+	stamped, err := h.state.Stamp(storeId, page.Records)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to read the metadata of state from store %s: %v", storeId, err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to read the metadata of state from store %s: %v", storeId, err))
+		return
+	}
+
+	sidecarRecords, err := SerializeRecords(stamped)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to serialize records: %v", err))
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to serialize records: %v", err))
+		return
+	}
+
+	h.tracer.UpdateStatus(spanId, 2, "success")
+
+	httputils.OkResponse(w, Page{Records: sidecarRecords, NextCursor: page.NextCursor})
+}
+
+// HandleBulkDelete answers with the count of deleted records or, when
+// newline delimited json is accepted, streams a count after every batch
+func (h *stateHandler) HandleBulkDelete(w gohttp.ResponseWriter, r *gohttp.Request) {
+	params := mux.Vars(r)
+
+	storeId := params["storeId"]
+
+	ctx := metadatautils.RequestToContext(r)
+
+	_, spanId := h.tracer.Start(ctx, "http.BulkDeleteStateHandler")
+	defer h.tracer.Finish(spanId)
+
+	defer r.Body.Close()
+
+	if r.Body == nil {
+		h.tracer.UpdateStatus(spanId, 1, "expected a body with keys or a prefix")
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected a body with keys or a prefix"))
+		return
+	}
+
+	var bulkDelete BulkDelete
+
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&bulkDelete); err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to decode request: %v", err))
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "failed to decode request: %v", err))
+		return
+	}
+
+	keys, _ := json.Marshal(bulkDelete.Keys)
+
+	h.tracer.AddMetadata(spanId, map[string]string{
+		"storeId": storeId,
+		"keys":    string(keys),
+		"prefix":  bulkDelete.Prefix,
+	})
+
+	if (len(bulkDelete.Keys) == 0) == (len(bulkDelete.Prefix) == 0) {
+		h.tracer.UpdateStatus(spanId, 1, "expected either keys or a prefix")
+		httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected either keys or a prefix"))
+		return
+	}
+
+	for i, key := range bulkDelete.Keys {
+		if len(key) == 0 {
+			h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("expected key %d to not be empty", i))
+			httputils.ErrResponse(w, errorutils.BadRequest("sidecar", "expected key %d to not be empty", i))
+			return
+		}
+	}
+
+	if _, err := h.state.Store(storeId); err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("%s: %s", err.Error(), storeId))
+		httputils.ErrResponse(w, errorutils.NotFound("sidecar", "%s: %s", err.Error(), storeId))
+		return
+	}
+
+	flusher, stream := w.(gohttp.Flusher)
+
+	stream = stream && strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+	var progress func(int)
+
+	if stream {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(gohttp.StatusOK)
+
+		encoder := json.NewEncoder(w)
+
+		progress = func(deleted int) {
+			encoder.Encode(Deleted{Deleted: deleted})
+			flusher.Flush()
+		}
+
+		defer flusher.Flush()
+	}
+
+	deleted, err := h.state.BulkDelete(storeId, bulkDelete.Keys, bulkDelete.Prefix, progress)
+	if err != nil {
+		h.tracer.UpdateStatus(spanId, 1, fmt.Sprintf("failed to remove state from store %s after %d records: %v", storeId, deleted, err))
+	} else {
+		h.tracer.UpdateStatus(spanId, 2, "success")
+	}
+
+	// the status of a stream has been sent, so its error is sent as
+	// the last count instead
+	if stream {
+		last := Deleted{Deleted: deleted, Done: err == nil}
+		if err != nil {
+			last.Error = fmt.Sprintf("failed to remove state from store %s after %d records: %v", storeId, deleted, err)
+		}
+		json.NewEncoder(w).Encode(last)
+		return
+	}
+
+	if err != nil {
+		httputils.ErrResponse(w, errorutils.InternalServerError("sidecar", "failed to remove state from store %s after %d records: %v", storeId, deleted, err))
+		return
+	}
+
+	httputils.OkResponse(w, Deleted{Deleted: deleted, Done: true})
+}
+
+func NewStateHandler(s sidecar.Sidecar, st *state.State, t tracev2.Trace) StateHandler {
+	return &stateHandler{s, st, t}
 }
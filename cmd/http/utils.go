@@ -1,30 +1,366 @@
 package http
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/w-h-a/pkg/sidecar"
 	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/utils/datautils"
+	"github.com/w-h-a/sidecar/state"
 )
 
-func SerializeRecords(recs []*store.Record) ([]sidecar.Record, error) {
+const (
+	EncodingBase64 = "base64"
+)
+
+// Record is a record of state with its etag. The etag of a record
+// that is written is the etag that the stored record must have and
+// a record that is written with a ttl expires after that many seconds.
+// A value that is not json has its content type, and a value that is
+// not text either is a base64 string with the base64 encoding. Json
+// that starts with the field "$sidecar" is reserved and has to be
+// written with a content type other than json. A record
+// that is read has the metadata of its record, except a record of a
+// pluggable component, whose protocol has no metadata, so it has none
+// and listing its records since a time fails with 501.
+type Record struct {
+	Key          string      `json:"key,omitempty"`
+	Value        interface{} `json:"value,omitempty"`
+	Etag         string      `json:"etag,omitempty"`
+	TtlInSeconds int64       `json:"ttlInSeconds,omitempty"`
+	ContentType  string      `json:"contentType,omitempty"`
+	Encoding     string      `json:"encoding,omitempty"`
+	CreatedAt    *time.Time  `json:"createdAt,omitempty"`
+	UpdatedAt    *time.Time  `json:"updatedAt,omitempty"`
+	Version      uint64      `json:"version,omitempty"`
+}
+
+// Page is the response to a paged list of state
+type Page struct {
+	Records    []Record `json:"records"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+// BulkGet is the request of a bulk get of state
+type BulkGet struct {
+	Keys []string `json:"keys"`
+}
+
+// Bulk is the response to a bulk get of state
+type Bulk struct {
+	Records []Record `json:"records"`
+	Missing []string `json:"missing"`
+}
+
+// BulkDelete is the request of a bulk delete of state, which has
+// either keys or a prefix
+type BulkDelete struct {
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+}
+
+// Deleted counts the records that a bulk delete has deleted so far.
+// When it streams its progress, the last count is done or has the
+// error that stopped it.
+type Deleted struct {
+	Deleted int    `json:"deleted"`
+	Done    bool   `json:"done,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Query is the request of a query of state. Its filter is an object
+// with one of EQ, IN, AND, or OR, where EQ and IN map one path to a
+// value or an array of values and AND and OR hold an array of filters.
+// A cursor counts the records before its page, so writes between pages
+// can skip or repeat records.
+type Query struct {
+	Filter map[string]interface{} `json:"filter,omitempty"`
+	Sort   []QuerySort            `json:"sort,omitempty"`
+	Page   QueryPage              `json:"page,omitempty"`
+}
+
+type QuerySort struct {
+	Path  string `json:"path"`
+	Order string `json:"order,omitempty"`
+}
+
+type QueryPage struct {
+	Limit  uint32 `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// DeserializeFilter turns the filter of a query into the filter of the
+// state package, which checks the rest of it
+func DeserializeFilter(raw map[string]interface{}) (*state.Filter, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	if len(raw) != 1 {
+		return nil, fmt.Errorf("%w: expected filter to have one of EQ, IN, AND, or OR", state.ErrInvalidQuery)
+	}
+
+	for op, arg := range raw {
+		filter := &state.Filter{
+			Op: strings.ToUpper(op),
+		}
+
+		switch filter.Op {
+		case state.FilterEq, state.FilterIn:
+			m, ok := arg.(map[string]interface{})
+			if !ok || len(m) != 1 {
+				return nil, fmt.Errorf("%w: expected %s to map one path to its value", state.ErrInvalidQuery, op)
+			}
+
+			for path, value := range m {
+				filter.Path = path
+
+				if filter.Op == state.FilterEq {
+					filter.Values = []interface{}{value}
+					continue
+				}
+
+				values, ok := value.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%w: expected IN of %s to be an array of values", state.ErrInvalidQuery, path)
+				}
+
+				filter.Values = values
+			}
+		case state.FilterAnd, state.FilterOr:
+			subs, ok := arg.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%w: expected %s to be an array of filters", state.ErrInvalidQuery, op)
+			}
+
+			for _, sub := range subs {
+				m, ok := sub.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%w: expected %s to be an array of filters", state.ErrInvalidQuery, op)
+				}
+
+				f, err := DeserializeFilter(m)
+				if err != nil {
+					return nil, err
+				}
+
+				filter.Filters = append(filter.Filters, f)
+			}
+		}
+
+		return filter, nil
+	}
+
+	return nil, nil
+}
+
+func DeserializeSorts(sorts []QuerySort) ([]state.Sort, error) {
+	ss := []state.Sort{}
+
+	for _, srt := range sorts {
+		order := strings.ToUpper(srt.Order)
+
+		if order != "" && order != "ASC" && order != "DESC" {
+			return nil, fmt.Errorf("expected the order of sort %s to be ASC or DESC", srt.Path)
+		}
+
+		ss = append(ss, state.Sort{
+			Path:       srt.Path,
+			Descending: order == "DESC",
+		})
+	}
+
+	return ss, nil
+}
+
+// Operation is an upsert or a delete of a transaction. A delete
+// only needs the key and, when it is checked, the etag of its record.
+type Operation struct {
+	Operation string `json:"operation"`
+	Record    Record `json:"record"`
+}
+
+// Transaction is the request of a transaction with events, which are
+// put in the outbox of the store with the operations. A transaction
+// without events may also be just the array of its operations.
+type Transaction struct {
+	Operations []Operation      `json:"operations"`
+	Events     []*sidecar.Event `json:"events,omitempty"`
+}
+
+// DeserializeEvents turns the events of a transaction into the events
+// of the state package, which checks them
+func DeserializeEvents(evs []*sidecar.Event) ([]*state.Event, error) {
+	events := []*state.Event{}
+
+	for i, ev := range evs {
+		if ev == nil {
+			return nil, fmt.Errorf("expected event %d to not be empty", i)
+		}
+
+		payload, err := json.Marshal(ev.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the payload of event %s: %v", ev.EventName, err)
+		}
+
+		events = append(events, &state.Event{
+			EventName: ev.EventName,
+			Payload:   payload,
+		})
+	}
+
+	return events, nil
+}
+
+// DeserializeOperations checks the operations of a transaction and
+// turns them into the operations of the state package
+func DeserializeOperations(ops []Operation) ([]state.Operation, error) {
+	operations := []state.Operation{}
+
+	for i, op := range ops {
+		if op.Operation != "upsert" && op.Operation != "delete" {
+			return nil, fmt.Errorf("expected operation %d to be upsert or delete", i)
+		}
+
+		if len(op.Record.Key) == 0 {
+			return nil, fmt.Errorf("expected operation %d to have a record with a key", i)
+		}
+
+		if op.Record.TtlInSeconds < 0 {
+			return nil, fmt.Errorf("expected the ttl of record %s to be a non-negative number of seconds", op.Record.Key)
+		}
+
+		rec := &store.Record{
+			Key:    op.Record.Key,
+			Expiry: time.Duration(op.Record.TtlInSeconds) * time.Second,
+		}
+
+		if op.Operation == "upsert" {
+			value, err := DeserializeValue(op.Record)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode the value of record %s: %v", op.Record.Key, err)
+			}
+			rec.Value = value
+		}
+
+		operations = append(operations, state.Operation{
+			Delete: op.Operation == "delete",
+			Record: rec,
+			Etag:   op.Record.Etag,
+		})
+	}
+
+	return operations, nil
+}
+
+// DeserializeValue returns the bytes that store the value of the record
+// with its content type
+func DeserializeValue(record Record) ([]byte, error) {
+	var data []byte
+
+	switch record.Encoding {
+	case "":
+		var err error
+		if data, err = datautils.Stringify(record.Value); err != nil {
+			return nil, err
+		}
+	case EncodingBase64:
+		str, ok := record.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected the value to be a base64 string")
+		}
+
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(str); err != nil {
+			return nil, fmt.Errorf("expected the value to be a base64 string: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("expected the encoding to be base64 but got %q", record.Encoding)
+	}
+
+	return state.Encode(&state.Value{
+		Data:        data,
+		ContentType: record.ContentType,
+	})
+}
+
+func DeserializeRecords(recs []Record) []sidecar.Record {
 	sidecarRecords := []sidecar.Record{}
 
 	for _, record := range recs {
-		sidecar := sidecar.Record{
-			Key: record.Key,
+		sidecarRecords = append(sidecarRecords, sidecar.Record{
+			Key:   record.Key,
+			Value: record.Value,
+		})
+	}
+
+	return sidecarRecords
+}
+
+func SerializeRecords(recs []*state.Stamped) ([]Record, error) {
+	sidecarRecords := []Record{}
+
+	for _, stamped := range recs {
+		record := stamped.Record
+
+		sidecar := Record{
+			Key:  record.Key,
+			Etag: state.Etag(record.Value, stamped.Meta),
 		}
 
-		var value interface{}
+		if meta := stamped.Meta; meta != nil {
+			createdAt, updatedAt := meta.CreatedAt.UTC(), meta.UpdatedAt.UTC()
+			sidecar.CreatedAt = &createdAt
+			sidecar.UpdatedAt = &updatedAt
+			sidecar.Version = meta.Version
+		}
 
-		if err := json.Unmarshal(record.Value, &value); err != nil {
-			return nil, err
+		value := state.Decode(record.Value)
+
+		switch {
+		// json that was stored before it was checked may not be json,
+		// so it is answered with as bytes instead
+		case state.IsJSON(value.ContentType) && json.Valid(value.Data):
+			if err := json.Unmarshal(value.Data, &sidecar.Value); err != nil {
+				return nil, err
+			}
+		case state.IsText(value.ContentType) && utf8.Valid(value.Data):
+			sidecar.Value = string(value.Data)
+		default:
+			sidecar.Value = base64.StdEncoding.EncodeToString(value.Data)
+			sidecar.Encoding = EncodingBase64
 		}
 
-		sidecar.Value = value
+		if value.ContentType != state.ContentTypeJSON {
+			sidecar.ContentType = value.ContentType
+		}
 
 		sidecarRecords = append(sidecarRecords, sidecar)
 	}
 
 	return sidecarRecords, nil
 }
+
+// plain tells whether the sidecar can save the records as they are,
+// which it cannot do with records that have etags, ttls, content types,
+// or encodings
+func plain(recs []Record) bool {
+	for _, record := range recs {
+		if len(record.Etag) > 0 || record.TtlInSeconds != 0 || len(record.ContentType) > 0 || len(record.Encoding) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseEtag strips the quotes and weakness of an etag header. The
+// etag * is kept as is so that it matches every record that exists.
+func parseEtag(header string) string {
+	return strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+}
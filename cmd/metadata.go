@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"github.com/w-h-a/sidecar/cmd/config"
+	"github.com/w-h-a/sidecar/metadata"
+)
+
+// describe reports what the sidecar has loaded. Addresses and other
+// settings are left out since they may hold credentials.
+func describe(c *componentSet, traceExporter string) *metadata.Metadata {
+	m := &metadata.Metadata{
+		Namespace: config.Namespace,
+		Name:      config.Name,
+		Version:   config.Version,
+		App: metadata.App{
+			Port:     config.ServicePort,
+			Protocol: config.ServiceProtocol,
+		},
+		Stores:        []metadata.Component{},
+		Producers:     []metadata.Component{},
+		Consumers:     []metadata.Component{},
+		Secrets:       []metadata.Component{},
+		TraceExporter: traceExporter,
+	}
+
+	for _, s := range c.config.Stores {
+		m.Stores = append(m.Stores, metadata.Component{
+			Name: s.Name,
+			Type: s.Type,
+		})
+	}
+
+	for _, s := range c.config.Producers {
+		m.Producers = append(m.Producers, metadata.Component{
+			Name:  s.Name,
+			Type:  s.Type,
+			Topic: s.Topic,
+		})
+	}
+
+	for _, s := range c.config.Consumers {
+		group, topic, _ := consumerGroupTopic(s.Name)
+
+		m.Consumers = append(m.Consumers, metadata.Component{
+			Name:  s.Name,
+			Type:  s.Type,
+			Topic: topic,
+			Group: group,
+		})
+	}
+
+	for _, s := range c.config.Secrets {
+		m.Secrets = append(m.Secrets, metadata.Component{
+			Name: s.Name,
+			Type: s.Type,
+		})
+	}
+
+	return m
+}
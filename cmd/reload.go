@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/w-h-a/pkg/sidecar"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/cmd/config"
+	"github.com/w-h-a/sidecar/pluggable"
+)
+
+const (
+	componentsPollInterval = 5 * time.Second
+	// how long the requests that are in flight when components are
+	// reloaded have to finish before the displaced components close
+	drainTimeout = 30 * time.Second
+)
+
+// reloadingSidecar hands every call to the most recently swapped in
+// sidecar so that the http and grpc handlers never have to be
+// rebuilt. Subscriptions stay with the sidecar that made them.
+type reloadingSidecar struct {
+	current sidecar.Sidecar
+	owners  map[string]sidecar.Sidecar
+	mtx     sync.RWMutex
+}
+
+func (s *reloadingSidecar) Options() sidecar.SidecarOptions {
+	return s.get().Options()
+}
+
+func (s *reloadingSidecar) SaveStateToStore(ctx context.Context, state *sidecar.State) error {
+	return s.get().SaveStateToStore(ctx, state)
+}
+
+func (s *reloadingSidecar) ListStateFromStore(ctx context.Context, storeId string) ([]*store.Record, error) {
+	return s.get().ListStateFromStore(ctx, storeId)
+}
+
+func (s *reloadingSidecar) SingleStateFromStore(ctx context.Context, storeId, key string) ([]*store.Record, error) {
+	return s.get().SingleStateFromStore(ctx, storeId, key)
+}
+
+func (s *reloadingSidecar) RemoveStateFromStore(ctx context.Context, storeId, key string) error {
+	return s.get().RemoveStateFromStore(ctx, storeId, key)
+}
+
+func (s *reloadingSidecar) WriteEventToBroker(ctx context.Context, event *sidecar.Event) error {
+	return s.get().WriteEventToBroker(ctx, event)
+}
+
+func (s *reloadingSidecar) ReadEventsFromBroker(ctx context.Context, brokerId string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.owners[brokerId]; ok {
+		log.Warnf("a subscriber for broker %s was already found", brokerId)
+		return
+	}
+
+	s.current.ReadEventsFromBroker(ctx, brokerId)
+
+	s.owners[brokerId] = s.current
+}
+
+func (s *reloadingSidecar) UnsubscribeFromBroker(ctx context.Context, brokerId string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	owner, ok := s.owners[brokerId]
+	if !ok {
+		return nil
+	}
+
+	if err := owner.UnsubscribeFromBroker(ctx, brokerId); err != nil {
+		return err
+	}
+
+	delete(s.owners, brokerId)
+
+	return nil
+}
+
+func (s *reloadingSidecar) ReadFromSecretStore(ctx context.Context, secretStore string, name string) (*sidecar.Secret, error) {
+	return s.get().ReadFromSecretStore(ctx, secretStore, name)
+}
+
+func (s *reloadingSidecar) String() string {
+	return s.get().String()
+}
+
+func (s *reloadingSidecar) Swap(next sidecar.Sidecar) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.current = next
+}
+
+func (s *reloadingSidecar) get() sidecar.Sidecar {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.current
+}
+
+func newReloadingSidecar(s sidecar.Sidecar) *reloadingSidecar {
+	return &reloadingSidecar{
+		current: s,
+		owners:  map[string]sidecar.Sidecar{},
+		mtx:     sync.RWMutex{},
+	}
+}
+
+// reloader rebuilds the components from the manifest at path and swaps
+// a sidecar of them into service. The components that the new sidecar
+// does not reuse are closed once the requests that were in flight on
+// them have had drain to finish.
+type reloader struct {
+	path       string
+	service    *reloadingSidecar
+	components *componentSet
+	newSidecar func(c *componentSet) sidecar.Sidecar
+	drain      time.Duration
+	mtx        sync.Mutex
+}
+
+func (r *reloader) reload() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if len(r.path) == 0 {
+		log.Info("components are configured by env vars; there is nothing to reload")
+		return
+	}
+
+	// pick up pluggable components that started since
+	if len(config.PluggableComponentsDir) > 0 {
+		if err := pluggable.Discover(config.PluggableComponentsDir); err != nil {
+			log.Errorf("failed to reload components: %v", err)
+			return
+		}
+	}
+
+	next, err := config.LoadComponents(r.path)
+	if err != nil {
+		log.Errorf("failed to reload components: %v", err)
+		return
+	}
+
+	nextComponents, err := makeComponents(next, r.components)
+	if err != nil {
+		log.Errorf("failed to reload components: %v", err)
+		return
+	}
+
+	removed, added := consumerChanges(r.components.config, nextComponents.config)
+
+	for _, name := range removed {
+		if err := r.service.UnsubscribeFromBroker(context.Background(), name); err != nil {
+			log.Errorf("failed to unsubscribe from broker %s: %v", name, err)
+		}
+	}
+
+	r.service.Swap(r.newSidecar(nextComponents))
+
+	for _, name := range added {
+		r.service.ReadEventsFromBroker(context.Background(), name)
+	}
+
+	old := displaced(r.components, nextComponents)
+
+	time.AfterFunc(r.drain, func() {
+		closeComponents(old)
+	})
+
+	r.components = nextComponents
+
+	log.Infof("successfully reloaded components from %s", r.path)
+}
+
+func (r *reloader) current() *componentSet {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.components
+}
+
+// watchComponents calls reload on SIGHUP and whenever the
+// modification time of the manifest at path changes, which
+// is polled at every interval. It returns when done is closed.
+func watchComponents(path string, interval time.Duration, reload func(), done <-chan struct{}) {
+	ch := make(chan os.Signal, 1)
+
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modified := modTime(path)
+
+	for {
+		select {
+		case <-done:
+			return
+		case sig := <-ch:
+			log.Infof("sidecar received signal %s", sig)
+			modified = modTime(path)
+			reload()
+		case <-ticker.C:
+			if len(path) == 0 {
+				continue
+			}
+			if t := modTime(path); !t.Equal(modified) {
+				log.Infof("components manifest %s has changed", path)
+				modified = t
+				reload()
+			}
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	if len(path) == 0 {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,403 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/sidecar"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	logmemory "github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	"github.com/w-h-a/sidecar/cmd/config"
+)
+
+func TestMain(m *testing.M) {
+	logger := logmemory.NewLog(
+		log.LogWithPrefix("test cmd"),
+		logmemory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	os.Exit(m.Run())
+}
+
+func TestReloadingSidecar(t *testing.T) {
+	prev := newFakeSidecar("prev")
+	next := newFakeSidecar("next")
+
+	service := newReloadingSidecar(prev)
+
+	service.ReadEventsFromBroker(context.Background(), "billing-orders")
+
+	t.Log("a request that is in flight during the swap")
+
+	prev.block = make(chan struct{})
+
+	inFlight := make(chan []*store.Record)
+
+	go func() {
+		recs, err := service.SingleStateFromStore(context.Background(), "orders", "key1")
+		require.NoError(t, err)
+		inFlight <- recs
+	}()
+
+	require.Eventually(t, func() bool {
+		return prev.calls() == 1
+	}, time.Second, time.Millisecond)
+
+	service.Swap(next)
+
+	recs, err := service.SingleStateFromStore(context.Background(), "orders", "key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("next"), recs[0].Value)
+
+	close(prev.block)
+
+	recs = <-inFlight
+	require.Equal(t, []byte("prev"), recs[0].Value)
+
+	t.Log("subscriptions stay with the sidecar that made them")
+
+	service.ReadEventsFromBroker(context.Background(), "billing-orders")
+	service.ReadEventsFromBroker(context.Background(), "audit-orders")
+
+	require.Equal(t, []string{"billing-orders"}, prev.subscribed())
+	require.Equal(t, []string{"audit-orders"}, next.subscribed())
+
+	require.NoError(t, service.UnsubscribeFromBroker(context.Background(), "billing-orders"))
+	require.NoError(t, service.UnsubscribeFromBroker(context.Background(), "audit-orders"))
+	require.NoError(t, service.UnsubscribeFromBroker(context.Background(), "unknown-orders"))
+
+	require.Equal(t, []string{"billing-orders"}, prev.unsubscribed())
+	require.Equal(t, []string{"audit-orders"}, next.unsubscribed())
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "components.yml")
+
+	require.NoError(t, os.WriteFile(path, []byte(`stores:
+  - name: kept
+    type: memory
+  - name: removed
+    type: memory
+consumers:
+  - name: billing-orders
+    type: memory
+  - name: audit-orders
+    type: memory
+`), 0o644))
+
+	cfg, err := config.LoadComponents(path)
+	require.NoError(t, err)
+
+	components, err := makeComponents(cfg, nil)
+	require.NoError(t, err)
+
+	// the removed store tells when it is closed
+	removed := &closingStore{Store: components.stores["removed"]}
+
+	components.stores["removed"] = removed
+
+	sidecars := []*fakeSidecar{}
+
+	newSidecar := func(c *componentSet) sidecar.Sidecar {
+		s := newFakeSidecar("sidecar")
+		s.stores = c.stores
+		sidecars = append(sidecars, s)
+		return s
+	}
+
+	service := newReloadingSidecar(newSidecar(components))
+
+	for _, c := range components.config.Consumers {
+		service.ReadEventsFromBroker(context.Background(), c.Name)
+	}
+
+	r := &reloader{
+		path:       path,
+		service:    service,
+		components: components,
+		newSidecar: newSidecar,
+		drain:      50 * time.Millisecond,
+	}
+
+	t.Log("a request that is in flight during the reload")
+
+	sidecars[0].block = make(chan struct{})
+
+	inFlight := make(chan error)
+
+	go func() {
+		_, err := service.SingleStateFromStore(context.Background(), "removed", "key1")
+		inFlight <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		return sidecars[0].calls() == 1
+	}, time.Second, time.Millisecond)
+
+	t.Log("reloading a manifest that adds and removes components")
+
+	require.NoError(t, os.WriteFile(path, []byte(`stores:
+  - name: kept
+    type: memory
+  - name: added
+    type: memory
+consumers:
+  - name: billing-orders
+    type: memory
+  - name: shipping-orders
+    type: memory
+`), 0o644))
+
+	r.reload()
+
+	require.Len(t, sidecars, 2)
+
+	require.Equal(t, []string{"audit-orders"}, sidecars[0].unsubscribed())
+	require.Equal(t, []string{"shipping-orders"}, sidecars[1].subscribed())
+
+	require.Same(t, components.stores["kept"], r.current().stores["kept"])
+	require.Contains(t, r.current().stores, "added")
+	require.NotContains(t, r.current().stores, "removed")
+
+	close(sidecars[0].block)
+
+	require.NoError(t, <-inFlight)
+
+	t.Log("closing the removed components once they drain")
+
+	require.False(t, removed.isClosed())
+
+	require.Eventually(t, func() bool {
+		return removed.isClosed()
+	}, time.Second, time.Millisecond)
+
+	t.Log("reloading a manifest that fails to load")
+
+	require.NoError(t, os.WriteFile(path, []byte(`stores: [`), 0o644))
+
+	r.reload()
+
+	require.Len(t, sidecars, 2)
+	require.Contains(t, r.current().stores, "added")
+}
+
+func TestReloadWithoutManifest(t *testing.T) {
+	components, err := makeComponents(&config.Components{}, nil)
+	require.NoError(t, err)
+
+	service := newReloadingSidecar(newFakeSidecar("sidecar"))
+
+	r := &reloader{
+		service:    service,
+		components: components,
+		newSidecar: func(c *componentSet) sidecar.Sidecar {
+			t.Fatal("components from env vars are reloaded")
+			return nil
+		},
+	}
+
+	r.reload()
+
+	require.Same(t, components, r.current())
+}
+
+func TestWatchComponents(t *testing.T) {
+	// SIGHUP must not stop the test before the watch listens for it
+	ch := make(chan os.Signal, 1)
+
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	path := filepath.Join(t.TempDir(), "components.yml")
+
+	require.NoError(t, os.WriteFile(path, []byte(`stores: []`), 0o644))
+
+	reloads := make(chan struct{}, 10)
+
+	done := make(chan struct{})
+
+	stopped := make(chan struct{})
+
+	go func() {
+		watchComponents(path, 10*time.Millisecond, func() { reloads <- struct{}{} }, done)
+		close(stopped)
+	}()
+
+	t.Log("a manifest that changes")
+
+	// the watch may start after a change, so the manifest changes
+	// until the watch sees it
+	later := time.Now()
+
+	require.Eventually(t, func() bool {
+		later = later.Add(time.Minute)
+
+		require.NoError(t, os.Chtimes(path, later, later))
+
+		select {
+		case <-reloads:
+			return true
+		case <-time.After(20 * time.Millisecond):
+			return false
+		}
+	}, time.Second, time.Millisecond)
+
+	t.Log("a manifest that does not change")
+
+	select {
+	case <-reloads:
+		t.Fatal("a manifest that did not change was reloaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	t.Log("SIGHUP")
+
+	require.Eventually(t, func() bool {
+		require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+		select {
+		case <-reloads:
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, time.Millisecond)
+
+	close(done)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the watch did not stop")
+	}
+}
+
+type closingStore struct {
+	store.Store
+	closed bool
+	mtx    sync.Mutex
+}
+
+func (s *closingStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.closed = true
+
+	return nil
+}
+
+func (s *closingStore) isClosed() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.closed
+}
+
+// fakeSidecar answers every read with its name and records the
+// subscriptions that it makes
+type fakeSidecar struct {
+	name   string
+	stores map[string]store.Store
+	// a read waits for block to close when it is set
+	block  chan struct{}
+	reads  int
+	subs   []string
+	unsubs []string
+	mtx    sync.Mutex
+}
+
+func (s *fakeSidecar) Options() sidecar.SidecarOptions {
+	return sidecar.SidecarOptions{Stores: s.stores}
+}
+
+func (s *fakeSidecar) SaveStateToStore(ctx context.Context, state *sidecar.State) error {
+	return nil
+}
+
+func (s *fakeSidecar) ListStateFromStore(ctx context.Context, storeId string) ([]*store.Record, error) {
+	return nil, nil
+}
+
+func (s *fakeSidecar) SingleStateFromStore(ctx context.Context, storeId, key string) ([]*store.Record, error) {
+	s.mtx.Lock()
+	s.reads++
+	s.mtx.Unlock()
+
+	if s.block != nil {
+		<-s.block
+	}
+
+	return []*store.Record{{Key: key, Value: []byte(s.name)}}, nil
+}
+
+func (s *fakeSidecar) RemoveStateFromStore(ctx context.Context, storeId, key string) error {
+	return nil
+}
+
+func (s *fakeSidecar) WriteEventToBroker(ctx context.Context, event *sidecar.Event) error {
+	return nil
+}
+
+func (s *fakeSidecar) ReadEventsFromBroker(ctx context.Context, brokerId string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.subs = append(s.subs, brokerId)
+}
+
+func (s *fakeSidecar) UnsubscribeFromBroker(ctx context.Context, brokerId string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.unsubs = append(s.unsubs, brokerId)
+
+	return nil
+}
+
+func (s *fakeSidecar) ReadFromSecretStore(ctx context.Context, secretStore string, name string) (*sidecar.Secret, error) {
+	return nil, nil
+}
+
+func (s *fakeSidecar) String() string {
+	return s.name
+}
+
+func (s *fakeSidecar) calls() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.reads
+}
+
+func (s *fakeSidecar) subscribed() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]string{}, s.subs...)
+}
+
+func (s *fakeSidecar) unsubscribed() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]string{}, s.unsubs...)
+}
+
+func newFakeSidecar(name string) *fakeSidecar {
+	return &fakeSidecar{
+		name: name,
+		mtx:  sync.Mutex{},
+	}
+}
@@ -3,22 +3,20 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/urfave/cli"
-	"github.com/w-h-a/pkg/broker"
 	"github.com/w-h-a/pkg/client/grpcclient"
 	"github.com/w-h-a/pkg/client/httpclient"
-	"github.com/w-h-a/pkg/security/secret"
 	"github.com/w-h-a/pkg/serverv2"
-	grpcserver "github.com/w-h-a/pkg/serverv2/grpc"
 	httpserver "github.com/w-h-a/pkg/serverv2/http"
 	"github.com/w-h-a/pkg/sidecar"
 	"github.com/w-h-a/pkg/sidecar/custom"
-	"github.com/w-h-a/pkg/store"
 	"github.com/w-h-a/pkg/telemetry/log"
 	memorylog "github.com/w-h-a/pkg/telemetry/log/memory"
 	"github.com/w-h-a/pkg/telemetry/tracev2"
@@ -27,6 +25,9 @@ import (
 	"github.com/w-h-a/sidecar/cmd/config"
 	"github.com/w-h-a/sidecar/cmd/grpc"
 	"github.com/w-h-a/sidecar/cmd/http"
+	"github.com/w-h-a/sidecar/metadata"
+	"github.com/w-h-a/sidecar/pluggable"
+	"github.com/w-h-a/sidecar/state"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
@@ -36,6 +37,16 @@ import (
 func run(ctx *cli.Context) {
 	name := fmt.Sprintf("%s.%s", config.Namespace, config.Name)
 
+	// the aws sdk only reads credentials from the env; those that
+	// refer to secrets are set once the secret stores are built
+	if len(config.AwsAccessKeyId) > 0 && !config.IsSecretRef(config.AwsAccessKeyId) {
+		os.Setenv("AWS_ACCESS_KEY_ID", config.AwsAccessKeyId)
+	}
+
+	if len(config.AwsSecretAccessKey) > 0 && !config.IsSecretRef(config.AwsSecretAccessKey) {
+		os.Setenv("AWS_SECRET_ACCESS_KEY", config.AwsSecretAccessKey)
+	}
+
 	// logger
 	logBuffer := memoryutils.NewBuffer()
 
@@ -88,89 +99,92 @@ func run(ctx *cli.Context) {
 
 	grpcClient := grpcclient.NewClient()
 
-	stores := map[string]store.Store{}
-
-	brokers := map[string]broker.Broker{}
-
-	secrets := map[string]secret.Secret{}
+	path := config.ComponentsPath
 
-	st, err := GetStoreBuilder(config.Store)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if st != nil {
-		for _, s := range config.Stores {
-			if len(s) == 0 {
-				continue
-			}
-
-			stores[s] = MakeStore(st, []string{config.StoreAddress}, config.DB, s)
+	// register pluggable components before they are referenced
+	if len(config.PluggableComponentsDir) > 0 {
+		if err := pluggable.Discover(config.PluggableComponentsDir); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	sc, err := GetSecretBuilder(config.Secret)
+	cfg, err := config.LoadComponents(path)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if sc != nil {
-		secrets[config.Secret] = MakeSecret(sc, []string{config.SecretAddress}, config.SecretPrefix)
-	}
-
-	bk, err := GetBrokerBuilder(config.Broker)
+	components, err := makeComponents(cfg, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if bk != nil {
-		for _, s := range config.Producers {
-			if len(s) == 0 {
-				continue
-			}
+	// get services
+	_, httpPort, _ := strings.Cut(config.HttpAddress, ":")
+	_, grpcPort, _ := strings.Cut(config.GrpcAddress, ":")
 
-			brokers[s] = MakeProducer(bk, []string{config.BrokerAddress}, s)
+	newSidecar := func(c *componentSet) sidecar.Sidecar {
+		sidecarOpts := []sidecar.SidecarOption{
+			sidecar.SidecarWithServiceName(config.ServiceName),
+			sidecar.SidecarWithHttpPort(sidecar.Port{Port: httpPort}),
+			sidecar.SidecarWithGrpcPort(sidecar.Port{Port: grpcPort}),
+			sidecar.SidecarWithServicePort(sidecar.Port{Port: config.ServicePort, Protocol: config.ServiceProtocol}),
+			sidecar.SidecarWithStores(c.stores),
+			sidecar.SidecarWithBrokers(c.brokers),
+			sidecar.SidecarWithSecrets(c.secrets),
+			sidecar.SidecarWithTracer(tracer),
 		}
 
-		for _, s := range config.Consumers {
-			if len(s) == 0 {
-				continue
-			}
-
-			brokers[s] = MakeConsumer(bk, []string{config.BrokerAddress}, s, config.Broker == "memory")
+		if config.ServiceProtocol == "grpc" {
+			sidecarOpts = append(sidecarOpts, sidecar.SidecarWithClient(grpcClient))
+		} else {
+			sidecarOpts = append(sidecarOpts, sidecar.SidecarWithClient(httpClient))
 		}
+
+		return custom.NewSidecar(sidecarOpts...)
 	}
 
-	// get services
-	_, httpPort, _ := strings.Cut(config.HttpAddress, ":")
-	_, grpcPort, _ := strings.Cut(config.GrpcAddress, ":")
+	service := newReloadingSidecar(newSidecar(components))
+
+	states := state.NewState(
+		service,
+		state.StateWithBulkParallelism(config.BulkParallelism),
+		state.StateWithQueryScanLimit(config.QueryScanLimit),
+	)
 
-	sidecarOpts := []sidecar.SidecarOption{
-		sidecar.SidecarWithServiceName(config.ServiceName),
-		sidecar.SidecarWithHttpPort(sidecar.Port{Port: httpPort}),
-		sidecar.SidecarWithGrpcPort(sidecar.Port{Port: grpcPort}),
-		sidecar.SidecarWithServicePort(sidecar.Port{Port: config.ServicePort, Protocol: config.ServiceProtocol}),
-		sidecar.SidecarWithStores(stores),
-		sidecar.SidecarWithBrokers(brokers),
-		sidecar.SidecarWithSecrets(secrets),
-		sidecar.SidecarWithTracer(tracer),
+	// subscribe by group
+	for _, c := range components.config.Consumers {
+		service.ReadEventsFromBroker(context.Background(), c.Name)
 	}
 
-	if config.ServiceProtocol == "grpc" {
-		sidecarOpts = append(sidecarOpts, sidecar.SidecarWithClient(grpcClient))
-	} else {
-		sidecarOpts = append(sidecarOpts, sidecar.SidecarWithClient(httpClient))
+	// reload components on SIGHUP or when the manifest changes
+	reloader := &reloader{
+		path:       path,
+		service:    service,
+		components: components,
+		newSidecar: newSidecar,
+		drain:      drainTimeout,
 	}
 
-	service := custom.NewSidecar(sidecarOpts...)
+	describeSidecar := func() *metadata.Metadata {
+		return describe(reloader.current(), exporter.String())
+	}
 
-	// subscribe by group
-	for _, s := range config.Consumers {
-		if len(s) == 0 {
-			continue
-		}
+	done := make(chan struct{})
 
-		service.ReadEventsFromBroker(context.Background(), s)
+	if len(path) == 0 {
+		log.Info("components are configured by env vars, so SIGHUP does not reload them; set a components manifest to reload them")
+	}
+
+	go watchComponents(path, componentsPollInterval, reloader.reload, done)
+
+	// reap expired state in the background
+	if config.ReapInterval > 0 {
+		go states.ReapEvery(config.ReapInterval, done)
+	}
+
+	// publish the events in the outboxes of the stores in the background
+	if config.OutboxInterval > 0 {
+		go states.RelayEvery(config.OutboxInterval, done)
 	}
 
 	// base server opts
@@ -185,17 +199,24 @@ func run(ctx *cli.Context) {
 
 	httpHealth := http.NewHealthHandler(traceBuffer)
 	httpPublish := http.NewPublishHandler(service, tracer)
-	httpState := http.NewStateHandler(service, tracer)
+	httpState := http.NewStateHandler(service, states, tracer)
 	httpSecret := http.NewSecretHandler(service, tracer)
+	httpMetadata := http.NewMetadataHandler(describeSidecar, tracer)
 
 	router.Methods("GET").Path("/health/check").HandlerFunc(httpHealth.Check)
 	router.Methods("GET").Path("/health/trace").HandlerFunc(httpHealth.Trace)
 	router.Methods("POST").Path("/publish").HandlerFunc(httpPublish.Handle)
 	router.Methods("POST").Path("/state/{storeId}").HandlerFunc(httpState.HandlePost)
+	router.Methods("POST").Path("/state/{storeId}/transaction").HandlerFunc(httpState.HandleTransact)
+	router.Methods("POST").Path("/state/{storeId}/bulk").HandlerFunc(httpState.HandleBulkGet)
+	router.Methods("POST").Path("/state/{storeId}/bulk/delete").HandlerFunc(httpState.HandleBulkDelete)
+	router.Methods("POST").Path("/state/{storeId}/query").HandlerFunc(httpState.HandleQuery)
 	router.Methods("GET").Path("/state/{storeId}").HandlerFunc(httpState.HandleList)
 	router.Methods("GET").Path("/state/{storeId}/{key}").HandlerFunc(httpState.HandleGet)
+	router.Methods("PUT").Path("/state/{storeId}/{key}").HandlerFunc(httpState.HandlePut)
 	router.Methods("DELETE").Path("/state/{storeId}/{key}").HandlerFunc(httpState.HandleDelete)
 	router.Methods("GET").Path("/secret/{secretId}/{key}").HandlerFunc(httpSecret.HandleGet)
+	router.Methods("GET").Path("/metadata").HandlerFunc(httpMetadata.HandleGet)
 
 	httpOpts := []serverv2.ServerOption{
 		serverv2.ServerWithAddress(config.HttpAddress),
@@ -208,23 +229,20 @@ func run(ctx *cli.Context) {
 	httpServer.Handle(router)
 
 	// create grpc server
-	grpcOpts := []serverv2.ServerOption{
-		serverv2.ServerWithAddress(config.GrpcAddress),
-	}
-
-	grpcOpts = append(grpcOpts, opts...)
-
-	grpcServer := grpcserver.NewServer(grpcOpts...)
-
 	grpcHealth := grpc.NewHealthHandler(traceBuffer)
 	grpcPublish := grpc.NewPublishHandler(service, tracer)
-	grpcState := grpc.NewStateHandler(service, tracer)
+	grpcState := grpc.NewStateHandler(service, states, tracer)
 	grpcSecret := grpc.NewSecretHandler(service, tracer)
+	grpcMetadata := grpc.NewMetadataHandler(describeSidecar, tracer)
+
+	grpcServer := grpc.NewServer(grpcHealth, grpcPublish, grpcState, grpcSecret, grpcMetadata)
 
-	grpcServer.Handle(grpcserver.NewHandler(grpcHealth))
-	grpcServer.Handle(grpcserver.NewHandler(grpcPublish))
-	grpcServer.Handle(grpcserver.NewHandler(grpcState))
-	grpcServer.Handle(grpcserver.NewHandler(grpcSecret))
+	listener, err := net.Listen("tcp", config.GrpcAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("grpc server is listening on %s", listener.Addr())
 
 	// wait group and error chan
 	wg := &sync.WaitGroup{}
@@ -234,7 +252,7 @@ func run(ctx *cli.Context) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		errCh <- grpcServer.Start()
+		errCh <- grpcServer.Serve(listener)
 	}()
 
 	// run http server
@@ -250,14 +268,21 @@ func run(ctx *cli.Context) {
 		log.Errorf("failed to start sidecar: %v", err)
 	}
 
-	// unsubscribe by group
-	for _, s := range config.Consumers {
-		if err := service.UnsubscribeFromBroker(context.Background(), s); err != nil {
-			log.Errorf("failed to unsubscribe from broker %s: %v", s, err)
+	// stop reloading and unsubscribe by group
+	close(done)
+
+	components = reloader.current()
+
+	for _, c := range components.config.Consumers {
+		if err := service.UnsubscribeFromBroker(context.Background(), c.Name); err != nil {
+			log.Errorf("failed to unsubscribe from broker %s: %v", c.Name, err)
 		}
 	}
 
-	// graceful shutdown
+	// graceful shutdown; the grpc server does not stop on a signal
+	// the way the http server does
+	go grpcServer.GracefulStop()
+
 	wait := make(chan struct{})
 
 	go func() {
@@ -267,8 +292,12 @@ func run(ctx *cli.Context) {
 
 	select {
 	case <-wait:
-	case <-time.After(30 * time.Second):
+	case <-time.After(drainTimeout):
+		grpcServer.Stop()
 	}
 
+	// every component is displaced once the sidecar stops
+	closeComponents(displaced(components, &componentSet{}))
+
 	log.Info("successfully stopped sidecar")
 }
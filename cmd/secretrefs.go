@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/w-h-a/pkg/security/secret"
+	"github.com/w-h-a/sidecar/cmd/config"
+)
+
+// resolveSecretRefs returns a copy of cfg in which every setting that
+// refers to a secret holds the value of that secret. The references
+// are kept so that a changed secret is seen as a changed component.
+func resolveSecretRefs(cfg *config.Components, secrets map[string]secret.Secret) (*config.Components, error) {
+	resolved := &config.Components{
+		Secrets: cfg.Secrets,
+	}
+
+	var err error
+
+	if resolved.Stores, err = resolveComponents("store", cfg.Stores, secrets); err != nil {
+		return nil, err
+	}
+
+	if resolved.Producers, err = resolveComponents("producer", cfg.Producers, secrets); err != nil {
+		return nil, err
+	}
+
+	if resolved.Consumers, err = resolveComponents("consumer", cfg.Consumers, secrets); err != nil {
+		return nil, err
+	}
+
+	return resolved, nil
+}
+
+func resolveComponents(kind string, cs []config.Component, secrets map[string]secret.Secret) ([]config.Component, error) {
+	resolved := []config.Component{}
+
+	for _, c := range cs {
+		for _, name := range c.RefFields() {
+			field, err := c.Field(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %v", kind, c.Name, err)
+			}
+
+			value, err := resolveSecretRef(c.SecretRefs[name], secrets)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: failed to resolve %s: %v", kind, c.Name, name, err)
+			}
+
+			*field = value
+		}
+
+		if c.Encryption != nil {
+			encryption := *c.Encryption
+			encryption.Secrets = map[string]string{}
+
+			for _, ref := range encryption.Refs() {
+				value, err := resolveSecretRef(ref, secrets)
+				if err != nil {
+					return nil, fmt.Errorf("%s %s: failed to resolve encryption key: %v", kind, c.Name, err)
+				}
+
+				encryption.Secrets[ref] = value
+			}
+
+			c.Encryption = &encryption
+		}
+
+		resolved = append(resolved, c)
+	}
+
+	return resolved, nil
+}
+
+// resolveAwsCredentials puts the aws credentials that refer to
+// secrets into the env, where the aws sdk reads them from.
+func resolveAwsCredentials(secrets map[string]secret.Secret) error {
+	for env, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     config.AwsAccessKeyId,
+		"AWS_SECRET_ACCESS_KEY": config.AwsSecretAccessKey,
+	} {
+		if !config.IsSecretRef(value) {
+			continue
+		}
+
+		v, err := resolveSecretRef(value, secrets)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %v", env, err)
+		}
+
+		os.Setenv(env, v)
+	}
+
+	return nil
+}
+
+func resolveSecretRef(value string, secrets map[string]secret.Secret) (string, error) {
+	ref, err := config.ParseSecretRef(value)
+	if err != nil {
+		return "", err
+	}
+
+	sc, ok := secrets[ref.SecretId]
+	if !ok {
+		return "", fmt.Errorf("secret store %s is not configured", ref.SecretId)
+	}
+
+	data, err := sc.GetSecret(ref.Key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from secret store %s: %v", ref.Key, ref.SecretId, err)
+	}
+
+	if len(data[ref.Key]) == 0 {
+		return "", fmt.Errorf("secret %s in secret store %s is empty", ref.Key, ref.SecretId)
+	}
+
+	return data[ref.Key], nil
+}
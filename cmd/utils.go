@@ -5,44 +5,27 @@ import (
 	"strings"
 
 	"github.com/w-h-a/pkg/broker"
-	memorybroker "github.com/w-h-a/pkg/broker/memory"
-	"github.com/w-h-a/pkg/broker/snssqs"
 	"github.com/w-h-a/pkg/security/secret"
-	"github.com/w-h-a/pkg/security/secret/env"
-	"github.com/w-h-a/pkg/security/secret/ssm"
 	"github.com/w-h-a/pkg/store"
-	"github.com/w-h-a/pkg/store/cockroach"
-	memorystore "github.com/w-h-a/pkg/store/memory"
 	"github.com/w-h-a/pkg/telemetry/traceexporter"
 	memorytraceexporter "github.com/w-h-a/pkg/telemetry/traceexporter/memory"
-	otelp "github.com/w-h-a/pkg/telemetry/traceexporter/otelp"
 	"github.com/w-h-a/pkg/utils/memoryutils"
+	"github.com/w-h-a/sidecar/registry"
 )
 
-var (
-	defaultStores = map[string]func(...store.StoreOption) store.Store{
-		"cockroach": cockroach.NewStore,
-		"memory":    memorystore.NewStore,
+// consumerGroupTopic splits the name of a consumer, which is of form
+// <group>-<topic>, at its first hyphen
+func consumerGroupTopic(name string) (string, string, bool) {
+	group, topic, ok := strings.Cut(name, "-")
+	if !ok || len(group) == 0 || len(topic) == 0 {
+		return "", "", false
 	}
 
-	defaultBrokers = map[string]func(...broker.BrokerOption) broker.Broker{
-		"snssqs": snssqs.NewBroker,
-		"memory": memorybroker.NewBroker,
-	}
-
-	defaultSecrets = map[string]func(...secret.SecretOption) secret.Secret{
-		"ssm": ssm.NewSecret,
-		"env": env.NewSecret,
-	}
-
-	defaultTraceExporters = map[string]func(...traceexporter.ExporterOption) traceexporter.TraceExporter{
-		"otelp":  otelp.NewExporter,
-		"memory": memorytraceexporter.NewExporter,
-	}
-)
+	return group, topic, true
+}
 
 func GetStoreBuilder(s string) (func(...store.StoreOption) store.Store, error) {
-	storeBuilder, exists := defaultStores[s]
+	storeBuilder, exists := registry.Store(s)
 	if !exists && len(s) > 0 {
 		return nil, fmt.Errorf("store %s is not supported", s)
 	} else if !exists {
@@ -60,7 +43,7 @@ func MakeStore(storeBuilder func(...store.StoreOption) store.Store, nodes []stri
 }
 
 func GetSecretBuilder(s string) (func(...secret.SecretOption) secret.Secret, error) {
-	secretBuilder, exists := defaultSecrets[s]
+	secretBuilder, exists := registry.Secret(s)
 	if !exists && len(s) > 0 {
 		return nil, fmt.Errorf("secret store %s is not supported", s)
 	} else if !exists {
@@ -77,7 +60,7 @@ func MakeSecret(secretBuilder func(...secret.SecretOption) secret.Secret, nodes
 }
 
 func GetTraceExporterBuilder(s string) (func(...traceexporter.ExporterOption) traceexporter.TraceExporter, error) {
-	traceExporterBuilder, exists := defaultTraceExporters[s]
+	traceExporterBuilder, exists := registry.TraceExporter(s)
 	if !exists && len(s) > 0 {
 		return nil, fmt.Errorf("trace exporter %s is not supported", s)
 	} else if !exists {
@@ -113,7 +96,7 @@ func MakeTraceExporter(tracerExporterBuilder func(...traceexporter.ExporterOptio
 }
 
 func GetBrokerBuilder(s string) (func(...broker.BrokerOption) broker.Broker, error) {
-	brokerBuilder, exists := defaultBrokers[s]
+	brokerBuilder, exists := registry.Broker(s)
 	if !exists && len(s) > 0 {
 		return nil, fmt.Errorf("broker %s is not supported", s)
 	} else if !exists {
@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+	"github.com/w-h-a/sidecar/cmd/config"
+	"github.com/w-h-a/sidecar/pluggable"
+	"github.com/w-h-a/sidecar/registry"
+)
+
+var (
+	// the backends that dial out and therefore need a
+	// reachable address, keyed by the kind of component
+	networkBackends = map[string]map[string]bool{
+		"store":          {"cockroach": true, "redis": true},
+		"broker":         {"snssqs": true},
+		"secret store":   {"ssm": true},
+		"trace exporter": {"otelp": true},
+	}
+)
+
+func validate(ctx *cli.Context) error {
+	problems := Validate(config.ComponentsPath)
+
+	for _, problem := range problems {
+		fmt.Fprintln(ctx.App.Writer, problem)
+	}
+
+	if len(problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("found %d problem(s) in the configuration", len(problems)), 1)
+	}
+
+	fmt.Fprintln(ctx.App.Writer, "configuration is valid")
+
+	return nil
+}
+
+// Validate checks the configuration without building any component
+// and returns every problem it finds.
+func Validate(path string) []string {
+	problems := []string{}
+
+	problems = append(problems, validateListenAddress("http address", config.HttpAddress)...)
+	problems = append(problems, validateListenAddress("grpc address", config.GrpcAddress)...)
+
+	if config.HttpAddress == config.GrpcAddress && len(config.HttpAddress) > 0 {
+		problems = append(problems, fmt.Sprintf("http address and grpc address are both %s", config.HttpAddress))
+	}
+
+	if len(config.ServicePort) > 0 {
+		problems = append(problems, validatePort("service port", config.ServicePort)...)
+	}
+
+	if !oneOf(config.ServiceProtocol, "", "http", "grpc") {
+		problems = append(problems, fmt.Sprintf("service protocol %s is not supported; use http or grpc", config.ServiceProtocol))
+	}
+
+	if config.ReapInterval < 0 {
+		problems = append(problems, fmt.Sprintf("reap interval %s cannot be negative", config.ReapInterval))
+	}
+
+	if config.OutboxInterval < 0 {
+		problems = append(problems, fmt.Sprintf("outbox interval %s cannot be negative", config.OutboxInterval))
+	}
+
+	if config.BulkParallelism < 1 {
+		problems = append(problems, fmt.Sprintf("bulk parallelism %d must be at least 1", config.BulkParallelism))
+	}
+
+	if config.QueryScanLimit < 1 {
+		problems = append(problems, fmt.Sprintf("query scan limit %d must be at least 1", config.QueryScanLimit))
+	}
+
+	if _, err := GetTraceExporterBuilder(config.TraceExporter); err != nil {
+		problems = append(problems, fmt.Sprintf("%v; supported types are %s", err, strings.Join(registry.TraceExporters(), ", ")))
+	}
+
+	if networkBackends["trace exporter"][config.TraceExporter] {
+		problems = append(problems, validateAddress("trace exporter", config.TraceExporter, config.TraceAddress)...)
+	}
+
+	if !oneOf(config.TraceProtocol, "", "http", "grpc") {
+		problems = append(problems, fmt.Sprintf("trace protocol %s is not supported; use http or grpc", config.TraceProtocol))
+	}
+
+	for _, pair := range config.TraceHeaders {
+		if len(pair) > 0 && len(strings.Split(pair, "=")) != 2 {
+			problems = append(problems, fmt.Sprintf("trace header %s is not of form <key>=<value>", pair))
+		}
+	}
+
+	if len(config.PluggableComponentsDir) > 0 {
+		if err := pluggable.Discover(config.PluggableComponentsDir); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	components, err := config.LoadComponents(path)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+
+	for _, c := range components.Stores {
+		if _, err := GetStoreBuilder(c.Type); err != nil {
+			problems = append(problems, fmt.Sprintf("store %s: %v; supported types are %s", c.Name, err, strings.Join(registry.Stores(), ", ")))
+		} else if len(c.Type) == 0 {
+			problems = append(problems, fmt.Sprintf("store %s requires a type", c.Name))
+		}
+
+		if networkBackends["store"][c.Type] && len(c.SecretRefs["address"]) == 0 {
+			problems = append(problems, validateAddress("store "+c.Name, c.Type, c.Address)...)
+		}
+
+		problems = append(problems, validateSecretRefs("store "+c.Name, c, components.Secrets)...)
+	}
+
+	for _, c := range components.Producers {
+		if _, err := GetBrokerBuilder(c.Type); err != nil {
+			problems = append(problems, fmt.Sprintf("producer %s: %v; supported types are %s", c.Name, err, strings.Join(registry.Brokers(), ", ")))
+		} else if len(c.Type) == 0 {
+			problems = append(problems, fmt.Sprintf("producer %s requires a type", c.Name))
+		}
+
+		if networkBackends["broker"][c.Type] && len(c.SecretRefs["address"]) == 0 {
+			problems = append(problems, validateAddress("producer "+c.Name, c.Type, c.Address)...)
+		}
+
+		problems = append(problems, validateSecretRefs("producer "+c.Name, c, components.Secrets)...)
+	}
+
+	for _, c := range components.Consumers {
+		if _, err := GetBrokerBuilder(c.Type); err != nil {
+			problems = append(problems, fmt.Sprintf("consumer %s: %v; supported types are %s", c.Name, err, strings.Join(registry.Brokers(), ", ")))
+		} else if len(c.Type) == 0 {
+			problems = append(problems, fmt.Sprintf("consumer %s requires a type", c.Name))
+		}
+
+		if networkBackends["broker"][c.Type] && len(c.SecretRefs["address"]) == 0 {
+			problems = append(problems, validateAddress("consumer "+c.Name, c.Type, c.Address)...)
+		}
+
+		problems = append(problems, validateSecretRefs("consumer "+c.Name, c, components.Secrets)...)
+
+		if _, _, ok := consumerGroupTopic(c.Name); !ok {
+			problems = append(problems, fmt.Sprintf("consumer %s should be of form <group>-<topic>", c.Name))
+		}
+	}
+
+	for _, c := range components.Secrets {
+		if _, err := GetSecretBuilder(c.Type); err != nil {
+			problems = append(problems, fmt.Sprintf("secret store %s: %v; supported types are %s", c.Name, err, strings.Join(registry.Secrets(), ", ")))
+		} else if len(c.Type) == 0 {
+			problems = append(problems, fmt.Sprintf("secret store %s requires a type", c.Name))
+		}
+
+		if networkBackends["secret store"][c.Type] && len(c.SecretRefs) == 0 {
+			problems = append(problems, validateAddress("secret store "+c.Name, c.Type, c.Address)...)
+		}
+
+		if len(c.SecretRefs) > 0 {
+			problems = append(problems, fmt.Sprintf("secret store %s cannot refer to secrets", c.Name))
+		}
+	}
+
+	if config.IsSecretRef(config.AwsAccessKeyId) {
+		problems = append(problems, validateSecretRef("aws access key id", config.AwsAccessKeyId, components.Secrets)...)
+	}
+
+	if config.IsSecretRef(config.AwsSecretAccessKey) {
+		problems = append(problems, validateSecretRef("aws secret access key", config.AwsSecretAccessKey, components.Secrets)...)
+	}
+
+	return problems
+}
+
+func validateSecretRefs(name string, c config.Component, secrets []config.Component) []string {
+	problems := []string{}
+
+	for _, field := range c.RefFields() {
+		if _, err := c.Field(field); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+
+		problems = append(problems, validateSecretRef(name+" "+field, c.SecretRefs[field], secrets)...)
+	}
+
+	return problems
+}
+
+func validateSecretRef(name, value string, secrets []config.Component) []string {
+	ref, err := config.ParseSecretRef(value)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", name, err)}
+	}
+
+	for _, s := range secrets {
+		if s.Name == ref.SecretId {
+			return nil
+		}
+	}
+
+	return []string{fmt.Sprintf("%s refers to secret store %s, which is not configured", name, ref.SecretId)}
+}
+
+func validateListenAddress(name, address string) []string {
+	if len(address) == 0 {
+		return []string{fmt.Sprintf("%s is required", name)}
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return []string{fmt.Sprintf("%s %s is not of form [host]:<port>: %v", name, address, err)}
+	}
+
+	return validatePort(name, port)
+}
+
+func validatePort(name, port string) []string {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return []string{fmt.Sprintf("%s has an invalid port %s", name, port)}
+	}
+
+	return nil
+}
+
+func validateAddress(name, typ, address string) []string {
+	if len(address) == 0 {
+		return []string{fmt.Sprintf("%s of type %s requires an address", name, typ)}
+	}
+
+	if !strings.Contains(address, "://") {
+		return validateListenAddress(name+" address", address)
+	}
+
+	// the address may hold credentials, so only the
+	// underlying reason is reported when it fails to parse
+	u, err := url.Parse(address)
+	if e, ok := err.(*url.Error); ok {
+		return []string{fmt.Sprintf("%s has an invalid address: %v", name, e.Err)}
+	} else if err != nil {
+		return []string{fmt.Sprintf("%s has an invalid address", name)}
+	}
+
+	if len(u.Host) == 0 {
+		return []string{fmt.Sprintf("%s has an address without a host", name)}
+	}
+
+	if len(u.Port()) > 0 {
+		return validatePort(name+" address", u.Port())
+	}
+
+	return nil
+}
+
+func oneOf(s string, options ...string) bool {
+	for _, o := range options {
+		if s == o {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/sidecar/cmd/config"
+)
+
+func TestValidate(t *testing.T) {
+	config.HttpAddress = ":3501"
+	config.GrpcAddress = ":50001"
+	config.ServiceProtocol = "http"
+	config.BulkParallelism = 10
+	config.QueryScanLimit = 10000
+
+	dir := t.TempDir()
+
+	testCases := []struct {
+		name     string
+		manifest string
+		problems []string
+	}{
+		{
+			name: "valid manifest",
+			manifest: `stores:
+  - name: orders
+    type: memory
+  - name: cache
+    type: redis
+    address: localhost:6379
+consumers:
+  - name: billing-orders
+    type: memory
+  - name: billing-orders-created
+    type: memory
+`,
+			problems: []string{},
+		},
+		{
+			name: "manifest with many problems",
+			manifest: `stores:
+  - name: orders
+    type: mongo
+  - name: untyped
+  - name: cache
+    type: redis
+  - name: remote
+    type: cockroach
+    address: postgres://localhost:99999/db
+  - name: secretive
+    type: memory
+    secretRefs:
+      address: vault:db/address
+producers:
+  - name: orders-created
+    type: kafka
+consumers:
+  - name: billing
+    type: memory
+  - name: billing-orders-created
+    type: memory
+  - name: -orders
+    type: memory
+secrets:
+  - name: env
+    type: env
+    secretRefs:
+      address: env:address
+`,
+			problems: []string{
+				"store orders: store mongo is not supported; supported types are cockroach, dynamodb, file, memory, redis, sqlite",
+				"store untyped requires a type",
+				"store cache of type redis requires an address",
+				"store remote address has an invalid port 99999",
+				"store secretive address refers to secret store vault, which is not configured",
+				"producer orders-created: broker kafka is not supported; supported types are memory, snssqs",
+				"consumer billing should be of form <group>-<topic>",
+				"consumer -orders should be of form <group>-<topic>",
+				"secret store env cannot refer to secrets",
+			},
+		},
+		{
+			name:     "manifest that does not exist",
+			manifest: "",
+			problems: []string{
+				"failed to read components manifest " + filepath.Join(dir, "manifest that does not exist.yml") + ": open " + filepath.Join(dir, "manifest that does not exist.yml") + ": no such file or directory",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			path := filepath.Join(dir, testCase.name+".yml")
+
+			if len(testCase.manifest) > 0 {
+				require.NoError(t, os.WriteFile(path, []byte(testCase.manifest), 0o644))
+			}
+
+			require.ElementsMatch(t, testCase.problems, Validate(path))
+		})
+	}
+}
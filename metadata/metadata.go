@@ -0,0 +1,30 @@
+// Package metadata describes a running sidecar and the components
+// it has loaded.
+package metadata
+
+type Metadata struct {
+	Namespace     string      `json:"namespace"`
+	Name          string      `json:"name"`
+	Version       string      `json:"version"`
+	App           App         `json:"app"`
+	Stores        []Component `json:"stores"`
+	Producers     []Component `json:"producers"`
+	Consumers     []Component `json:"consumers"`
+	Secrets       []Component `json:"secrets"`
+	TraceExporter string      `json:"traceExporter"`
+}
+
+type App struct {
+	Port     string `json:"port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// Component is a store, a producer or consumer of a broker, or a
+// secret store. Topic is set for producers and consumers and Group
+// for consumers only.
+type Component struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Topic string `json:"topic,omitempty"`
+	Group string `json:"group,omitempty"`
+}
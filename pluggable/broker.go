@@ -0,0 +1,157 @@
+package pluggable
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/utils/datautils"
+	pb "github.com/w-h-a/sidecar/proto/pluggable"
+	"google.golang.org/grpc"
+)
+
+type pluggableBroker struct {
+	options broker.BrokerOptions
+	client  pb.BrokerClient
+	conn    *grpc.ClientConn
+}
+
+func (b *pluggableBroker) Options() broker.BrokerOptions {
+	return b.options
+}
+
+func (b *pluggableBroker) Publish(data interface{}, options broker.PublishOptions) error {
+	bs, err := datautils.Stringify(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err = b.client.Publish(ctx, &pb.PublishRequest{
+		Topic: options.Topic,
+		Data:  bs,
+	})
+
+	return err
+}
+
+func (b *pluggableBroker) Subscribe(callback func([]byte) error, options broker.SubscribeOptions) broker.Subscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sub := &subscriber{
+		options: options,
+		id:      uuid.New().String(),
+		handler: callback,
+		cancel:  cancel,
+	}
+
+	go func() {
+		for {
+			if err := b.consume(ctx, sub); err != nil {
+				log.Errorf("pluggable subscriber for group %s failed: %v", options.Group, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	return sub
+}
+
+func (b *pluggableBroker) String() string {
+	return "pluggable"
+}
+
+// Close closes the connection to the socket of the component
+func (b *pluggableBroker) Close() error {
+	return b.conn.Close()
+}
+
+func (b *pluggableBroker) consume(ctx context.Context, sub *subscriber) error {
+	stream, err := b.client.Subscribe(ctx, &pb.SubscribeRequest{
+		Group: sub.options.Group,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := stream.Recv()
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := sub.Handler(msg.Data); err != nil {
+			log.Errorf("failed to handle message for group %s: %v", sub.options.Group, err)
+		}
+	}
+}
+
+func (b *pluggableBroker) configure() error {
+	if len(b.options.Nodes) == 0 {
+		return fmt.Errorf("pluggable broker socket is required")
+	}
+
+	conn, err := dial(b.options.Nodes[0])
+	if err != nil {
+		return err
+	}
+
+	b.conn = conn
+	b.client = pb.NewBrokerClient(conn)
+
+	return nil
+}
+
+func NewBroker(opts ...broker.BrokerOption) broker.Broker {
+	options := broker.NewBrokerOptions(opts...)
+
+	b := &pluggableBroker{
+		options: options,
+	}
+
+	if err := b.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return b
+}
+
+type subscriber struct {
+	options broker.SubscribeOptions
+	id      string
+	handler func([]byte) error
+	cancel  context.CancelFunc
+}
+
+func (s *subscriber) Options() broker.SubscribeOptions {
+	return s.options
+}
+
+func (s *subscriber) Id() string {
+	return s.id
+}
+
+func (s *subscriber) Handler(b []byte) error {
+	return s.handler(b)
+}
+
+func (s *subscriber) Unsubscribe() error {
+	s.cancel()
+	return nil
+}
+
+func (s *subscriber) String() string {
+	return "pluggable"
+}
@@ -0,0 +1,168 @@
+// Package memory is a reference pluggable store that keeps its
+// records in memory. It shows what a pluggable component has to
+// serve and backs the integration tests.
+package memory
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/store/memory"
+	pb "github.com/w-h-a/sidecar/proto/pluggable"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+type storeServer struct {
+	pb.UnimplementedStoreServer
+	stores map[string]store.Store
+	mtx    sync.Mutex
+}
+
+func (s *storeServer) Write(ctx context.Context, req *pb.WriteRequest) (*pb.WriteResponse, error) {
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "a record is required")
+	}
+
+	err := s.get(req.Database, req.Table).Write(&store.Record{
+		Key:    req.Record.Key,
+		Value:  req.Record.Value,
+		Expiry: time.Duration(req.Record.Expiry),
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.WriteResponse{}, nil
+}
+
+func (s *storeServer) Read(ctx context.Context, req *pb.ReadRequest) (*pb.ReadResponse, error) {
+	opts := []store.ReadOption{}
+
+	if req.Prefix {
+		opts = append(opts, store.ReadWithPrefix())
+	}
+
+	if req.Suffix {
+		opts = append(opts, store.ReadWithSuffix())
+	}
+
+	if req.Limit > 0 {
+		opts = append(opts, store.ReadWithLimit(uint(req.Limit)))
+	}
+
+	if req.Offset > 0 {
+		opts = append(opts, store.ReadWithOffset(uint(req.Offset)))
+	}
+
+	recs, err := s.get(req.Database, req.Table).Read(req.Key, opts...)
+	if errors.Is(err, store.ErrRecordNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	rsp := &pb.ReadResponse{}
+
+	for _, rec := range recs {
+		rsp.Records = append(rsp.Records, &pb.Record{
+			Key:    rec.Key,
+			Value:  rec.Value,
+			Expiry: int64(rec.Expiry),
+		})
+	}
+
+	return rsp, nil
+}
+
+func (s *storeServer) List(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
+	opts := []store.ListOption{}
+
+	if len(req.Prefix) > 0 {
+		opts = append(opts, store.ListWithPrefix(req.Prefix))
+	}
+
+	if len(req.Suffix) > 0 {
+		opts = append(opts, store.ListWithSuffix(req.Suffix))
+	}
+
+	if req.Limit > 0 {
+		opts = append(opts, store.ListWithLimit(uint(req.Limit)))
+	}
+
+	if req.Offset > 0 {
+		opts = append(opts, store.ListWithOffset(uint(req.Offset)))
+	}
+
+	keys, err := s.get(req.Database, req.Table).List(opts...)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.ListResponse{Keys: keys}, nil
+}
+
+func (s *storeServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	if err := s.get(req.Database, req.Table).Delete(req.Key); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.DeleteResponse{}, nil
+}
+
+func (s *storeServer) get(database, table string) store.Store {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := database + ":" + table
+
+	if st, ok := s.stores[key]; ok {
+		return st
+	}
+
+	st := memory.NewStore(
+		store.StoreWithDatabase(database),
+		store.StoreWithTable(table),
+	)
+
+	s.stores[key] = st
+
+	return st
+}
+
+func NewStoreServer() pb.StoreServer {
+	return &storeServer{
+		stores: map[string]store.Store{},
+		mtx:    sync.Mutex{},
+	}
+}
+
+// Serve serves a new in-memory store on the unix domain socket at
+// path along with the server reflection that discovery relies on.
+func Serve(path string) (*grpc.Server, error) {
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := grpc.NewServer()
+
+	pb.RegisterStoreServer(srv, NewStoreServer())
+
+	reflection.Register(srv)
+
+	go srv.Serve(lis)
+
+	return srv, nil
+}
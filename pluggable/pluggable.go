@@ -0,0 +1,162 @@
+// Package pluggable talks to components that run in their own
+// process and serve the contract in proto/pluggable on a unix
+// domain socket.
+package pluggable
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/security/secret"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+)
+
+const (
+	socketExtension = ".sock"
+	requestTimeout  = 10 * time.Second
+)
+
+var (
+	mtx sync.Mutex
+	// the names that discovery registered, by the service that
+	// they serve, which a later discovery may register again
+	discovered = map[string]map[string]bool{}
+)
+
+// Discover registers every pluggable component serving on a unix domain
+// socket in dir. A component is registered under the name of its socket
+// without the extension, once for each of the store, broker, and secret
+// services it serves. A component cannot take the name of a backend
+// that was registered in any other way, such as memory or redis.
+func Discover(dir string) error {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read pluggable components directory %s: %v", dir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSocket == 0 || !strings.HasSuffix(entry.Name(), socketExtension) {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), socketExtension)
+
+		address := "unix://" + filepath.Join(dir, entry.Name())
+
+		services, err := listServices(address)
+		if err != nil {
+			return fmt.Errorf("failed to discover pluggable component %s: %v", name, err)
+		}
+
+		for _, service := range services {
+			if taken(service, name) {
+				return fmt.Errorf("pluggable component %s cannot replace the built-in backend of the same name", name)
+			}
+
+			switch service {
+			case "pluggable.Store":
+				registry.RegisterStore(name, func(opts ...store.StoreOption) store.Store {
+					return NewStore(append(opts, store.StoreWithNodes(address))...)
+				})
+			case "pluggable.Broker":
+				registry.RegisterBroker(name, func(opts ...broker.BrokerOption) broker.Broker {
+					return NewBroker(append(opts, broker.BrokerWithNodes(address))...)
+				})
+			case "pluggable.Secret":
+				registry.RegisterSecret(name, func(opts ...secret.SecretOption) secret.Secret {
+					return NewSecret(append(opts, secret.SecretWithNodes(address))...)
+				})
+			default:
+				continue
+			}
+
+			if discovered[service] == nil {
+				discovered[service] = map[string]bool{}
+			}
+
+			discovered[service][name] = true
+
+			log.Infof("discovered pluggable component %s serving %s", name, service)
+		}
+	}
+
+	return nil
+}
+
+// taken tells whether the name is registered for the service by
+// something other than discovery
+func taken(service, name string) bool {
+	if discovered[service][name] {
+		return false
+	}
+
+	var ok bool
+
+	switch service {
+	case "pluggable.Store":
+		_, ok = registry.Store(name)
+	case "pluggable.Broker":
+		_, ok = registry.Broker(name)
+	case "pluggable.Secret":
+		_, ok = registry.Secret(name)
+	}
+
+	return ok
+}
+
+func listServices(address string) ([]string, error) {
+	conn, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}); err != nil {
+		return nil, err
+	}
+
+	rsp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	if e := rsp.GetErrorResponse(); e != nil {
+		return nil, fmt.Errorf("%s", e.ErrorMessage)
+	}
+
+	services := []string{}
+
+	for _, service := range rsp.GetListServicesResponse().GetService() {
+		services = append(services, service.Name)
+	}
+
+	return services, nil
+}
+
+func dial(address string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
@@ -0,0 +1,75 @@
+package pluggable
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/w-h-a/pkg/security/secret"
+	"github.com/w-h-a/pkg/telemetry/log"
+	pb "github.com/w-h-a/sidecar/proto/pluggable"
+	"google.golang.org/grpc"
+)
+
+type pluggableSecret struct {
+	options secret.SecretOptions
+	client  pb.SecretClient
+	conn    *grpc.ClientConn
+}
+
+func (s *pluggableSecret) Options() secret.SecretOptions {
+	return s.options
+}
+
+func (s *pluggableSecret) GetSecret(key string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	rsp, err := s.client.Get(ctx, &pb.GetSecretRequest{
+		Prefix: s.options.Prefix,
+		Key:    key,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.Data, nil
+}
+
+func (s *pluggableSecret) String() string {
+	return "pluggable"
+}
+
+// Close closes the connection to the socket of the component
+func (s *pluggableSecret) Close() error {
+	return s.conn.Close()
+}
+
+func (s *pluggableSecret) configure() error {
+	if len(s.options.Nodes) == 0 {
+		return fmt.Errorf("pluggable secret store socket is required")
+	}
+
+	conn, err := dial(s.options.Nodes[0])
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.client = pb.NewSecretClient(conn)
+
+	return nil
+}
+
+func NewSecret(opts ...secret.SecretOption) secret.Secret {
+	options := secret.NewSecretOptions(opts...)
+
+	s := &pluggableSecret{
+		options: options,
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
@@ -0,0 +1,151 @@
+package pluggable
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	pb "github.com/w-h-a/sidecar/proto/pluggable"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pluggableStore is not a stamper since the protocol of pluggable
+// components has no metadata, so its records are read without it and
+// listing them since a time is rejected as unimplemented.
+type pluggableStore struct {
+	options store.StoreOptions
+	client  pb.StoreClient
+	conn    *grpc.ClientConn
+}
+
+func (s *pluggableStore) Options() store.StoreOptions {
+	return s.options
+}
+
+func (s *pluggableStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := s.client.Write(ctx, &pb.WriteRequest{
+		Database: s.options.Database,
+		Table:    s.options.Table,
+		Record: &pb.Record{
+			Key:    rec.Key,
+			Value:  rec.Value,
+			Expiry: int64(rec.Expiry),
+		},
+	})
+
+	return err
+}
+
+func (s *pluggableStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	options := store.NewReadOptions(opts...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	rsp, err := s.client.Read(ctx, &pb.ReadRequest{
+		Database: s.options.Database,
+		Table:    s.options.Table,
+		Key:      key,
+		Prefix:   options.Prefix,
+		Suffix:   options.Suffix,
+		Limit:    uint32(options.Limit),
+		Offset:   uint32(options.Offset),
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, store.ErrRecordNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	records := []*store.Record{}
+
+	for _, rec := range rsp.Records {
+		records = append(records, &store.Record{
+			Key:    rec.Key,
+			Value:  rec.Value,
+			Expiry: time.Duration(rec.Expiry),
+		})
+	}
+
+	return records, nil
+}
+
+func (s *pluggableStore) List(opts ...store.ListOption) ([]string, error) {
+	options := store.NewListOptions(opts...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	rsp, err := s.client.List(ctx, &pb.ListRequest{
+		Database: s.options.Database,
+		Table:    s.options.Table,
+		Prefix:   options.Prefix,
+		Suffix:   options.Suffix,
+		Limit:    uint32(options.Limit),
+		Offset:   uint32(options.Offset),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.Keys, nil
+}
+
+func (s *pluggableStore) Delete(key string, opts ...store.DeleteOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := s.client.Delete(ctx, &pb.DeleteRequest{
+		Database: s.options.Database,
+		Table:    s.options.Table,
+		Key:      key,
+	})
+
+	return err
+}
+
+func (s *pluggableStore) String() string {
+	return "pluggable"
+}
+
+// Close closes the connection to the socket of the component
+func (s *pluggableStore) Close() error {
+	return s.conn.Close()
+}
+
+func (s *pluggableStore) configure() error {
+	if len(s.options.Nodes) == 0 {
+		return fmt.Errorf("pluggable store socket is required")
+	}
+
+	conn, err := dial(s.options.Nodes[0])
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.client = pb.NewStoreClient(conn)
+
+	return nil
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	options := store.NewStoreOptions(opts...)
+
+	s := &pluggableStore{
+		options: options,
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
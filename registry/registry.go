@@ -0,0 +1,176 @@
+// Package registry holds the backends that the sidecar can build
+// components from. Custom binaries may register their own backends
+// in init() and then reuse cmd.Commands() unchanged.
+package registry
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/w-h-a/pkg/broker"
+	memorybroker "github.com/w-h-a/pkg/broker/memory"
+	"github.com/w-h-a/pkg/broker/snssqs"
+	"github.com/w-h-a/pkg/security/secret"
+	"github.com/w-h-a/pkg/security/secret/env"
+	"github.com/w-h-a/pkg/security/secret/ssm"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/traceexporter"
+	memorytraceexporter "github.com/w-h-a/pkg/telemetry/traceexporter/memory"
+	"github.com/w-h-a/pkg/telemetry/traceexporter/otelp"
+	"github.com/w-h-a/sidecar/store/cockroach"
+	"github.com/w-h-a/sidecar/store/dynamodb"
+	"github.com/w-h-a/sidecar/store/file"
+	memorystore "github.com/w-h-a/sidecar/store/memory"
+	"github.com/w-h-a/sidecar/store/redis"
+	"github.com/w-h-a/sidecar/store/sqlite"
+)
+
+var (
+	mtx sync.RWMutex
+
+	stores = map[string]func(...store.StoreOption) store.Store{
+		"cockroach": cockroach.NewStore,
+		"memory":    memorystore.NewStore,
+		"file":      file.NewStore,
+		"redis":     redis.NewStore,
+		"dynamodb":  dynamodb.NewStore,
+		"sqlite":    sqlite.NewStore,
+	}
+
+	brokers = map[string]func(...broker.BrokerOption) broker.Broker{
+		"snssqs": snssqs.NewBroker,
+		"memory": memorybroker.NewBroker,
+	}
+
+	secrets = map[string]func(...secret.SecretOption) secret.Secret{
+		"ssm": ssm.NewSecret,
+		"env": env.NewSecret,
+	}
+
+	traceExporters = map[string]func(...traceexporter.ExporterOption) traceexporter.TraceExporter{
+		"otelp":  otelp.NewExporter,
+		"memory": memorytraceexporter.NewExporter,
+	}
+)
+
+// RegisterStore makes a store backend available under name. Registering
+// a name that is already taken replaces the previous backend.
+func RegisterStore(name string, builder func(...store.StoreOption) store.Store) {
+	if len(name) == 0 || builder == nil {
+		panic("registry: store requires a name and a builder")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	stores[name] = builder
+}
+
+func RegisterBroker(name string, builder func(...broker.BrokerOption) broker.Broker) {
+	if len(name) == 0 || builder == nil {
+		panic("registry: broker requires a name and a builder")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	brokers[name] = builder
+}
+
+func RegisterSecret(name string, builder func(...secret.SecretOption) secret.Secret) {
+	if len(name) == 0 || builder == nil {
+		panic("registry: secret store requires a name and a builder")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	secrets[name] = builder
+}
+
+func RegisterTraceExporter(name string, builder func(...traceexporter.ExporterOption) traceexporter.TraceExporter) {
+	if len(name) == 0 || builder == nil {
+		panic("registry: trace exporter requires a name and a builder")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	traceExporters[name] = builder
+}
+
+func Store(name string) (func(...store.StoreOption) store.Store, bool) {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	builder, ok := stores[name]
+
+	return builder, ok
+}
+
+func Broker(name string) (func(...broker.BrokerOption) broker.Broker, bool) {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	builder, ok := brokers[name]
+
+	return builder, ok
+}
+
+func Secret(name string) (func(...secret.SecretOption) secret.Secret, bool) {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	builder, ok := secrets[name]
+
+	return builder, ok
+}
+
+func TraceExporter(name string) (func(...traceexporter.ExporterOption) traceexporter.TraceExporter, bool) {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	builder, ok := traceExporters[name]
+
+	return builder, ok
+}
+
+func Stores() []string {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return names(stores)
+}
+
+func Brokers() []string {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return names(brokers)
+}
+
+func Secrets() []string {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return names(secrets)
+}
+
+func TraceExporters() []string {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return names(traceExporters)
+}
+
+func names[T any](builders map[string]T) []string {
+	ns := []string{}
+
+	for name := range builders {
+		ns = append(ns, name)
+	}
+
+	sort.Strings(ns)
+
+	return ns
+}
@@ -0,0 +1,154 @@
+package registry_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/telemetry/log"
+	logmemory "github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	"github.com/w-h-a/sidecar/cmd"
+	"github.com/w-h-a/sidecar/pluggable"
+	"github.com/w-h-a/sidecar/pluggable/memory"
+	"github.com/w-h-a/sidecar/registry"
+	memorystore "github.com/w-h-a/sidecar/store/memory"
+)
+
+func TestMain(m *testing.M) {
+	logger := logmemory.NewLog(
+		log.LogWithPrefix("test registry"),
+		logmemory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	os.Exit(m.Run())
+}
+
+func TestBuiltIns(t *testing.T) {
+	testCases := []struct {
+		kind   string
+		lookup func(name string) bool
+		names  []string
+	}{
+		{
+			kind: "store",
+			lookup: func(name string) bool {
+				builder, ok := registry.Store(name)
+				return ok && builder != nil
+			},
+			names: []string{"cockroach", "dynamodb", "file", "memory", "redis", "sqlite"},
+		},
+		{
+			kind: "broker",
+			lookup: func(name string) bool {
+				builder, ok := registry.Broker(name)
+				return ok && builder != nil
+			},
+			names: []string{"memory", "snssqs"},
+		},
+		{
+			kind: "secret store",
+			lookup: func(name string) bool {
+				builder, ok := registry.Secret(name)
+				return ok && builder != nil
+			},
+			names: []string{"env", "ssm"},
+		},
+		{
+			kind: "trace exporter",
+			lookup: func(name string) bool {
+				builder, ok := registry.TraceExporter(name)
+				return ok && builder != nil
+			},
+			names: []string{"memory", "otelp"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.kind, func(t *testing.T) {
+			for _, name := range testCase.names {
+				require.True(t, testCase.lookup(name), "%s %s is not registered", testCase.kind, name)
+			}
+
+			require.False(t, testCase.lookup("mongo"))
+		})
+	}
+
+	require.Subset(t, registry.Stores(), []string{"cockroach", "dynamodb", "file", "memory", "redis", "sqlite"})
+	require.Subset(t, registry.Brokers(), []string{"memory", "snssqs"})
+	require.Subset(t, registry.Secrets(), []string{"env", "ssm"})
+	require.Subset(t, registry.TraceExporters(), []string{"memory", "otelp"})
+}
+
+func TestUnknownType(t *testing.T) {
+	_, err := cmd.GetStoreBuilder("mongo")
+	require.EqualError(t, err, "store mongo is not supported")
+
+	_, err = cmd.GetBrokerBuilder("kafka")
+	require.EqualError(t, err, "broker kafka is not supported")
+
+	_, err = cmd.GetSecretBuilder("vault")
+	require.EqualError(t, err, "secret store vault is not supported")
+
+	_, err = cmd.GetTraceExporterBuilder("zipkin")
+	require.EqualError(t, err, "trace exporter zipkin is not supported")
+
+	// no type is not an error but builds nothing
+	builder, err := cmd.GetStoreBuilder("")
+	require.NoError(t, err)
+	require.Nil(t, builder)
+}
+
+func TestRegister(t *testing.T) {
+	registry.RegisterStore("registered", memorystore.NewStore)
+
+	builder, ok := registry.Store("registered")
+	require.True(t, ok)
+	require.Equal(t, reflect.ValueOf(memorystore.NewStore).Pointer(), reflect.ValueOf(builder).Pointer())
+	require.Contains(t, registry.Stores(), "registered")
+
+	require.Panics(t, func() {
+		registry.RegisterStore("", memorystore.NewStore)
+	})
+
+	require.Panics(t, func() {
+		registry.RegisterStore("registered", nil)
+	})
+}
+
+func TestPluggableName(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Log("a pluggable component named after a built-in backend")
+
+	srv, err := memory.Serve(filepath.Join(dir, "memory.sock"))
+	require.NoError(t, err)
+
+	err = pluggable.Discover(dir)
+	require.EqualError(t, err, "pluggable component memory cannot replace the built-in backend of the same name")
+
+	builder, ok := registry.Store("memory")
+	require.True(t, ok)
+	require.Equal(t, reflect.ValueOf(memorystore.NewStore).Pointer(), reflect.ValueOf(builder).Pointer())
+
+	// stopping the server removes its socket
+	srv.Stop()
+
+	t.Log("a pluggable component that is discovered again")
+
+	srv, err = memory.Serve(filepath.Join(dir, "plugged.sock"))
+	require.NoError(t, err)
+
+	defer srv.Stop()
+
+	require.NoError(t, pluggable.Discover(dir))
+	require.NoError(t, pluggable.Discover(dir))
+
+	builder, ok = registry.Store("plugged")
+	require.True(t, ok)
+	require.NotEqual(t, reflect.ValueOf(memorystore.NewStore).Pointer(), reflect.ValueOf(builder).Pointer())
+}
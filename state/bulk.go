@@ -0,0 +1,213 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/w-h-a/pkg/store"
+)
+
+const (
+	deleteBatchSize = 100
+)
+
+// Bulk is the result of a bulk get. Its records are in the order of
+// the keys that were asked for and the keys without a record are
+// missing.
+type Bulk struct {
+	Records []*store.Record
+	Missing []string
+}
+
+// BulkGet reads the records of the keys from the store, running as
+// many reads at once as the bulk parallelism allows. A key that is
+// asked for more than once is read once.
+func (s *State) BulkGet(storeId string, keys []string) (*Bulk, error) {
+	st, err := s.Store(storeId)
+	if err != nil {
+		return nil, err
+	}
+
+	unique := dedupe(keys)
+
+	recs := make([]*store.Record, len(unique))
+
+	errs := make([]error, len(unique))
+
+	s.parallel(len(unique), func(i int) {
+		recs[i], errs[i] = read(st, unique[i])
+	})
+
+	bulk := &Bulk{
+		Records: []*store.Record{},
+		Missing: []string{},
+	}
+
+	for i, key := range unique {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+
+		if recs[i] == nil {
+			bulk.Missing = append(bulk.Missing, key)
+			continue
+		}
+
+		bulk.Records = append(bulk.Records, recs[i])
+	}
+
+	return bulk, nil
+}
+
+// BulkDelete deletes the records of the keys or, when there are no
+// keys, the records whose keys have the prefix, a batch at a time. A
+// key that is given more than once is deleted once. It
+// returns how many records there were and calls progress with the
+// count so far after every batch.
+func (s *State) BulkDelete(storeId string, keys []string, prefix string, progress func(deleted int)) (int, error) {
+	st, err := s.Store(storeId)
+	if err != nil {
+		return 0, err
+	}
+
+	if progress == nil {
+		progress = func(int) {}
+	}
+
+	deleted := 0
+
+	if len(keys) > 0 {
+		keys = dedupe(keys)
+
+		for start := 0; start < len(keys); start += deleteBatchSize {
+			end := start + deleteBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			n, err := s.deleteKeys(st, keys[start:end], true)
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+
+			progress(deleted)
+		}
+
+		return deleted, nil
+	}
+
+	after := ""
+
+	for {
+		recs, err := ReadPage(st, prefix, after, deleteBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+
+		if len(recs) == 0 {
+			return deleted, nil
+		}
+
+		batch := []string{}
+
+		for _, rec := range recs {
+			batch = append(batch, rec.Key)
+		}
+
+		n, err := s.deleteKeys(st, batch, false)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+
+		progress(deleted)
+
+		after = batch[len(batch)-1]
+	}
+}
+
+// deleteKeys deletes the records of the keys and returns how many there
+// were. The keys that are not known to have records are read first.
+func (s *State) deleteKeys(st store.Store, keys []string, check bool) (int, error) {
+	found := make([]bool, len(keys))
+
+	errs := make([]error, len(keys))
+
+	s.parallel(len(keys), func(i int) {
+		if check {
+			rec, err := read(st, keys[i])
+			if err != nil || rec == nil {
+				errs[i] = err
+				return
+			}
+		}
+
+		if errs[i] = st.Delete(keys[i]); errs[i] == nil {
+			found[i] = true
+		}
+	})
+
+	deleted := 0
+
+	for i := range keys {
+		if found[i] {
+			deleted++
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// parallel calls fn with every index below n, running as many calls at
+// once as the bulk parallelism allows
+func (s *State) parallel(n int, fn func(i int)) {
+	sem := make(chan struct{}, s.options.BulkParallelism)
+
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// dedupe returns the keys in order without the ones seen before
+func dedupe(keys []string) []string {
+	unique := []string{}
+
+	seen := map[string]bool{}
+
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+
+	return unique
+}
+
+// read returns the record of the key or nil when there is none
+func read(st store.Store, key string) (*store.Record, error) {
+	recs, err := st.Read(key)
+	if err == store.ErrRecordNotFound || (err == nil && len(recs) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return recs[0], nil
+}
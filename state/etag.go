@@ -0,0 +1,138 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+
+	"github.com/w-h-a/pkg/store"
+)
+
+const (
+	// AnyEtag matches the etag of every record that exists
+	AnyEtag = "*"
+)
+
+var (
+	ErrEtagMismatch = errors.New("etag does not match the record")
+	ErrNotSwappable = errors.New("store cannot check the etags of its records")
+)
+
+// Swapper is implemented by stampers that can write or delete a record
+// only while its version is still the version that was read, so that
+// the check holds across every sidecar that shares the store. The old
+// metadata is nil for a record that was read without metadata, which
+// is then only swapped while it still has none. Checked writes to
+// other stores fail with ErrNotSwappable.
+type Swapper interface {
+	CompareAndSwap(rec *store.Record, old *Meta) (bool, error)
+	CompareAndDelete(key string, old *Meta) (bool, error)
+}
+
+// Etag returns the etag of a record. The etag of a record with metadata
+// is its version and when it was created, so that every write of the
+// record changes it, also one that writes a value that the record had
+// before. The etag of a record without metadata is a hash of its value.
+func Etag(value []byte, meta *Meta) string {
+	if meta != nil {
+		return strconv.FormatUint(meta.Version, 36) + "-" + strconv.FormatInt(meta.CreatedAt.UnixNano(), 36)
+	}
+
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Matches tells whether the etag is the etag of the record or AnyEtag
+func Matches(value []byte, meta *Meta, etag string) bool {
+	return etag == AnyEtag || Etag(value, meta) == etag
+}
+
+// Write writes the record to the store. When the etag is not empty,
+// the record is only written while the etag of the record in the
+// store matches it and ErrEtagMismatch is returned otherwise. Checked
+// writes to stores that are not Swappers return ErrNotSwappable.
+func (s *State) Write(storeId string, rec *store.Record, etag string) error {
+	st, err := s.Store(storeId)
+	if err != nil {
+		return err
+	}
+
+	if len(etag) == 0 {
+		return st.Write(rec)
+	}
+
+	sw, ok := st.(Swapper)
+	if !ok {
+		return ErrNotSwappable
+	}
+
+	old, err := s.match(st, rec.Key, etag)
+	if err != nil {
+		return err
+	}
+
+	if swapped, err := sw.CompareAndSwap(rec, old); err != nil {
+		return err
+	} else if !swapped {
+		return ErrEtagMismatch
+	}
+
+	return nil
+}
+
+// Delete deletes the record of the key from the store. When the etag
+// is not empty, the record is only deleted while the etag of the record
+// in the store matches it and ErrEtagMismatch is returned otherwise.
+// Checked deletes from stores that are not Swappers return
+// ErrNotSwappable.
+func (s *State) Delete(storeId, key, etag string) error {
+	st, err := s.Store(storeId)
+	if err != nil {
+		return err
+	}
+
+	if len(etag) == 0 {
+		return st.Delete(key)
+	}
+
+	sw, ok := st.(Swapper)
+	if !ok {
+		return ErrNotSwappable
+	}
+
+	old, err := s.match(st, key, etag)
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := sw.CompareAndDelete(key, old); err != nil {
+		return err
+	} else if !deleted {
+		return ErrEtagMismatch
+	}
+
+	return nil
+}
+
+// match returns the metadata of the record of the key if the etag
+// matches it. A record that does not exist matches no etag.
+func (s *State) match(st store.Store, key, etag string) (*Meta, error) {
+	sp, ok := st.(Stamper)
+	if !ok {
+		return nil, ErrNotSwappable
+	}
+
+	stamped, err := sp.ReadStamped([]string{key})
+	if err == ErrNoMetadata {
+		return nil, ErrNotSwappable
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(stamped) == 0 || !Matches(stamped[0].Record.Value, stamped[0].Meta, etag) {
+		return nil, ErrEtagMismatch
+	}
+
+	return stamped[0].Meta, nil
+}
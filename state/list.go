@@ -0,0 +1,132 @@
+package state
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+)
+
+// Pager is implemented by stores that can read the records whose keys
+// have a prefix in key order starting after a key. A limit of 0 means
+// no limit. Stores that are not pagers are paged by listing their keys.
+type Pager interface {
+	Page(prefix, after string, limit uint) ([]*store.Record, error)
+}
+
+// Page is a page of records in key order. NextCursor is empty when
+// there are no more records.
+type Page struct {
+	Records    []*store.Record
+	NextCursor string
+}
+
+// List returns the page of records of the store whose keys have the
+// prefix and that come after the cursor. A limit of 0 means no limit.
+// When updatedSince is not zero, only the records that were updated at
+// or after it are listed, which needs a stamper or else fails with
+// ErrNoMetadata.
+func (s *State) List(storeId, prefix, cursor string, updatedSince time.Time, limit uint) (*Page, error) {
+	st, err := s.Store(storeId)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []*store.Record
+
+	// read one more than the limit to tell whether there is a next page
+	more := limit
+	if limit > 0 {
+		more++
+	}
+
+	if !updatedSince.IsZero() {
+		sp, ok := st.(Stamper)
+		if !ok {
+			return nil, ErrNoMetadata
+		}
+
+		recs, err = since(st, sp, prefix, after, updatedSince, more)
+	} else {
+		recs, err = ReadPage(st, prefix, after, more)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	pg := &Page{
+		Records: recs,
+	}
+
+	if limit > 0 && uint(len(recs)) > limit {
+		pg.Records = recs[:limit]
+		pg.NextCursor = encodeCursor(pg.Records[limit-1].Key)
+	}
+
+	return pg, nil
+}
+
+// ReadPage reads the records of the store whose keys have the prefix in
+// key order starting after a key, from the store when it is a pager
+func ReadPage(st store.Store, prefix, after string, limit uint) ([]*store.Record, error) {
+	if p, ok := st.(Pager); ok {
+		return p.Page(prefix, after, limit)
+	}
+
+	return page(st, prefix, after, limit)
+}
+
+func page(st store.Store, prefix, after string, limit uint) ([]*store.Record, error) {
+	keys, err := st.List(store.ListWithPrefix(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	// not every store filters or orders what it lists
+	sort.Strings(keys)
+
+	recs := []*store.Record{}
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || (len(after) > 0 && key <= after) {
+			continue
+		}
+
+		rs, err := st.Read(key)
+		if err == store.ErrRecordNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		recs = append(recs, rs...)
+
+		if limit > 0 && uint(len(recs)) >= limit {
+			break
+		}
+	}
+
+	return recs, nil
+}
+
+// cursors are opaque to clients; they encode the last key of a page
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+
+	return string(bs), nil
+}
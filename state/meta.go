@@ -0,0 +1,146 @@
+package state
+
+import (
+	"errors"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+)
+
+const (
+	sinceBatchSize = 100
+)
+
+var (
+	ErrNoMetadata = errors.New("store does not keep the metadata of its records")
+)
+
+// Meta tells when a record was created and last updated and what its
+// version is. The version is the revision of the store at the last
+// write of the record, so it grows with every write of the record, also
+// after the record was deleted or expired, but not one at a time since
+// the writes of every other record of the store grow it too. dynamodb
+// has no revision, so its version counts the writes of the record
+// since it was created instead.
+type Meta struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Version   uint64
+}
+
+// Stamped is a record with its metadata. The metadata is nil when the
+// store does not keep it or did not when the record was written.
+type Stamped struct {
+	Record *store.Record
+	Meta   *Meta
+}
+
+// Stamper is implemented by stores that keep the metadata of their
+// records. They stamp every write and read each record together with
+// its metadata, skipping the keys that have no unexpired record. A
+// store that wraps another may fail with ErrNoMetadata when the store
+// that it wraps is not a stamper. Stores that are not stampers, such as
+// pluggable components, have records without metadata and cannot be
+// listed since a time.
+type Stamper interface {
+	ReadStamped(keys []string) ([]*Stamped, error)
+}
+
+// SincePager is implemented by stampers that can read the records whose
+// keys have a prefix and that were updated at or after a time in key
+// order starting after a key, so that the time is checked by the store
+// rather than by reading the metadata of every record. A limit of 0
+// means no limit.
+type SincePager interface {
+	PageSince(prefix, after string, updatedSince time.Time, limit uint) ([]*store.Record, error)
+}
+
+// Stamp returns the records with their metadata. The records of a
+// stamper are read again with their metadata so that the two always
+// agree, which drops the records that were deleted since they were
+// read. The records of other stores are returned without metadata.
+func (s *State) Stamp(storeId string, recs []*store.Record) ([]*Stamped, error) {
+	st, err := s.Store(storeId)
+	if err != nil {
+		return nil, err
+	}
+
+	sp, ok := st.(Stamper)
+	if !ok || len(recs) == 0 {
+		return unstamped(recs), nil
+	}
+
+	keys := []string{}
+
+	for _, rec := range recs {
+		keys = append(keys, rec.Key)
+	}
+
+	stamped, err := sp.ReadStamped(keys)
+	if err == ErrNoMetadata {
+		return unstamped(recs), nil
+	}
+
+	return stamped, err
+}
+
+func unstamped(recs []*store.Record) []*Stamped {
+	stamped := []*Stamped{}
+
+	for _, rec := range recs {
+		stamped = append(stamped, &Stamped{Record: rec})
+	}
+
+	return stamped
+}
+
+// since reads the records of the stamper whose keys have the prefix and
+// come after the key and that were updated at or after the time, from
+// the store when it is a since pager
+func since(st store.Store, sp Stamper, prefix, after string, updatedSince time.Time, limit uint) ([]*store.Record, error) {
+	if p, ok := st.(SincePager); ok {
+		return p.PageSince(prefix, after, updatedSince, limit)
+	}
+
+	recs := []*store.Record{}
+
+	for {
+		batch, err := ReadPage(st, prefix, after, sinceBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(batch) == 0 {
+			return recs, nil
+		}
+
+		after = batch[len(batch)-1].Key
+
+		keys := []string{}
+
+		for _, rec := range batch {
+			keys = append(keys, rec.Key)
+		}
+
+		stamped, err := sp.ReadStamped(keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, stamp := range stamped {
+			if stamp.Meta == nil || stamp.Meta.UpdatedAt.Before(updatedSince) {
+				continue
+			}
+
+			recs = append(recs, stamp.Record)
+
+			if limit > 0 && uint(len(recs)) >= limit {
+				return recs, nil
+			}
+		}
+
+		if len(batch) < sinceBatchSize {
+			return recs, nil
+		}
+	}
+}
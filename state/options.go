@@ -0,0 +1,49 @@
+package state
+
+const (
+	defaultBulkParallelism = 10
+	defaultQueryScanLimit  = 10000
+)
+
+type StateOption func(o *StateOptions)
+
+type StateOptions struct {
+	// the most reads or deletes of one bulk call that run at once
+	BulkParallelism int
+	// the most records that a query reads from a store that cannot
+	// evaluate queries itself
+	QueryScanLimit int
+}
+
+func StateWithBulkParallelism(n int) StateOption {
+	return func(o *StateOptions) {
+		o.BulkParallelism = n
+	}
+}
+
+func StateWithQueryScanLimit(n int) StateOption {
+	return func(o *StateOptions) {
+		o.QueryScanLimit = n
+	}
+}
+
+func NewStateOptions(opts ...StateOption) StateOptions {
+	options := StateOptions{
+		BulkParallelism: defaultBulkParallelism,
+		QueryScanLimit:  defaultQueryScanLimit,
+	}
+
+	for _, fn := range opts {
+		fn(&options)
+	}
+
+	if options.BulkParallelism < 1 {
+		options.BulkParallelism = 1
+	}
+
+	if options.QueryScanLimit < 1 {
+		options.QueryScanLimit = defaultQueryScanLimit
+	}
+
+	return options
+}
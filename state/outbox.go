@@ -0,0 +1,219 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/w-h-a/pkg/sidecar"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+const (
+	relayBatchSize = 100
+	// how long a relay holds the events that it claims
+	relayLease = 30 * time.Second
+	// how many times an event is published before it fails
+	relayMaxAttempts = 5
+)
+
+var (
+	ErrNoOutbox     = errors.New("store does not keep an outbox")
+	ErrInvalidEvent = errors.New("event is invalid")
+)
+
+// Event is an event that a transaction puts in the outbox of its store.
+// It is published to the producer of its name once the transaction
+// applies, and its id orders it among the events of its store.
+type Event struct {
+	Id        uint64
+	EventName string
+	Payload   []byte
+}
+
+// Outboxer is implemented by stores that can keep an outbox of events
+// beside their records. Once its outbox is opened, a store writes the
+// events of a transaction to the outbox in the same transaction as the
+// operations, so that the events are kept exactly when the operations
+// apply. A store whose outbox is not open fails with ErrNoOutbox.
+//
+// Relays claim the events that they publish, so that the sidecars that
+// share a store do not publish the same events. An event that is
+// published too many times without success fails and is kept in the
+// outbox without being relayed again.
+type Outboxer interface {
+	OpenOutbox() error
+	TransactWithEvents(ops []Operation, events []*Event) error
+	// Claim reads the events that are neither sent nor failed in the
+	// order that they were written and holds them for the lease. It
+	// claims nothing while the events of another claim are held.
+	Claim(limit uint, lease time.Duration) ([]*Event, error)
+	MarkSent(ids []uint64) error
+	// MarkFailed counts a failed publish of the event and releases it.
+	// The event fails once it has been published maxAttempts times.
+	MarkFailed(id uint64, maxAttempts uint) error
+	// Release releases the claimed events that were not published
+	Release(ids []uint64) error
+}
+
+// TransactWithEvents applies the operations to the store atomically
+// together with writing the events to the outbox of the store. Without
+// events, it is a transaction like any other.
+func (s *State) TransactWithEvents(storeId string, ops []Operation, events []*Event) error {
+	if len(events) == 0 {
+		return s.Transact(storeId, ops)
+	}
+
+	st, err := s.Store(storeId)
+	if err != nil {
+		return err
+	}
+
+	ob, ok := st.(Outboxer)
+	if !ok {
+		return ErrNoOutbox
+	}
+
+	for _, ev := range events {
+		if err := s.validateEvent(ev); err != nil {
+			return err
+		}
+	}
+
+	return ob.TransactWithEvents(ops, events)
+}
+
+// validateEvent checks the event the way that a publish is checked, so
+// that an event that is in the outbox can always be published
+func (s *State) validateEvent(ev *Event) error {
+	if len(ev.EventName) == 0 {
+		return fmt.Errorf("%w: an event name as topic is required", ErrInvalidEvent)
+	}
+
+	payload := map[string]interface{}{}
+
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("%w: expected the payload of event %s to be a json object", ErrInvalidEvent, ev.EventName)
+	}
+
+	if _, ok := s.service.Options().Brokers[ev.EventName]; !ok {
+		return fmt.Errorf("%w: there is no producer %s", ErrInvalidEvent, ev.EventName)
+	}
+
+	return nil
+}
+
+// Relay publishes the pending events of the outbox of every store and
+// marks them sent. The events of a store are published in order and a
+// failed publish leaves it and the events after it for the next relay,
+// until the event fails and the events after it are published. An event
+// is marked sent after it is published, so an event may be published
+// again when the sidecar stops in between or its claim runs out.
+func (s *State) Relay() {
+	for storeId, st := range s.service.Options().Stores {
+		ob, ok := st.(Outboxer)
+		if !ok {
+			continue
+		}
+
+		n, err := s.relay(ob)
+		if err != nil {
+			log.Errorf("failed to relay the outbox of store %s: %v", storeId, err)
+		}
+
+		if n > 0 {
+			log.Infof("relayed %d events of the outbox of store %s", n, storeId)
+		}
+	}
+}
+
+// RelayEvery relays at every interval until done is closed
+func (s *State) RelayEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.Relay()
+		}
+	}
+}
+
+func (s *State) relay(ob Outboxer) (int, error) {
+	sent := 0
+
+	for {
+		events, err := ob.Claim(relayBatchSize, relayLease)
+		if err == ErrNoOutbox {
+			return sent, nil
+		} else if err != nil {
+			return sent, err
+		}
+
+		ids := []uint64{}
+
+		for i, ev := range events {
+			if err = s.publish(ev); err != nil {
+				// a payload that is not json never publishes
+				maxAttempts := uint(relayMaxAttempts)
+				if errors.Is(err, ErrInvalidEvent) {
+					maxAttempts = 1
+				}
+
+				if err := ob.MarkFailed(ev.Id, maxAttempts); err != nil {
+					log.Errorf("failed to mark event %d failed: %v", ev.Id, err)
+				}
+
+				rest := []uint64{}
+
+				for _, ev := range events[i+1:] {
+					rest = append(rest, ev.Id)
+				}
+
+				if err := ob.Release(rest); err != nil {
+					log.Errorf("failed to release %d events: %v", len(rest), err)
+				}
+
+				break
+			}
+
+			ids = append(ids, ev.Id)
+		}
+
+		if len(ids) > 0 {
+			if err := ob.MarkSent(ids); err != nil {
+				return sent, err
+			}
+
+			sent += len(ids)
+		}
+
+		if err != nil {
+			return sent, err
+		}
+
+		if len(events) < relayBatchSize {
+			return sent, nil
+		}
+	}
+}
+
+func (s *State) publish(ev *Event) error {
+	payload := map[string]interface{}{}
+
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("%w: expected the payload of event %d to be a json object", ErrInvalidEvent, ev.Id)
+	}
+
+	event := &sidecar.Event{
+		EventName: ev.EventName,
+		Payload:   payload,
+	}
+
+	return s.service.WriteEventToBroker(context.Background(), event)
+}
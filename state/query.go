@@ -0,0 +1,429 @@
+package state
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/w-h-a/pkg/store"
+)
+
+const (
+	FilterEq  = "EQ"
+	FilterIn  = "IN"
+	FilterAnd = "AND"
+	FilterOr  = "OR"
+)
+
+var (
+	ErrInvalidQuery  = errors.New("query is invalid")
+	ErrQueryTooLarge = errors.New("store has more records than can be queried without a querier")
+)
+
+// Filter matches the records whose values are json. EQ matches when
+// the value at the path is the one value, IN when it is one of the
+// values, AND when every filter matches, and OR when one does. A path
+// is a dot separated list of object fields and array indexes.
+type Filter struct {
+	Op      string
+	Path    string
+	Values  []interface{}
+	Filters []*Filter
+}
+
+// Sort orders the records by the value at the path. Records without
+// a value at the path come first in ascending order.
+type Sort struct {
+	Path       string
+	Descending bool
+}
+
+// Query is what a querier is asked for. Records are ordered by the
+// sorts and then by key, and a limit of 0 means no limit.
+type Query struct {
+	Filter *Filter
+	Sort   []Sort
+	Limit  uint
+	Offset uint
+}
+
+// Querier is implemented by stores that can evaluate a query in the
+// backend. The records of other stores are read and evaluated here,
+// which fails with ErrQueryTooLarge once a store holds more records
+// than the query scan limit.
+type Querier interface {
+	Query(q *Query) ([]*store.Record, error)
+}
+
+// Query returns the page of records of the store that match the filter
+// in the order of the sorts, starting at the cursor. A nil filter
+// matches every record whose value is json. A cursor counts the
+// records that came before its page, so records that are written or
+// deleted between pages may move other records onto a page that was
+// already read or past the cursor; cursors are not stable snapshots.
+func (s *State) Query(storeId string, filter *Filter, sorts []Sort, cursor string, limit uint) (*Page, error) {
+	st, err := s.Store(storeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	for _, srt := range sorts {
+		if len(srt.Path) == 0 {
+			return nil, fmt.Errorf("%w: expected sort to have a path", ErrInvalidQuery)
+		}
+	}
+
+	offset, err := decodeOffset(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	// read one more than the limit to tell whether there is a next page
+	more := limit
+	if limit > 0 {
+		more++
+	}
+
+	q := &Query{
+		Filter: filter.normalize(),
+		Sort:   sorts,
+		Limit:  more,
+		Offset: offset,
+	}
+
+	var recs []*store.Record
+
+	if qr, ok := st.(Querier); ok {
+		recs, err = qr.Query(q)
+	} else {
+		recs, err = query(st, q, uint(s.options.QueryScanLimit))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	pg := &Page{
+		Records: recs,
+	}
+
+	if limit > 0 && uint(len(recs)) > limit {
+		pg.Records = recs[:limit]
+		pg.NextCursor = encodeOffset(offset + limit)
+	}
+
+	return pg, nil
+}
+
+// Validate tells what is wrong with the filter, if anything
+func (f *Filter) Validate() error {
+	if f == nil {
+		return nil
+	}
+
+	switch f.Op {
+	case FilterEq, FilterIn:
+		if len(f.Path) == 0 {
+			return fmt.Errorf("%w: expected %s to have a path", ErrInvalidQuery, f.Op)
+		}
+
+		if f.Op == FilterEq && len(f.Values) != 1 {
+			return fmt.Errorf("%w: expected EQ of %s to have one value", ErrInvalidQuery, f.Path)
+		}
+
+		if f.Op == FilterIn && len(f.Values) == 0 {
+			return fmt.Errorf("%w: expected IN of %s to have values", ErrInvalidQuery, f.Path)
+		}
+	case FilterAnd, FilterOr:
+		if len(f.Filters) == 0 {
+			return fmt.Errorf("%w: expected %s to have filters", ErrInvalidQuery, f.Op)
+		}
+
+		for _, sub := range f.Filters {
+			if sub == nil {
+				return fmt.Errorf("%w: expected %s to have no empty filters", ErrInvalidQuery, f.Op)
+			}
+
+			if err := sub.Validate(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: expected filter to be one of EQ, IN, AND, or OR but got %q", ErrInvalidQuery, f.Op)
+	}
+
+	return nil
+}
+
+// match tells whether the filter matches the decoded json document
+func (f *Filter) match(doc interface{}) bool {
+	if f == nil {
+		return true
+	}
+
+	switch f.Op {
+	case FilterEq, FilterIn:
+		v, ok := lookup(doc, f.Path)
+		if !ok {
+			return false
+		}
+
+		for _, value := range f.Values {
+			if reflect.DeepEqual(v, value) {
+				return true
+			}
+		}
+
+		return false
+	case FilterAnd:
+		for _, sub := range f.Filters {
+			if !sub.match(doc) {
+				return false
+			}
+		}
+
+		return true
+	case FilterOr:
+		for _, sub := range f.Filters {
+			if sub.match(doc) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// normalize copies the filter with its values as decoded json so that
+// they compare equal to the values of the documents
+func (f *Filter) normalize() *Filter {
+	if f == nil {
+		return nil
+	}
+
+	n := &Filter{
+		Op:   f.Op,
+		Path: f.Path,
+	}
+
+	for _, value := range f.Values {
+		var v interface{}
+
+		bs, err := json.Marshal(value)
+		if err == nil && json.Unmarshal(bs, &v) == nil {
+			value = v
+		}
+
+		n.Values = append(n.Values, value)
+	}
+
+	for _, sub := range f.Filters {
+		n.Filters = append(n.Filters, sub.normalize())
+	}
+
+	return n
+}
+
+// lookup returns the value at the path of the decoded json document
+func lookup(doc interface{}, path string) (interface{}, bool) {
+	v := doc
+
+	for _, field := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[field]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// query reads every record of the store and evaluates the query. It
+// reads at most one more record than the scan limit to tell whether
+// the store holds too many.
+func query(st store.Store, q *Query, scanLimit uint) ([]*store.Record, error) {
+	recs, err := ReadPage(st, "", "", scanLimit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint(len(recs)) > scanLimit {
+		return nil, ErrQueryTooLarge
+	}
+
+	type hit struct {
+		record *store.Record
+		doc    interface{}
+	}
+
+	matches := []hit{}
+
+	for _, rec := range recs {
+		// only values that are stored as json are queried, the way
+		// that stores which evaluate queries do
+		v := Decode(rec.Value)
+
+		if v.ContentType != ContentTypeJSON {
+			continue
+		}
+
+		var doc interface{}
+
+		if err := json.Unmarshal(v.Data, &doc); err != nil {
+			continue
+		}
+
+		if q.Filter.match(doc) {
+			matches = append(matches, hit{rec, doc})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		for _, srt := range q.Sort {
+			a, aok := lookup(matches[i].doc, srt.Path)
+			b, bok := lookup(matches[j].doc, srt.Path)
+
+			c := compare(a, aok, b, bok)
+			if c == 0 {
+				continue
+			}
+
+			if srt.Descending {
+				return c > 0
+			}
+
+			return c < 0
+		}
+
+		return matches[i].record.Key < matches[j].record.Key
+	})
+
+	if q.Offset >= uint(len(matches)) {
+		return []*store.Record{}, nil
+	}
+
+	matches = matches[q.Offset:]
+
+	if q.Limit > 0 && q.Limit < uint(len(matches)) {
+		matches = matches[:q.Limit]
+	}
+
+	results := []*store.Record{}
+
+	for _, m := range matches {
+		results = append(results, m.record)
+	}
+
+	return results, nil
+}
+
+// compare orders json values the way jsonb does, where null comes
+// before strings, then numbers, booleans, arrays, and objects, and a
+// missing value comes before everything
+func compare(a interface{}, aok bool, b interface{}, bok bool) int {
+	if !aok || !bok {
+		return boolRank(aok) - boolRank(bok)
+	}
+
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+
+	switch x := a.(type) {
+	case string:
+		return strings.Compare(x, b.(string))
+	case float64:
+		y := b.(float64)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	case bool:
+		return boolRank(x) - boolRank(b.(bool))
+	case []interface{}:
+		y := b.([]interface{})
+		if len(x) != len(y) {
+			return len(x) - len(y)
+		}
+		for i := range x {
+			if c := compare(x[i], true, y[i], true); c != 0 {
+				return c
+			}
+		}
+	case map[string]interface{}:
+		// objects are only ordered by how many fields they have
+		return len(x) - len(b.(map[string]interface{}))
+	}
+
+	return 0
+}
+
+func rank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case string:
+		return 1
+	case float64:
+		return 2
+	case bool:
+		return 3
+	case []interface{}:
+		return 4
+	default:
+		return 5
+	}
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// the cursors of a query encode how many records came before its page
+func encodeOffset(offset uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(offset), 10)))
+}
+
+func decodeOffset(cursor string) (uint, error) {
+	if len(cursor) == 0 {
+		return 0, nil
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+
+	offset, err := strconv.ParseUint(string(bs), 10, 32)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+
+	return uint(offset), nil
+}
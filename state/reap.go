@@ -0,0 +1,49 @@
+package state
+
+import (
+	"time"
+
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+// Reaper is implemented by stores that can delete all of their expired
+// records at once. Stores that are not reapers delete expired records
+// as they come across them or leave it to the backend.
+type Reaper interface {
+	Reap() (int, error)
+}
+
+// Reap deletes the expired records of every store that is a reaper
+func (s *State) Reap() {
+	for storeId, st := range s.service.Options().Stores {
+		r, ok := st.(Reaper)
+		if !ok {
+			continue
+		}
+
+		n, err := r.Reap()
+		if err != nil {
+			log.Errorf("failed to reap expired records of store %s: %v", storeId, err)
+			continue
+		}
+
+		if n > 0 {
+			log.Infof("reaped %d expired records of store %s", n, storeId)
+		}
+	}
+}
+
+// ReapEvery reaps at every interval until done is closed
+func (s *State) ReapEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.Reap()
+		}
+	}
+}
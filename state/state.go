@@ -0,0 +1,44 @@
+// Package state offers the parts of the state api that the sidecar
+// interface does not, such as paging through the records of a store.
+package state
+
+import (
+	"errors"
+
+	"github.com/w-h-a/pkg/sidecar"
+	"github.com/w-h-a/pkg/store"
+)
+
+var (
+	ErrInvalidCursor = errors.New("cursor is invalid")
+)
+
+// State reaches the stores of the sidecar that it wraps so that it
+// always sees the stores of the most recently loaded components
+type State struct {
+	options StateOptions
+	service sidecar.Sidecar
+}
+
+func (s *State) Options() StateOptions {
+	return s.options
+}
+
+// Store returns the store with the id or sidecar.ErrComponentNotFound
+func (s *State) Store(storeId string) (store.Store, error) {
+	st, ok := s.service.Options().Stores[storeId]
+	if !ok {
+		return nil, sidecar.ErrComponentNotFound
+	}
+
+	return st, nil
+}
+
+func NewState(s sidecar.Sidecar, opts ...StateOption) *State {
+	options := NewStateOptions(opts...)
+
+	return &State{
+		options: options,
+		service: s,
+	}
+}
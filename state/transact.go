@@ -0,0 +1,67 @@
+package state
+
+import (
+	"errors"
+
+	"github.com/w-h-a/pkg/store"
+)
+
+var (
+	ErrNotTransactional = errors.New("store cannot apply operations atomically")
+)
+
+// Operation is one upsert or delete of a transaction. A delete only
+// needs the key of its record. When the etag is not empty, the record
+// in the store must have it for the transaction to apply.
+type Operation struct {
+	Delete bool
+	Record *store.Record
+	Etag   string
+}
+
+// Transactor is implemented by stores that can apply many operations
+// atomically. The operations are applied in order and their etags are
+// checked within the transaction, so that one that does not match
+// fails the transaction with ErrEtagMismatch and nothing is applied.
+type Transactor interface {
+	Transact(ops []Operation) error
+}
+
+// Transact applies the operations to the store atomically or returns
+// ErrNotTransactional when the store cannot
+func (s *State) Transact(storeId string, ops []Operation) error {
+	st, err := s.Store(storeId)
+	if err != nil {
+		return err
+	}
+
+	t, ok := st.(Transactor)
+	if !ok {
+		return ErrNotTransactional
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	return t.Transact(ops)
+}
+
+// WriteAll writes the records of the upserts to the store atomically
+// when the store is a Transactor. The records of other stores, and of
+// stores that wrap one that is not, are written one by one in order,
+// where the first that fails stops the rest and those before it stay
+// written.
+func (s *State) WriteAll(storeId string, ops []Operation) error {
+	if err := s.Transact(storeId, ops); err != ErrNotTransactional {
+		return err
+	}
+
+	for _, op := range ops {
+		if err := s.Write(storeId, op.Record, op.Etag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	ContentTypeJSON = "application/json"
+
+	// values that the sidecar keeps something beside are stored in an
+	// envelope, which is json that starts with this field
+	EnvelopePrefix = `{"$sidecar":`
+)
+
+var (
+	ErrInvalidJSON   = errors.New("value of a json content type is not json")
+	ErrReservedField = errors.New(`value cannot start with the field "$sidecar", which the sidecar reserves`)
+)
+
+// Value is a value of state with its content type
+type Value struct {
+	Data        []byte
+	ContentType string
+}
+
+type envelope struct {
+	Meta envelopeMeta    `json:"$sidecar"`
+	JSON json.RawMessage `json:"json,omitempty"`
+	Data []byte          `json:"data,omitempty"`
+}
+
+type envelopeMeta struct {
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// Encode returns the bytes that store the value. Json without a content
+// type or with the json content type is stored as it is, as are bytes
+// without a content type, so that they stay readable by the sidecar
+// interface and queryable. Everything else is stored in an envelope.
+// A value of a json content type that is not json is not stored and
+// ErrInvalidJSON is returned instead, and a value that is stored as it
+// is and would be read as an envelope returns ErrReservedField.
+func Encode(v *Value) ([]byte, error) {
+	if IsJSON(v.ContentType) && !json.Valid(v.Data) {
+		return nil, ErrInvalidJSON
+	}
+
+	if len(v.ContentType) == 0 || v.ContentType == ContentTypeJSON {
+		if bytes.HasPrefix(v.Data, []byte(EnvelopePrefix)) {
+			return nil, ErrReservedField
+		}
+
+		return v.Data, nil
+	}
+
+	env := &envelope{
+		Meta: envelopeMeta{
+			ContentType: v.ContentType,
+		},
+	}
+
+	if IsJSON(v.ContentType) {
+		env.JSON = v.Data
+	} else {
+		env.Data = v.Data
+	}
+
+	return json.Marshal(env)
+}
+
+// Decode returns the value that the bytes store. The content type of a
+// value that was stored as it is is json when it is json and otherwise
+// sniffed from the bytes.
+func Decode(bs []byte) *Value {
+	if bytes.HasPrefix(bs, []byte(EnvelopePrefix)) {
+		env := &envelope{}
+
+		if err := json.Unmarshal(bs, env); err == nil {
+			v := &Value{
+				Data:        env.Data,
+				ContentType: env.Meta.ContentType,
+			}
+
+			if env.JSON != nil {
+				v.Data = env.JSON
+			}
+
+			return v
+		}
+	}
+
+	if json.Valid(bs) {
+		return &Value{Data: bs, ContentType: ContentTypeJSON}
+	}
+
+	return &Value{Data: bs, ContentType: http.DetectContentType(bs)}
+}
+
+// IsJSON tells whether the content type is json or a json suffixed type
+func IsJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == ContentTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// IsText tells whether the content type is text
+func IsText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/")
+}
@@ -0,0 +1,860 @@
+// Package cockroach wraps the cockroach store of pkg, which creates the
+// table and reads, lists, and deletes its records. Over a connection
+// pool of its own to the same database, since pkg does not share its
+// pool, it writes records with their metadata, reads pages of records
+// in key order so that listing a large table does not scan it, pushes
+// queries over json values down to cockroach as jsonb, swaps records,
+// applies transactions, reaps expired records, and keeps an outbox of
+// events in the table of its table name suffixed by _outbox.
+package cockroach
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/store/cockroach"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/state"
+)
+
+const (
+	maxTransactRetries = 5
+
+	outboxSuffix = "_outbox"
+
+	// the sequence of a table whose next value is the
+	// version of the record that is written
+	revisionSuffix = "_revision"
+
+	// the value of a record as jsonb or null when it is not json, which
+	// is kept beside the value because a cast of it would fail instead
+	document = "(CASE WHEN is_json THEN convert_from(value, 'UTF8')::JSONB END)"
+
+	// the number of records whose json is marked at once when a
+	// table from before the json was kept is opened
+	markBatchSize = 100
+)
+
+var (
+	likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+)
+
+type cockroachStore struct {
+	// the store of pkg, which reads, lists, and deletes records
+	store.Store
+	client    *sql.DB
+	write     *sql.Stmt
+	readMeta  *sql.Stmt
+	page      *sql.Stmt
+	pageSince *sql.Stmt
+	swap      *sql.Stmt
+	cad       *sql.Stmt
+	lock      *sql.Stmt
+	reap      *sql.Stmt
+	// deletes within transactions, which the store of pkg cannot join
+	delete *sql.Stmt
+	// the outbox is nil until it is opened
+	outbox    *outbox
+	outboxMtx sync.RWMutex
+}
+
+type outbox struct {
+	insert     *sql.Stmt
+	claim      *sql.Stmt
+	markSent   *sql.Stmt
+	markFailed *sql.Stmt
+	release    *sql.Stmt
+	reap       *sql.Stmt
+}
+
+// Write writes the record with its metadata, which the store of pkg
+// does not keep
+func (s *cockroachStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	var expiry interface{}
+
+	if rec.Expiry != 0 {
+		expiry = time.Now().Add(rec.Expiry)
+	}
+
+	_, err := s.write.Exec(rec.Key, rec.Value, expiry, json.Valid(rec.Value))
+
+	return err
+}
+
+func (s *cockroachStore) Page(prefix, after string, limit uint) ([]*store.Record, error) {
+	l := int64(math.MaxInt64)
+
+	if limit > 0 {
+		l = int64(limit)
+	}
+
+	rows, err := s.page.Query(likeEscaper.Replace(prefix)+"%", after, l)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*store.Record{}
+
+	var timehelper pq.NullTime
+
+	for rows.Next() {
+		record := &store.Record{}
+
+		if err := rows.Scan(&record.Key, &record.Value, &timehelper); err != nil {
+			return records, err
+		}
+
+		if timehelper.Valid {
+			if timehelper.Time.Before(time.Now()) {
+				go s.Delete(record.Key)
+				continue
+			}
+			record.Expiry = time.Until(timehelper.Time)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// PageSince reads a page of the records that were updated at or after
+// the time
+func (s *cockroachStore) PageSince(prefix, after string, updatedSince time.Time, limit uint) ([]*store.Record, error) {
+	l := int64(math.MaxInt64)
+
+	if limit > 0 {
+		l = int64(limit)
+	}
+
+	rows, err := s.pageSince.Query(likeEscaper.Replace(prefix)+"%", after, updatedSince, l)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*store.Record{}
+
+	var timehelper pq.NullTime
+
+	for rows.Next() {
+		record := &store.Record{}
+
+		if err := rows.Scan(&record.Key, &record.Value, &timehelper); err != nil {
+			return records, err
+		}
+
+		if timehelper.Valid {
+			record.Expiry = time.Until(timehelper.Time)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (s *cockroachStore) CompareAndSwap(rec *store.Record, old *state.Meta) (bool, error) {
+	var expiry interface{}
+
+	if rec.Expiry != 0 {
+		expiry = time.Now().Add(rec.Expiry)
+	}
+
+	res, err := s.swap.Exec(rec.Key, rec.Value, expiry, version(old), json.Valid(rec.Value))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return n == 1, err
+}
+
+func (s *cockroachStore) CompareAndDelete(key string, old *state.Meta) (bool, error) {
+	res, err := s.cad.Exec(key, version(old))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return n == 1, err
+}
+
+// Transact applies the operations in one transaction. Cockroach may
+// abort a transaction that conflicts with another and ask for it to
+// be retried, which is done a few times before giving up.
+func (s *cockroachStore) Transact(ops []state.Operation) error {
+	return s.retry(ops, nil)
+}
+
+func (s *cockroachStore) OpenOutbox() error {
+	s.outboxMtx.Lock()
+	defer s.outboxMtx.Unlock()
+
+	if s.outbox != nil {
+		return nil
+	}
+
+	table := fmt.Sprintf("%s.%s", s.Options().Database, s.Options().Table+outboxSuffix)
+
+	if _, err := s.client.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+	(
+		id int8 NOT NULL DEFAULT unique_rowid(),
+		event_name text NOT NULL,
+		payload bytea,
+		created_at timestamp with time zone,
+		sent_at timestamp with time zone,
+		claimed_until timestamp with time zone,
+		attempts int8 NOT NULL DEFAULT 0,
+		failed_at timestamp with time zone,
+		CONSTRAINT %s_pkey PRIMARY KEY (id)
+	);`, table, s.Options().Table+outboxSuffix)); err != nil {
+		return err
+	}
+
+	// outboxes that were created before events were claimed get the columns
+	if _, err := s.client.Exec(fmt.Sprintf(`ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS claimed_until timestamp with time zone,
+		ADD COLUMN IF NOT EXISTS attempts int8 NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS failed_at timestamp with time zone;`, table)); err != nil {
+		return err
+	}
+
+	ob := &outbox{}
+
+	var err error
+
+	if ob.insert, err = s.client.Prepare(fmt.Sprintf("INSERT INTO %s(event_name, payload, created_at) VALUES ($1, $2::bytea, now());", table)); err != nil {
+		return err
+	}
+
+	// one statement claims the events so that the sidecars that share the
+	// table conflict instead of claiming the same events
+	if ob.claim, err = s.client.Prepare(fmt.Sprintf(`UPDATE %s SET claimed_until = now() + ($1::INT8 * INTERVAL '1 millisecond')
+		WHERE id IN (SELECT id FROM %s WHERE sent_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT $2)
+		AND NOT EXISTS (SELECT 1 FROM %s WHERE sent_at IS NULL AND failed_at IS NULL AND claimed_until > now())
+		RETURNING id, event_name, payload;`, table, table, table)); err != nil {
+		return err
+	}
+
+	if ob.markSent, err = s.client.Prepare(fmt.Sprintf("UPDATE %s SET sent_at = now() WHERE id = ANY($1::INT8[]) AND sent_at IS NULL;", table)); err != nil {
+		return err
+	}
+
+	if ob.markFailed, err = s.client.Prepare(fmt.Sprintf(`UPDATE %s SET claimed_until = NULL, attempts = attempts + 1,
+		failed_at = CASE WHEN attempts + 1 >= $2 THEN now() END
+		WHERE id = $1 AND sent_at IS NULL AND failed_at IS NULL;`, table)); err != nil {
+		return err
+	}
+
+	if ob.release, err = s.client.Prepare(fmt.Sprintf("UPDATE %s SET claimed_until = NULL WHERE id = ANY($1::INT8[]);", table)); err != nil {
+		return err
+	}
+
+	if ob.reap, err = s.client.Prepare(fmt.Sprintf("DELETE FROM %s WHERE sent_at IS NOT NULL;", table)); err != nil {
+		return err
+	}
+
+	s.outbox = ob
+
+	return nil
+}
+
+// TransactWithEvents applies the operations like Transact and inserts
+// the events into the outbox in the same transaction. The ids of the
+// events only roughly follow the order that they were written in.
+func (s *cockroachStore) TransactWithEvents(ops []state.Operation, events []*state.Event) error {
+	if s.getOutbox() == nil {
+		return state.ErrNoOutbox
+	}
+
+	return s.retry(ops, events)
+}
+
+// Claim reads the events of the outbox that are neither sent nor failed
+// and holds them for the lease
+func (s *cockroachStore) Claim(limit uint, lease time.Duration) ([]*state.Event, error) {
+	ob := s.getOutbox()
+	if ob == nil {
+		return nil, state.ErrNoOutbox
+	}
+
+	l := int64(math.MaxInt64)
+
+	if limit > 0 {
+		l = int64(limit)
+	}
+
+	rows, err := ob.claim.Query(lease.Milliseconds(), l)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*state.Event{}
+
+	for rows.Next() {
+		var id int64
+
+		ev := &state.Event{}
+
+		if err := rows.Scan(&id, &ev.EventName, &ev.Payload); err != nil {
+			return nil, err
+		}
+
+		ev.Id = uint64(id)
+
+		events = append(events, ev)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the rows that are returned are not in any order
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id < events[j].Id
+	})
+
+	return events, nil
+}
+
+func (s *cockroachStore) MarkSent(ids []uint64) error {
+	ob := s.getOutbox()
+	if ob == nil {
+		return state.ErrNoOutbox
+	}
+
+	arr := pq.Int64Array{}
+
+	for _, id := range ids {
+		arr = append(arr, int64(id))
+	}
+
+	_, err := ob.markSent.Exec(arr)
+
+	return err
+}
+
+func (s *cockroachStore) MarkFailed(id uint64, maxAttempts uint) error {
+	ob := s.getOutbox()
+	if ob == nil {
+		return state.ErrNoOutbox
+	}
+
+	_, err := ob.markFailed.Exec(int64(id), int64(maxAttempts))
+
+	return err
+}
+
+func (s *cockroachStore) Release(ids []uint64) error {
+	ob := s.getOutbox()
+	if ob == nil {
+		return state.ErrNoOutbox
+	}
+
+	arr := pq.Int64Array{}
+
+	for _, id := range ids {
+		arr = append(arr, int64(id))
+	}
+
+	_, err := ob.release.Exec(arr)
+
+	return err
+}
+
+func (s *cockroachStore) getOutbox() *outbox {
+	s.outboxMtx.RLock()
+	defer s.outboxMtx.RUnlock()
+
+	return s.outbox
+}
+
+// retry runs the transaction until it applies, fails for good, or has
+// been retried too many times
+func (s *cockroachStore) retry(ops []state.Operation, events []*state.Event) error {
+	var err error
+
+	for i := 0; i < maxTransactRetries; i++ {
+		if err = s.transact(ops, events); !retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (s *cockroachStore) transact(ops []state.Operation, events []*state.Event) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, op := range ops {
+		key := op.Record.Key
+
+		if len(op.Etag) > 0 {
+			if ok, err := s.tagged(tx, key, op.Etag); err != nil {
+				return err
+			} else if !ok {
+				return state.ErrEtagMismatch
+			}
+		}
+
+		if op.Delete {
+			_, err = tx.Stmt(s.delete).Exec(key)
+		} else {
+			var expiry interface{}
+
+			if op.Record.Expiry != 0 {
+				expiry = time.Now().Add(op.Record.Expiry)
+			}
+
+			_, err = tx.Stmt(s.write).Exec(key, op.Record.Value, expiry, json.Valid(op.Record.Value))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(events) > 0 {
+		insert := tx.Stmt(s.getOutbox().insert)
+
+		for _, ev := range events {
+			if _, err := insert.Exec(ev.EventName, ev.Payload); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// tagged locks the record of the key for the rest of the transaction
+// and tells whether it is unexpired and has the etag
+func (s *cockroachStore) tagged(tx *sql.Tx, key, etag string) (bool, error) {
+	var value []byte
+
+	var expiry, createdAt pq.NullTime
+
+	var version sql.NullInt64
+
+	if err := tx.Stmt(s.lock).QueryRow(key).Scan(&value, &expiry, &createdAt, &version); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if expiry.Valid && expiry.Time.Before(time.Now()) {
+		return false, nil
+	}
+
+	var meta *state.Meta
+
+	// records that were written before there was metadata have none
+	if version.Valid {
+		meta = &state.Meta{
+			CreatedAt: createdAt.Time,
+			Version:   uint64(version.Int64),
+		}
+	}
+
+	return state.Matches(value, meta, etag), nil
+}
+
+// Query evaluates the query in cockroach by reading the values as
+// jsonb. Values that are not json are skipped as they are when the
+// query is evaluated in memory.
+func (s *cockroachStore) Query(q *state.Query) ([]*store.Record, error) {
+	// values in an envelope are json but not the json that was stored
+	args := []interface{}{[]byte(state.EnvelopePrefix)}
+
+	where := "(expiry IS NULL OR expiry > now()) AND is_json AND substring(value, 1, length($1::BYTES)) <> $1::BYTES"
+
+	if q.Filter != nil {
+		cond, err := condition(q.Filter, &args)
+		if err != nil {
+			return nil, err
+		}
+		where += " AND " + cond
+	}
+
+	order := []string{}
+
+	for _, srt := range q.Sort {
+		args = append(args, pq.Array(strings.Split(srt.Path, ".")))
+
+		o := fmt.Sprintf("(%s #> $%d::STRING[])", document, len(args))
+		if srt.Descending {
+			o += " DESC"
+		}
+
+		order = append(order, o)
+	}
+
+	order = append(order, "key")
+
+	l := int64(math.MaxInt64)
+
+	if q.Limit > 0 {
+		l = int64(q.Limit)
+	}
+
+	args = append(args, l, int64(q.Offset))
+
+	rows, err := s.client.Query(fmt.Sprintf(
+		"SELECT key, value, expiry FROM %s.%s WHERE %s ORDER BY %s LIMIT $%d OFFSET $%d;",
+		s.Options().Database, s.Options().Table, where, strings.Join(order, ", "), len(args)-1, len(args),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*store.Record{}
+
+	var timehelper pq.NullTime
+
+	for rows.Next() {
+		record := &store.Record{}
+
+		if err := rows.Scan(&record.Key, &record.Value, &timehelper); err != nil {
+			return records, err
+		}
+
+		if timehelper.Valid {
+			record.Expiry = time.Until(timehelper.Time)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// ReadStamped reads the unexpired records of the keys with their
+// metadata in one statement
+func (s *cockroachStore) ReadStamped(keys []string) ([]*state.Stamped, error) {
+	rows, err := s.readMeta.Query(pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byKey := map[string]*state.Stamped{}
+
+	for rows.Next() {
+		var expiry, createdAt, updatedAt pq.NullTime
+
+		var version sql.NullInt64
+
+		record := &store.Record{}
+
+		if err := rows.Scan(&record.Key, &record.Value, &expiry, &createdAt, &updatedAt, &version); err != nil {
+			return nil, err
+		}
+
+		if expiry.Valid {
+			if expiry.Time.Before(time.Now()) {
+				continue
+			}
+			record.Expiry = time.Until(expiry.Time)
+		}
+
+		stamp := &state.Stamped{
+			Record: record,
+		}
+
+		// records that were written before there was metadata have none
+		if version.Valid {
+			stamp.Meta = &state.Meta{
+				CreatedAt: createdAt.Time,
+				UpdatedAt: updatedAt.Time,
+				Version:   uint64(version.Int64),
+			}
+		}
+
+		byKey[record.Key] = stamp
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stamped := []*state.Stamped{}
+
+	for _, key := range keys {
+		if st, ok := byKey[key]; ok {
+			stamped = append(stamped, st)
+		}
+	}
+
+	return stamped, nil
+}
+
+// Reap deletes the expired records and returns how many there were.
+// The events of the outbox that were sent are deleted with them, while
+// the events that failed are kept.
+func (s *cockroachStore) Reap() (int, error) {
+	res, err := s.reap.Exec()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if ob := s.getOutbox(); ob != nil {
+		if _, err := ob.reap.Exec(); err != nil {
+			return int(n), err
+		}
+	}
+
+	return int(n), nil
+}
+
+// Close closes the connection pool of the store. The store of pkg
+// cannot be closed and keeps its pool.
+func (s *cockroachStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *cockroachStore) configure() error {
+	client, err := sql.Open("postgres", s.Options().Nodes[0])
+	if err != nil {
+		return err
+	}
+
+	if err := client.Ping(); err != nil {
+		return err
+	}
+
+	s.client = client
+
+	return s.initDB()
+}
+
+func (s *cockroachStore) initDB() error {
+	// the table that the store of pkg created gets the columns of the
+	// metadata and of whether the value is json
+	if _, err := s.client.Exec(fmt.Sprintf(`ALTER TABLE %s.%s
+		ADD COLUMN IF NOT EXISTS created_at timestamp with time zone,
+		ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone,
+		ADD COLUMN IF NOT EXISTS version int8,
+		ADD COLUMN IF NOT EXISTS is_json bool;`, s.Options().Database, s.Options().Table)); err != nil {
+		return err
+	}
+
+	if err := s.revise(); err != nil {
+		return err
+	}
+
+	revision := fmt.Sprintf("'%s.%s%s'", s.Options().Database, s.Options().Table, revisionSuffix)
+
+	// a record that replaces an unexpired record keeps when it was
+	// created and every record that is written is the next revision
+	write, err := s.client.Prepare(fmt.Sprintf(`INSERT INTO %s.%s AS r(key, value, expiry, created_at, updated_at, version, is_json)
+		VALUES ($1, $2::bytea, $3, now(), now(), nextval(%s), $4)
+		ON CONFLICT (key)
+		DO UPDATE
+		SET value = EXCLUDED.value, expiry = EXCLUDED.expiry, updated_at = EXCLUDED.updated_at, version = EXCLUDED.version, is_json = EXCLUDED.is_json,
+			created_at = CASE WHEN r.expiry IS NOT NULL AND r.expiry <= now() THEN EXCLUDED.created_at ELSE COALESCE(r.created_at, EXCLUDED.created_at) END;`, s.Options().Database, s.Options().Table, revision))
+	if err != nil {
+		return err
+	}
+	s.write = write
+
+	readMeta, err := s.client.Prepare(fmt.Sprintf("SELECT key, value, expiry, created_at, updated_at, version FROM %s.%s WHERE key = ANY($1::STRING[]);", s.Options().Database, s.Options().Table))
+	if err != nil {
+		return err
+	}
+	s.readMeta = readMeta
+
+	page, err := s.client.Prepare(fmt.Sprintf("SELECT key, value, expiry FROM %s.%s WHERE key LIKE $1 AND key > $2 ORDER BY key LIMIT $3;", s.Options().Database, s.Options().Table))
+	if err != nil {
+		return err
+	}
+	s.page = page
+
+	pageSince, err := s.client.Prepare(fmt.Sprintf("SELECT key, value, expiry FROM %s.%s WHERE key LIKE $1 AND key > $2 AND updated_at >= $3 AND (expiry IS NULL OR expiry > now()) ORDER BY key LIMIT $4;", s.Options().Database, s.Options().Table))
+	if err != nil {
+		return err
+	}
+	s.pageSince = pageSince
+
+	delete, err := s.client.Prepare(fmt.Sprintf("DELETE FROM %s.%s WHERE key = $1;", s.Options().Database, s.Options().Table))
+	if err != nil {
+		return err
+	}
+	s.delete = delete
+
+	swap, err := s.client.Prepare(fmt.Sprintf("UPDATE %s.%s SET value = $2::bytea, expiry = $3, updated_at = now(), created_at = COALESCE(created_at, now()), version = nextval(%s), is_json = $5 WHERE key = $1 AND version IS NOT DISTINCT FROM $4::INT8;", s.Options().Database, s.Options().Table, revision))
+	if err != nil {
+		return err
+	}
+	s.swap = swap
+
+	cad, err := s.client.Prepare(fmt.Sprintf("DELETE FROM %s.%s WHERE key = $1 AND version IS NOT DISTINCT FROM $2::INT8;", s.Options().Database, s.Options().Table))
+	if err != nil {
+		return err
+	}
+	s.cad = cad
+
+	lock, err := s.client.Prepare(fmt.Sprintf("SELECT value, expiry, created_at, version FROM %s.%s WHERE key = $1 FOR UPDATE;", s.Options().Database, s.Options().Table))
+	if err != nil {
+		return err
+	}
+	s.lock = lock
+
+	reap, err := s.client.Prepare(fmt.Sprintf("DELETE FROM %s.%s WHERE expiry < now();", s.Options().Database, s.Options().Table))
+	if err != nil {
+		return err
+	}
+	s.reap = reap
+
+	return s.markJson()
+}
+
+// revise creates the sequence of the table, which starts after the
+// versions of its records that were counted one record at a time
+// before there was a sequence
+func (s *cockroachStore) revise() error {
+	var version int64
+
+	if err := s.client.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s.%s;", s.Options().Database, s.Options().Table)).Scan(&version); err != nil {
+		return err
+	}
+
+	_, err := s.client.Exec(fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS %s.%s%s START %d;", s.Options().Database, s.Options().Table, revisionSuffix, version+1))
+
+	return err
+}
+
+// markJson keeps whether the value is json for the records that were
+// written before it was kept. A record that is written in between is
+// marked by its write and left alone.
+func (s *cockroachStore) markJson() error {
+	for {
+		rows, err := s.client.Query(fmt.Sprintf("SELECT key, value FROM %s.%s WHERE is_json IS NULL LIMIT %d;", s.Options().Database, s.Options().Table, markBatchSize))
+		if err != nil {
+			return err
+		}
+
+		marks := map[string]bool{}
+
+		for rows.Next() {
+			var key string
+
+			var value []byte
+
+			if err := rows.Scan(&key, &value); err != nil {
+				rows.Close()
+				return err
+			}
+
+			marks[key] = json.Valid(value)
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(marks) == 0 {
+			return nil
+		}
+
+		for key, isJson := range marks {
+			if _, err := s.client.Exec(fmt.Sprintf("UPDATE %s.%s SET is_json = $2 WHERE key = $1 AND is_json IS NULL;", s.Options().Database, s.Options().Table), key, isJson); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// condition turns the filter into a sql condition on the jsonb of the
+// value whose paths and values are added to the args as placeholders
+func condition(f *state.Filter, args *[]interface{}) (string, error) {
+	switch f.Op {
+	case state.FilterEq, state.FilterIn:
+		*args = append(*args, pq.Array(strings.Split(f.Path, ".")))
+
+		path := fmt.Sprintf("(%s #> $%d::STRING[])", document, len(*args))
+
+		values := []string{}
+
+		for _, value := range f.Values {
+			bs, err := json.Marshal(value)
+			if err != nil {
+				return "", err
+			}
+
+			*args = append(*args, string(bs))
+
+			values = append(values, fmt.Sprintf("$%d::JSONB", len(*args)))
+		}
+
+		return fmt.Sprintf("%s IN (%s)", path, strings.Join(values, ", ")), nil
+	case state.FilterAnd, state.FilterOr:
+		conds := []string{}
+
+		for _, sub := range f.Filters {
+			cond, err := condition(sub, args)
+			if err != nil {
+				return "", err
+			}
+			conds = append(conds, cond)
+		}
+
+		return "(" + strings.Join(conds, " "+f.Op+" ") + ")", nil
+	}
+
+	return "", state.ErrInvalidQuery
+}
+
+// version is the version of the metadata of a record that was read,
+// which is null for a record that was read without metadata
+func version(meta *state.Meta) sql.NullInt64 {
+	if meta == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: int64(meta.Version), Valid: true}
+}
+
+// retryable tells whether cockroach asked for the transaction that
+// failed with the error to be retried
+func retryable(err error) bool {
+	var e *pq.Error
+	return errors.As(err, &e) && e.Code == "40001"
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	s := &cockroachStore{
+		Store: cockroach.NewStore(opts...),
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
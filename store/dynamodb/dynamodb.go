@@ -0,0 +1,705 @@
+// Package dynamodb is a store that keeps each table in its own
+// dynamodb table with key, value, and expiry attributes, where
+// expiry is in epoch seconds so that dynamodb's ttl can use it,
+// and the created, updated, and version attributes of the metadata
+// of each record. dynamodb has no revision of a table, so the
+// version counts the writes of a record since it was created. A
+// record written over an expired item that dynamodb has not removed
+// yet keeps when that item was created.
+// It reads the aws credentials from the env like the snssqs
+// broker and the ssm secret store do.
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	transport "github.com/aws/smithy-go/endpoints"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/state"
+)
+
+const (
+	defaultRegion    = "us-west-2"
+	defaultTable     = "records"
+	keyAttribute     = "key"
+	valueAttribute   = "value"
+	expiryAttribute  = "expiry"
+	createdAttribute = "created"
+	updatedAttribute = "updated"
+	versionAttribute = "version"
+	batchGetSize     = 100
+	requestTimeout   = 10 * time.Second
+	tableWaitTimeout = 2 * time.Minute
+)
+
+type dynamodbStore struct {
+	options store.StoreOptions
+	client  *dynamodb.Client
+	table   string
+}
+
+func (s *dynamodbStore) Options() store.StoreOptions {
+	return s.options
+}
+
+func (s *dynamodbStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := s.client.UpdateItem(ctx, update(s.table, rec))
+
+	return err
+}
+
+func (s *dynamodbStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	options := store.NewReadOptions(opts...)
+
+	// read many; otherwise, read one
+	if options.Prefix || options.Suffix {
+		return s.read(key, options)
+	}
+
+	records := []*store.Record{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	rsp, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]types.AttributeValue{keyAttribute: &types.AttributeValueMemberS{Value: key}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Item == nil {
+		return records, store.ErrRecordNotFound
+	}
+
+	stamp, expired, err := decode(rsp.Item)
+	if err != nil {
+		return nil, err
+	}
+
+	// if the record has expired, then delete it instead
+	if expired {
+		go s.Delete(key)
+		return records, store.ErrRecordNotFound
+	}
+
+	return append(records, stamp.Record), nil
+}
+
+func (s *dynamodbStore) read(key string, options store.ReadOptions) ([]*store.Record, error) {
+	prefix := ""
+
+	if options.Prefix {
+		prefix = key
+	}
+
+	suffix := ""
+
+	if options.Suffix {
+		suffix = key
+	}
+
+	stamped, err := s.scan(prefix, suffix, "")
+	if err != nil {
+		return nil, err
+	}
+
+	records := unstamp(stamped)
+
+	if options.Offset >= uint(len(records)) {
+		return []*store.Record{}, nil
+	}
+
+	records = records[options.Offset:]
+
+	if options.Limit > 0 && options.Limit < uint(len(records)) {
+		records = records[:options.Limit]
+	}
+
+	return records, nil
+}
+
+func (s *dynamodbStore) List(opts ...store.ListOption) ([]string, error) {
+	options := store.NewListOptions(opts...)
+
+	stamped, err := s.scan(options.Prefix, options.Suffix, "")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+
+	for _, stamp := range stamped {
+		keys = append(keys, stamp.Record.Key)
+	}
+
+	if options.Offset >= uint(len(keys)) {
+		return []string{}, nil
+	}
+
+	keys = keys[options.Offset:]
+
+	if options.Limit > 0 && options.Limit < uint(len(keys)) {
+		keys = keys[:options.Limit]
+	}
+
+	return keys, nil
+}
+
+// Page reads the records whose keys have the prefix in key order after
+// a key. dynamodb filters the keys as it scans, so only the records of
+// the keys that are left come back, and they are read in one pass.
+func (s *dynamodbStore) Page(prefix, after string, limit uint) ([]*store.Record, error) {
+	stamped, err := s.scan(prefix, "", after)
+	if err != nil {
+		return nil, err
+	}
+
+	records := unstamp(stamped)
+
+	if limit > 0 && limit < uint(len(records)) {
+		records = records[:limit]
+	}
+
+	return records, nil
+}
+
+// PageSince reads a page of the records that were updated at or after
+// the time, which are checked as the records are scanned
+func (s *dynamodbStore) PageSince(prefix, after string, updatedSince time.Time, limit uint) ([]*store.Record, error) {
+	stamped, err := s.scan(prefix, "", after)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*store.Record{}
+
+	for _, stamp := range stamped {
+		if stamp.Meta == nil || stamp.Meta.UpdatedAt.Before(updatedSince) {
+			continue
+		}
+
+		records = append(records, stamp.Record)
+
+		if limit > 0 && uint(len(records)) >= limit {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+func (s *dynamodbStore) CompareAndSwap(rec *store.Record, old *state.Meta) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	input := update(s.table, rec)
+
+	expression, names, values := condition(old)
+
+	input.ConditionExpression = aws.String(expression)
+
+	for name, attribute := range names {
+		input.ExpressionAttributeNames[name] = attribute
+	}
+
+	for name, value := range values {
+		input.ExpressionAttributeValues[name] = value
+	}
+
+	_, err := s.client.UpdateItem(ctx, input)
+
+	return swapped(err)
+}
+
+func (s *dynamodbStore) CompareAndDelete(key string, old *state.Meta) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	expression, names, values := condition(old)
+
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(s.table),
+		Key:                       map[string]types.AttributeValue{keyAttribute: &types.AttributeValueMemberS{Value: key}},
+		ConditionExpression:       aws.String(expression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+
+	return swapped(err)
+}
+
+func (s *dynamodbStore) Delete(key string, opts ...store.DeleteOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       map[string]types.AttributeValue{keyAttribute: &types.AttributeValueMemberS{Value: key}},
+	})
+
+	return err
+}
+
+func (s *dynamodbStore) String() string {
+	return "dynamodb"
+}
+
+// ReadStamped reads the unexpired records of the keys with their
+// metadata in batches of as many keys as dynamodb reads at once
+func (s *dynamodbStore) ReadStamped(keys []string) ([]*state.Stamped, error) {
+	byKey := map[string]*state.Stamped{}
+
+	for start := 0; start < len(keys); start += batchGetSize {
+		end := start + batchGetSize
+
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		if err := s.batchGet(keys[start:end], byKey); err != nil {
+			return nil, err
+		}
+	}
+
+	stamped := []*state.Stamped{}
+
+	for _, key := range keys {
+		if stamp, ok := byKey[key]; ok {
+			stamped = append(stamped, stamp)
+		}
+	}
+
+	return stamped, nil
+}
+
+// batchGet reads the unexpired records of the keys into byKey, asking
+// again for the keys that dynamodb leaves unprocessed
+func (s *dynamodbStore) batchGet(keys []string, byKey map[string]*state.Stamped) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	requested := []map[string]types.AttributeValue{}
+
+	for _, key := range keys {
+		requested = append(requested, map[string]types.AttributeValue{keyAttribute: &types.AttributeValueMemberS{Value: key}})
+	}
+
+	items := map[string]types.KeysAndAttributes{
+		s.table: {Keys: requested, ConsistentRead: aws.Bool(true)},
+	}
+
+	for len(items) > 0 {
+		rsp, err := s.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: items,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, item := range rsp.Responses[s.table] {
+			stamp, expired, err := decode(item)
+			if err != nil {
+				return err
+			}
+
+			if expired {
+				go s.Delete(stamp.Record.Key)
+				continue
+			}
+
+			byKey[stamp.Record.Key] = stamp
+		}
+
+		items = rsp.UnprocessedKeys
+	}
+
+	return nil
+}
+
+// scan returns the unexpired records with their metadata whose keys
+// have the prefix and the suffix and come after a key sorted by key. dynamodb does not
+// order the keys of a table with only a hash key, so every page is
+// read, but the prefix and the key after are filtered as it scans.
+func (s *dynamodbStore) scan(prefix, suffix, after string) ([]*state.Stamped, error) {
+	stamped := []*state.Stamped{}
+
+	input := &dynamodb.ScanInput{
+		TableName:      aws.String(s.table),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	filters := []string{}
+	values := map[string]types.AttributeValue{}
+
+	if len(prefix) > 0 {
+		filters = append(filters, "begins_with(#k, :prefix)")
+		values[":prefix"] = &types.AttributeValueMemberS{Value: prefix}
+	}
+
+	if len(after) > 0 {
+		filters = append(filters, "#k > :after")
+		values[":after"] = &types.AttributeValueMemberS{Value: after}
+	}
+
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+		input.ExpressionAttributeNames = map[string]string{"#k": keyAttribute}
+		input.ExpressionAttributeValues = values
+	}
+
+	for {
+		page, err := s.scanPage(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Items {
+			stamp, expired, err := decode(item)
+			if err != nil {
+				return nil, err
+			}
+
+			record := stamp.Record
+
+			if !strings.HasPrefix(record.Key, prefix) || !strings.HasSuffix(record.Key, suffix) || (len(after) > 0 && record.Key <= after) {
+				continue
+			}
+
+			if expired {
+				go s.Delete(record.Key)
+				continue
+			}
+
+			stamped = append(stamped, stamp)
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			break
+		}
+
+		input.ExclusiveStartKey = page.LastEvaluatedKey
+	}
+
+	sort.Slice(stamped, func(i, j int) bool {
+		return stamped[i].Record.Key < stamped[j].Record.Key
+	})
+
+	return stamped, nil
+}
+
+// scanPage reads one page of a scan, which has a deadline of its own
+// so that scanning a large table does not time out partway through
+func (s *dynamodbStore) scanPage(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	return s.client.Scan(ctx, input)
+}
+
+func (s *dynamodbStore) configure() error {
+	reg, err := regexp.Compile("[^a-zA-Z0-9_.-]+")
+	if err != nil {
+		return errors.New("failed to compile regex for table names")
+	}
+
+	s.table = s.options.Table
+	if len(s.table) == 0 {
+		s.table = defaultTable
+	}
+
+	if len(s.options.Database) > 0 {
+		s.table = s.options.Database + "_" + s.table
+	}
+
+	s.table = reg.ReplaceAllString(s.table, "_")
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Region) == 0 {
+		cfg.Region = defaultRegion
+	}
+
+	clientOpts := []func(*dynamodb.Options){}
+
+	// without an address, the endpoint of the region is used
+	if len(s.options.Nodes) > 0 && len(s.options.Nodes[0]) > 0 {
+		clientOpts = append(clientOpts, func(o *dynamodb.Options) {
+			o.EndpointResolverV2 = &resolver{s.options.Nodes}
+		})
+	}
+
+	s.client = dynamodb.NewFromConfig(cfg, clientOpts...)
+
+	return s.initTable()
+}
+
+func (s *dynamodbStore) initTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), tableWaitTimeout)
+	defer cancel()
+
+	_, err := s.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.table),
+	})
+
+	var notFound *types.ResourceNotFoundException
+
+	if err == nil {
+		return nil
+	} else if !errors.As(err, &notFound) {
+		return err
+	}
+
+	if _, err := s.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(s.table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(keyAttribute), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(keyAttribute), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}); err != nil {
+		var inUse *types.ResourceInUseException
+		// another sidecar may have created it first
+		if !errors.As(err, &inUse) {
+			return err
+		}
+	}
+
+	if err := dynamodb.NewTableExistsWaiter(s.client).Wait(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.table),
+	}, tableWaitTimeout); err != nil {
+		return err
+	}
+
+	// let dynamodb remove expired items in the background too
+	_, err = s.client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(s.table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(expiryAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+
+	return err
+}
+
+// update writes the value and expiry of a record, stamping when it
+// was updated and counting its version, and keeps when it was created
+func update(table string, rec *store.Record) *dynamodb.UpdateItemInput {
+	now := &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().UnixNano(), 10)}
+
+	expression := "SET #v = :value, #c = if_not_exists(#c, :now), #u = :now"
+
+	values := map[string]types.AttributeValue{
+		":value": &types.AttributeValueMemberB{Value: rec.Value},
+		":now":   now,
+		":one":   &types.AttributeValueMemberN{Value: "1"},
+	}
+
+	if rec.Expiry != 0 {
+		// dynamodb expires items by epoch seconds, so the
+		// expiry is rounded up to the next whole second
+		expiresAt := time.Now().Add(rec.Expiry).Add(time.Second - 1).Truncate(time.Second)
+		expression += ", #e = :expiry"
+		values[":expiry"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)}
+	} else {
+		expression += " REMOVE #e"
+	}
+
+	expression += " ADD #ver :one"
+
+	return &dynamodb.UpdateItemInput{
+		TableName:        aws.String(table),
+		Key:              map[string]types.AttributeValue{keyAttribute: &types.AttributeValueMemberS{Value: rec.Key}},
+		UpdateExpression: aws.String(expression),
+		ExpressionAttributeNames: map[string]string{
+			"#v":   valueAttribute,
+			"#c":   createdAttribute,
+			"#u":   updatedAttribute,
+			"#e":   expiryAttribute,
+			"#ver": versionAttribute,
+		},
+		ExpressionAttributeValues: values,
+	}
+}
+
+// condition holds while the item has the version of the metadata and
+// was created when the metadata was, since the version of an item
+// starts over when it is created again, or while the item has no
+// version when there is no metadata
+func condition(old *state.Meta) (string, map[string]string, map[string]types.AttributeValue) {
+	names := map[string]string{"#ver": versionAttribute}
+
+	if old == nil {
+		names["#k"] = keyAttribute
+		return "attribute_exists(#k) AND attribute_not_exists(#ver)", names, nil
+	}
+
+	names["#c"] = createdAttribute
+
+	values := map[string]types.AttributeValue{
+		":version": &types.AttributeValueMemberN{Value: strconv.FormatUint(old.Version, 10)},
+		":created": &types.AttributeValueMemberN{Value: strconv.FormatInt(old.CreatedAt.UnixNano(), 10)},
+	}
+
+	return "#ver = :version AND #c = :created", names, values
+}
+
+// swapped maps a failed condition to a record that was not swapped
+func swapped(err error) (bool, error) {
+	var failed *types.ConditionalCheckFailedException
+
+	if errors.As(err, &failed) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func decode(item map[string]types.AttributeValue) (*state.Stamped, bool, error) {
+	key, ok := item[keyAttribute].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, false, fmt.Errorf("item without a %s attribute", keyAttribute)
+	}
+
+	record := &store.Record{
+		Key: key.Value,
+	}
+
+	stamp := &state.Stamped{
+		Record: record,
+	}
+
+	if value, ok := item[valueAttribute].(*types.AttributeValueMemberB); ok {
+		record.Value = value.Value
+	}
+
+	// items that were put before the store kept metadata have none
+	if _, ok := item[versionAttribute]; ok {
+		meta, err := decodeMeta(key.Value, item)
+		if err != nil {
+			return nil, false, err
+		}
+
+		stamp.Meta = meta
+	}
+
+	if _, ok := item[expiryAttribute]; ok {
+		secs, err := number(key.Value, expiryAttribute, item)
+		if err != nil {
+			return nil, false, err
+		}
+
+		expiresAt := time.Unix(secs, 0)
+
+		if expiresAt.Before(time.Now()) {
+			return stamp, true, nil
+		}
+
+		record.Expiry = time.Until(expiresAt)
+	}
+
+	return stamp, false, nil
+}
+
+func decodeMeta(key string, item map[string]types.AttributeValue) (*state.Meta, error) {
+	created, err := number(key, createdAttribute, item)
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := number(key, updatedAttribute, item)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := number(key, versionAttribute, item)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state.Meta{
+		CreatedAt: time.Unix(0, created),
+		UpdatedAt: time.Unix(0, updated),
+		Version:   uint64(version),
+	}, nil
+}
+
+// number reads a number attribute of an item
+func number(key, attribute string, item map[string]types.AttributeValue) (int64, error) {
+	n, ok := item[attribute].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("item %s has no %s attribute", key, attribute)
+	}
+
+	v, err := strconv.ParseInt(n.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("item %s has an invalid %s attribute: %v", key, attribute, err)
+	}
+
+	return v, nil
+}
+
+func unstamp(stamped []*state.Stamped) []*store.Record {
+	records := []*store.Record{}
+
+	for _, stamp := range stamped {
+		records = append(records, stamp.Record)
+	}
+
+	return records
+}
+
+type resolver struct {
+	nodes []string
+}
+
+func (r *resolver) ResolveEndpoint(ctx context.Context, params dynamodb.EndpointParameters) (transport.Endpoint, error) {
+	u, err := url.Parse(r.nodes[0])
+	if err != nil {
+		return transport.Endpoint{}, err
+	}
+
+	return transport.Endpoint{
+		URI: *u,
+	}, nil
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	options := store.NewStoreOptions(opts...)
+
+	s := &dynamodbStore{
+		options: options,
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
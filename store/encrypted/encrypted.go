@@ -0,0 +1,464 @@
+// Package encrypted is a store that wraps another store and encrypts the
+// values of its records at rest with AES-GCM. Every value keeps the id
+// of the key that encrypted it, so that a key can be rotated by writing
+// with a new key while the values of the previous keys stay readable.
+// Values that were written before the store was encrypted fail to be
+// read, unless the store is told to read them as they are while it is
+// migrated to encryption.
+package encrypted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/sidecar/state"
+)
+
+const (
+	// encrypted values are json that starts with this field
+	prefix = `{"$encrypted":`
+)
+
+var (
+	ErrNoKeys    = errors.New("encrypted store requires a key")
+	ErrPlaintext = errors.New("value is not encrypted")
+)
+
+// Key is a key of the store. Its secret is an AES key of 16, 24, or 32
+// bytes and its id is kept with the values that it encrypts, so it must
+// always name the same secret.
+type Key struct {
+	Id     string
+	Secret []byte
+}
+
+type encryptedStore struct {
+	store store.Store
+	// the first key encrypts and every key decrypts the
+	// values that it encrypted
+	primary string
+	aeads   map[string]cipher.AEAD
+	options EncryptedOptions
+}
+
+type envelope struct {
+	Encrypted sealed `json:"$encrypted"`
+}
+
+type sealed struct {
+	KeyId string `json:"keyId"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func (s *encryptedStore) Options() store.StoreOptions {
+	return s.store.Options()
+}
+
+func (s *encryptedStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	enc, err := s.encrypt(rec)
+	if err != nil {
+		return err
+	}
+
+	return s.store.Write(enc, opts...)
+}
+
+func (s *encryptedStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	recs, err := s.store.Read(key, opts...)
+	if err != nil {
+		return recs, err
+	}
+
+	return s.decryptAll(recs)
+}
+
+func (s *encryptedStore) List(opts ...store.ListOption) ([]string, error) {
+	return s.store.List(opts...)
+}
+
+func (s *encryptedStore) Delete(key string, opts ...store.DeleteOption) error {
+	return s.store.Delete(key, opts...)
+}
+
+func (s *encryptedStore) String() string {
+	return s.store.String()
+}
+
+// Close closes the store that it encrypts if that store can be closed
+func (s *encryptedStore) Close() error {
+	if c, ok := s.store.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (s *encryptedStore) Page(prefix, after string, limit uint) ([]*store.Record, error) {
+	recs, err := state.ReadPage(s.store, prefix, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decryptAll(recs)
+}
+
+// CompareAndSwap swaps the encrypted value of the record for the new one
+// while the record has the version that was read, which does not
+// depend on the value, so it is compared by the store that it wraps
+func (s *encryptedStore) CompareAndSwap(rec *store.Record, old *state.Meta) (bool, error) {
+	enc, err := s.encrypt(rec)
+	if err != nil {
+		return false, err
+	}
+
+	sw, ok := s.store.(state.Swapper)
+	if !ok {
+		return false, state.ErrNotSwappable
+	}
+
+	return sw.CompareAndSwap(enc, old)
+}
+
+func (s *encryptedStore) CompareAndDelete(key string, old *state.Meta) (bool, error) {
+	sw, ok := s.store.(state.Swapper)
+	if !ok {
+		return false, state.ErrNotSwappable
+	}
+
+	return sw.CompareAndDelete(key, old)
+}
+
+// Transact encrypts the records of the operations and lets the store
+// check their etags, where the etags of records without metadata are
+// hashes of their values and are swapped for the etags of the
+// encrypted values first.
+func (s *encryptedStore) Transact(ops []state.Operation) error {
+	t, ok := s.store.(state.Transactor)
+	if !ok {
+		return state.ErrNotTransactional
+	}
+
+	encrypted, err := s.seal(ops)
+	if err != nil {
+		return err
+	}
+
+	return t.Transact(encrypted)
+}
+
+func (s *encryptedStore) OpenOutbox() error {
+	ob, ok := s.store.(state.Outboxer)
+	if !ok {
+		return state.ErrNoOutbox
+	}
+
+	return ob.OpenOutbox()
+}
+
+// TransactWithEvents encrypts the operations like Transact. The events
+// are not state and are kept in the outbox as they are.
+func (s *encryptedStore) TransactWithEvents(ops []state.Operation, events []*state.Event) error {
+	ob, ok := s.store.(state.Outboxer)
+	if !ok {
+		return state.ErrNoOutbox
+	}
+
+	encrypted, err := s.seal(ops)
+	if err != nil {
+		return err
+	}
+
+	return ob.TransactWithEvents(encrypted, events)
+}
+
+func (s *encryptedStore) Claim(limit uint, lease time.Duration) ([]*state.Event, error) {
+	ob, ok := s.store.(state.Outboxer)
+	if !ok {
+		return nil, state.ErrNoOutbox
+	}
+
+	return ob.Claim(limit, lease)
+}
+
+func (s *encryptedStore) MarkSent(ids []uint64) error {
+	ob, ok := s.store.(state.Outboxer)
+	if !ok {
+		return state.ErrNoOutbox
+	}
+
+	return ob.MarkSent(ids)
+}
+
+func (s *encryptedStore) MarkFailed(id uint64, maxAttempts uint) error {
+	ob, ok := s.store.(state.Outboxer)
+	if !ok {
+		return state.ErrNoOutbox
+	}
+
+	return ob.MarkFailed(id, maxAttempts)
+}
+
+func (s *encryptedStore) Release(ids []uint64) error {
+	ob, ok := s.store.(state.Outboxer)
+	if !ok {
+		return state.ErrNoOutbox
+	}
+
+	return ob.Release(ids)
+}
+
+// seal returns the operations with their records encrypted and the
+// etags of records without metadata swapped for the etags of the
+// encrypted values. The etag of a record that an earlier operation
+// wrote is checked by the store against what that operation staged.
+func (s *encryptedStore) seal(ops []state.Operation) ([]state.Operation, error) {
+	staged := map[string]bool{}
+
+	encrypted := []state.Operation{}
+
+	for _, op := range ops {
+		key := op.Record.Key
+
+		etag := op.Etag
+
+		if len(etag) > 0 && etag != state.AnyEtag && !staged[key] {
+			var err error
+			if etag, err = s.sealEtag(key, etag); err != nil {
+				return nil, err
+			}
+		}
+
+		staged[key] = true
+
+		if op.Delete {
+			encrypted = append(encrypted, state.Operation{
+				Delete: true,
+				Record: op.Record,
+				Etag:   etag,
+			})
+
+			continue
+		}
+
+		enc, err := s.encrypt(op.Record)
+		if err != nil {
+			return nil, err
+		}
+
+		encrypted = append(encrypted, state.Operation{
+			Record: enc,
+			Etag:   etag,
+		})
+	}
+
+	return encrypted, nil
+}
+
+// sealEtag returns the etag that the store holds for the record of the
+// key when the record has no metadata and its decrypted value has the
+// etag. Other etags do not depend on the value and are kept.
+func (s *encryptedStore) sealEtag(key, etag string) (string, error) {
+	sp, ok := s.store.(state.Stamper)
+	if !ok {
+		return etag, nil
+	}
+
+	stamped, err := sp.ReadStamped([]string{key})
+	if err != nil {
+		return "", err
+	}
+
+	if len(stamped) == 0 || stamped[0].Meta != nil {
+		return etag, nil
+	}
+
+	plain, err := s.decrypt(stamped[0].Record)
+	if err != nil {
+		return "", err
+	}
+
+	if !state.Matches(plain.Value, nil, etag) {
+		return "", state.ErrEtagMismatch
+	}
+
+	return state.Etag(stamped[0].Record.Value, nil), nil
+}
+
+func (s *encryptedStore) Reap() (int, error) {
+	r, ok := s.store.(state.Reaper)
+	if !ok {
+		return 0, nil
+	}
+
+	return r.Reap()
+}
+
+func (s *encryptedStore) ReadStamped(keys []string) ([]*state.Stamped, error) {
+	sp, ok := s.store.(state.Stamper)
+	if !ok {
+		return nil, state.ErrNoMetadata
+	}
+
+	stamped, err := sp.ReadStamped(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range stamped {
+		if st.Record, err = s.decrypt(st.Record); err != nil {
+			return nil, err
+		}
+	}
+
+	return stamped, nil
+}
+
+// encrypt returns a copy of the record with the value encrypted by the
+// primary key, where the key of the record is authenticated with it so
+// that a value cannot be moved to another key
+func (s *encryptedStore) encrypt(rec *store.Record) (*store.Record, error) {
+	aead := s.aeads[s.primary]
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to encrypt record %s: %v", rec.Key, err)
+	}
+
+	bs, err := json.Marshal(&envelope{
+		Encrypted: sealed{
+			KeyId: s.primary,
+			Nonce: nonce,
+			Data:  aead.Seal(nil, nonce, rec.Value, []byte(rec.Key)),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt record %s: %v", rec.Key, err)
+	}
+
+	return &store.Record{
+		Key:    rec.Key,
+		Value:  bs,
+		Expiry: rec.Expiry,
+	}, nil
+}
+
+// decrypt returns a copy of the record with the value decrypted by the
+// key that encrypted it. A value that is read as it is may start like
+// an encrypted value, so only a value that is exactly an envelope of
+// the store is decrypted then.
+func (s *encryptedStore) decrypt(rec *store.Record) (*store.Record, error) {
+	env, err := unseal(rec.Value)
+	if err != nil && s.options.Plaintext {
+		return rec, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record %s: %w", rec.Key, err)
+	}
+
+	aead, ok := s.aeads[env.Encrypted.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt record %s: there is no key %s", rec.Key, env.Encrypted.KeyId)
+	}
+
+	if len(env.Encrypted.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("failed to decrypt record %s: nonce is invalid", rec.Key)
+	}
+
+	value, err := aead.Open(nil, env.Encrypted.Nonce, env.Encrypted.Data, []byte(rec.Key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record %s: %v", rec.Key, err)
+	}
+
+	return &store.Record{
+		Key:    rec.Key,
+		Value:  value,
+		Expiry: rec.Expiry,
+	}, nil
+}
+
+// unseal returns the envelope that the value is, where an envelope has
+// every field of a sealed value and nothing else
+func unseal(value []byte) (*envelope, error) {
+	if !bytes.HasPrefix(value, []byte(prefix)) {
+		return nil, ErrPlaintext
+	}
+
+	env := &envelope{}
+
+	decoder := json.NewDecoder(bytes.NewReader(value))
+
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(env); err != nil {
+		return nil, err
+	}
+
+	if decoder.More() || len(env.Encrypted.KeyId) == 0 || len(env.Encrypted.Nonce) == 0 || len(env.Encrypted.Data) == 0 {
+		return nil, ErrPlaintext
+	}
+
+	return env, nil
+}
+
+func (s *encryptedStore) decryptAll(recs []*store.Record) ([]*store.Record, error) {
+	decrypted := []*store.Record{}
+
+	for _, rec := range recs {
+		d, err := s.decrypt(rec)
+		if err != nil {
+			return nil, err
+		}
+
+		decrypted = append(decrypted, d)
+	}
+
+	return decrypted, nil
+}
+
+// NewStore wraps the store so that its values are encrypted with the
+// first key and decrypted with whichever key encrypted them
+func NewStore(st store.Store, keys []Key, opts ...EncryptedOption) (store.Store, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	s := &encryptedStore{
+		store:   st,
+		primary: keys[0].Id,
+		aeads:   map[string]cipher.AEAD{},
+		options: NewEncryptedOptions(opts...),
+	}
+
+	for _, key := range keys {
+		if len(key.Id) == 0 {
+			return nil, errors.New("encrypted store requires keys with ids")
+		}
+
+		if _, ok := s.aeads[key.Id]; ok {
+			return nil, fmt.Errorf("key %s is given more than once", key.Id)
+		}
+
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is invalid: %v", key.Id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is invalid: %v", key.Id, err)
+		}
+
+		s.aeads[key.Id] = aead
+	}
+
+	return s, nil
+}
@@ -0,0 +1,26 @@
+package encrypted
+
+type EncryptedOption func(o *EncryptedOptions)
+
+type EncryptedOptions struct {
+	// read the values that were written before the store was
+	// encrypted as they are, which is only meant for the time
+	// that it takes to migrate the store to encryption
+	Plaintext bool
+}
+
+func EncryptedWithPlaintext(plaintext bool) EncryptedOption {
+	return func(o *EncryptedOptions) {
+		o.Plaintext = plaintext
+	}
+}
+
+func NewEncryptedOptions(opts ...EncryptedOption) EncryptedOptions {
+	options := EncryptedOptions{}
+
+	for _, fn := range opts {
+		fn(&options)
+	}
+
+	return options
+}
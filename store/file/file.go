@@ -0,0 +1,929 @@
+// Package file is a store that persists records to bolt databases in a
+// local data directory. Each database is a file in the directory and
+// each table is a bucket in that file. Every write is fsynced before
+// it returns and stamps the metadata of its record. The outbox of a
+// table is the bucket of the table name suffixed by _outbox.
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/state"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultDirectory = "data"
+	defaultDatabase  = "sidecar"
+	defaultTable     = "default"
+	outboxSuffix     = "_outbox"
+	openTimeout      = 5 * time.Second
+)
+
+var (
+	// a bolt file may only be opened once per process, so the
+	// stores that share a database share its handle, which is
+	// closed once the last of them is closed
+	dbs    = map[string]*handle{}
+	dbsMtx sync.Mutex
+)
+
+type handle struct {
+	db   *bolt.DB
+	refs int
+}
+
+type fileStore struct {
+	options store.StoreOptions
+	path    string
+	db      *bolt.DB
+	bucket  []byte
+	// the outbox bucket is nil until it is opened
+	outbox []byte
+	mtx    sync.RWMutex
+}
+
+type record struct {
+	Value     []byte    `json:"value"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Version   uint64    `json:"version"`
+}
+
+type event struct {
+	EventName    string    `json:"eventName"`
+	Payload      []byte    `json:"payload"`
+	SentAt       time.Time `json:"sentAt"`
+	ClaimedUntil time.Time `json:"claimedUntil"`
+	Attempts     uint      `json:"attempts"`
+	FailedAt     time.Time `json:"failedAt"`
+}
+
+func (e *event) pending() bool {
+	return e.SentAt.IsZero() && e.FailedAt.IsZero()
+}
+
+func (s *fileStore) Options() store.StoreOptions {
+	return s.options
+}
+
+func (s *fileStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		bs, err := stamp(b, rec)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(rec.Key), bs)
+	})
+}
+
+func (s *fileStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	options := store.NewReadOptions(opts...)
+
+	// read many; otherwise, read one
+	if options.Prefix || options.Suffix {
+		return s.read(key, options)
+	}
+
+	records := []*store.Record{}
+
+	var bs []byte
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(s.bucket).Get([]byte(key)); v != nil {
+			bs = append([]byte{}, v...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if bs == nil {
+		return records, store.ErrRecordNotFound
+	}
+
+	record, expired, err := decode(key, bs)
+	if err != nil {
+		return nil, err
+	}
+
+	// if the record has expired, then delete it instead
+	if expired {
+		go s.Delete(key)
+		return records, store.ErrRecordNotFound
+	}
+
+	return append(records, record), nil
+}
+
+func (s *fileStore) read(key string, options store.ReadOptions) ([]*store.Record, error) {
+	records := []*store.Record{}
+
+	prefix := ""
+
+	if options.Prefix {
+		prefix = key
+	}
+
+	suffix := ""
+
+	if options.Suffix {
+		suffix = key
+	}
+
+	skipped := uint(0)
+
+	err := s.scan(prefix, suffix, func(k string, v []byte) (bool, error) {
+		record, expired, err := decode(k, v)
+		if err != nil {
+			return false, err
+		}
+
+		if expired {
+			go s.Delete(k)
+			return true, nil
+		}
+
+		if skipped < options.Offset {
+			skipped++
+			return true, nil
+		}
+
+		records = append(records, record)
+
+		return options.Limit == 0 || uint(len(records)) < options.Limit, nil
+	})
+
+	return records, err
+}
+
+func (s *fileStore) List(opts ...store.ListOption) ([]string, error) {
+	options := store.NewListOptions(opts...)
+
+	keys := []string{}
+
+	skipped := uint(0)
+
+	err := s.scan(options.Prefix, options.Suffix, func(k string, v []byte) (bool, error) {
+		_, expired, err := decode(k, v)
+		if err != nil {
+			return false, err
+		}
+
+		if expired {
+			go s.Delete(k)
+			return true, nil
+		}
+
+		if skipped < options.Offset {
+			skipped++
+			return true, nil
+		}
+
+		keys = append(keys, k)
+
+		return options.Limit == 0 || uint(len(keys)) < options.Limit, nil
+	})
+
+	return keys, err
+}
+
+func (s *fileStore) Page(prefix, after string, limit uint) ([]*store.Record, error) {
+	records := []*store.Record{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+
+		p := []byte(prefix)
+
+		k, v := c.Seek(p)
+
+		if len(after) > 0 && after > prefix {
+			k, v = c.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			record, expired, err := decode(string(k), v)
+			if err != nil {
+				return err
+			}
+
+			if expired {
+				go s.Delete(string(k))
+				continue
+			}
+
+			records = append(records, record)
+
+			if limit > 0 && uint(len(records)) >= limit {
+				return nil
+			}
+		}
+
+		return nil
+	})
+
+	return records, err
+}
+
+func (s *fileStore) CompareAndSwap(rec *store.Record, old *state.Meta) (bool, error) {
+	swapped := false
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		if ok, err := s.holds(b, rec.Key, old); err != nil || !ok {
+			return err
+		}
+
+		bs, err := stamp(b, rec)
+		if err != nil {
+			return err
+		}
+
+		swapped = true
+
+		return b.Put([]byte(rec.Key), bs)
+	})
+
+	return swapped, err
+}
+
+func (s *fileStore) CompareAndDelete(key string, old *state.Meta) (bool, error) {
+	deleted := false
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		if ok, err := s.holds(b, key, old); err != nil || !ok {
+			return err
+		}
+
+		deleted = true
+
+		return b.Delete([]byte(key))
+	})
+
+	return deleted, err
+}
+
+// Transact applies the operations in one bolt transaction, which
+// is rolled back when an etag does not match
+func (s *fileStore) Transact(ops []state.Operation) error {
+	return s.transact(ops, nil)
+}
+
+func (s *fileStore) OpenOutbox() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	outbox := append(bytes.Clone(s.bucket), outboxSuffix...)
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(outbox)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	s.outbox = outbox
+
+	return nil
+}
+
+// TransactWithEvents applies the operations like Transact and puts the
+// events in the outbox in the same bolt transaction
+func (s *fileStore) TransactWithEvents(ops []state.Operation, events []*state.Event) error {
+	if s.outboxBucket() == nil {
+		return state.ErrNoOutbox
+	}
+
+	return s.transact(ops, events)
+}
+
+// Claim reads the events of the outbox that are neither sent nor failed
+// and holds them for the lease. The events are keyed by their ids in big
+// endian so that they are in order.
+func (s *fileStore) Claim(limit uint, lease time.Duration) ([]*state.Event, error) {
+	outbox := s.outboxBucket()
+	if outbox == nil {
+		return nil, state.ErrNoOutbox
+	}
+
+	events := []*state.Event{}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outbox)
+
+		now := time.Now()
+
+		claimed := map[string]*event{}
+
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			ev := &event{}
+
+			if err := json.Unmarshal(v, ev); err != nil {
+				return fmt.Errorf("failed to decode event %d: %v", binary.BigEndian.Uint64(k), err)
+			}
+
+			if !ev.pending() {
+				continue
+			}
+
+			if ev.ClaimedUntil.After(now) {
+				events = []*state.Event{}
+				return nil
+			}
+
+			if limit > 0 && uint(len(events)) >= limit {
+				continue
+			}
+
+			ev.ClaimedUntil = now.Add(lease)
+
+			claimed[string(k)] = ev
+
+			events = append(events, &state.Event{
+				Id:        binary.BigEndian.Uint64(k),
+				EventName: ev.EventName,
+				Payload:   ev.Payload,
+			})
+		}
+
+		for k, ev := range claimed {
+			bs, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put([]byte(k), bs); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return events, err
+}
+
+func (s *fileStore) MarkSent(ids []uint64) error {
+	now := time.Now()
+
+	return s.updateEvents(ids, func(ev *event) {
+		if ev.SentAt.IsZero() {
+			ev.SentAt = now
+		}
+	})
+}
+
+func (s *fileStore) MarkFailed(id uint64, maxAttempts uint) error {
+	return s.updateEvents([]uint64{id}, func(ev *event) {
+		if !ev.pending() {
+			return
+		}
+
+		ev.ClaimedUntil = time.Time{}
+		ev.Attempts++
+
+		if ev.Attempts >= maxAttempts {
+			ev.FailedAt = time.Now()
+		}
+	})
+}
+
+func (s *fileStore) Release(ids []uint64) error {
+	return s.updateEvents(ids, func(ev *event) {
+		ev.ClaimedUntil = time.Time{}
+	})
+}
+
+// updateEvents applies the update to each of the events of the ids in
+// one bolt transaction
+func (s *fileStore) updateEvents(ids []uint64, update func(ev *event)) error {
+	outbox := s.outboxBucket()
+	if outbox == nil {
+		return state.ErrNoOutbox
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outbox)
+
+		for _, id := range ids {
+			k := binary.BigEndian.AppendUint64(nil, id)
+
+			v := b.Get(k)
+			if v == nil {
+				continue
+			}
+
+			ev := &event{}
+
+			if err := json.Unmarshal(v, ev); err != nil {
+				return fmt.Errorf("failed to decode event %d: %v", id, err)
+			}
+
+			update(ev)
+
+			bs, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(k, bs); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *fileStore) transact(ops []state.Operation, events []*state.Event) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		for _, op := range ops {
+			key := op.Record.Key
+
+			if len(op.Etag) > 0 {
+				if ok, err := s.tagged(b, key, op.Etag); err != nil {
+					return err
+				} else if !ok {
+					return state.ErrEtagMismatch
+				}
+			}
+
+			if op.Delete {
+				if err := b.Delete([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			bs, err := stamp(b, op.Record)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put([]byte(key), bs); err != nil {
+				return err
+			}
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		outbox := tx.Bucket(s.outboxBucket())
+
+		for _, ev := range events {
+			id, err := outbox.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			bs, err := json.Marshal(&event{
+				EventName: ev.EventName,
+				Payload:   ev.Payload,
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := outbox.Put(binary.BigEndian.AppendUint64(nil, id), bs); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ReadStamped reads the unexpired records of the keys with their
+// metadata in one bolt transaction
+func (s *fileStore) ReadStamped(keys []string) ([]*state.Stamped, error) {
+	stamped := []*state.Stamped{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		for _, key := range keys {
+			v := b.Get([]byte(key))
+			if v == nil {
+				continue
+			}
+
+			r, err := load(key, v)
+			if err != nil {
+				return err
+			}
+
+			if r.expired() {
+				continue
+			}
+
+			stamped = append(stamped, &state.Stamped{
+				Record: r.record(key),
+				Meta:   r.meta(),
+			})
+		}
+
+		return nil
+	})
+
+	return stamped, err
+}
+
+// Reap deletes the expired records and returns how many there were
+func (s *fileStore) Reap() (int, error) {
+	reaped := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+
+		for k, v := c.First(); k != nil; {
+			_, expired, err := decode(string(k), v)
+			if err != nil {
+				return err
+			}
+
+			if !expired {
+				k, v = c.Next()
+				continue
+			}
+
+			deleted := bytes.Clone(k)
+
+			if err := c.Delete(); err != nil {
+				return err
+			}
+
+			reaped++
+
+			// next skips a key after a delete but seeking
+			// the deleted key lands on the key after it
+			k, v = c.Seek(deleted)
+		}
+
+		if outbox := s.outboxBucket(); outbox != nil {
+			return reapSent(tx.Bucket(outbox))
+		}
+
+		return nil
+	})
+
+	return reaped, err
+}
+
+// reapSent deletes the events of the outbox that were sent
+func reapSent(b *bolt.Bucket) error {
+	c := b.Cursor()
+
+	for k, v := c.First(); k != nil; {
+		ev := &event{}
+
+		if err := json.Unmarshal(v, ev); err != nil {
+			return fmt.Errorf("failed to decode event %d: %v", binary.BigEndian.Uint64(k), err)
+		}
+
+		if ev.SentAt.IsZero() {
+			k, v = c.Next()
+			continue
+		}
+
+		deleted := bytes.Clone(k)
+
+		if err := c.Delete(); err != nil {
+			return err
+		}
+
+		k, v = c.Seek(deleted)
+	}
+
+	return nil
+}
+
+func (s *fileStore) outboxBucket() []byte {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.outbox
+}
+
+// holds tells whether the unexpired record of the key has the version
+// of the metadata, or has no version when there is no metadata
+func (s *fileStore) holds(b *bolt.Bucket, key string, old *state.Meta) (bool, error) {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return false, nil
+	}
+
+	r, err := load(key, v)
+	if err != nil || r.expired() {
+		return false, err
+	}
+
+	if old == nil {
+		return r.Version == 0, nil
+	}
+
+	return r.Version == old.Version, nil
+}
+
+// tagged tells whether the unexpired record of the key has the etag
+func (s *fileStore) tagged(b *bolt.Bucket, key, etag string) (bool, error) {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return false, nil
+	}
+
+	r, err := load(key, v)
+	if err != nil || r.expired() {
+		return false, err
+	}
+
+	return state.Matches(r.Value, r.meta(), etag), nil
+}
+
+func (s *fileStore) Delete(key string, opts ...store.DeleteOption) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(key))
+	})
+}
+
+func (s *fileStore) String() string {
+	return "file"
+}
+
+// Close releases the handle of the database of the store
+func (s *fileStore) Close() error {
+	return release(s.path)
+}
+
+// scan calls fn in key order for every record whose key has the prefix
+// and the suffix until fn returns false or an error
+func (s *fileStore) scan(prefix, suffix string, fn func(k string, v []byte) (bool, error)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+
+		p := []byte(prefix)
+
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if !strings.HasSuffix(string(k), suffix) {
+				continue
+			}
+
+			more, err := fn(string(k), append([]byte{}, v...))
+			if err != nil {
+				return err
+			}
+
+			if !more {
+				return nil
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *fileStore) configure() error {
+	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		return fmt.Errorf("failed to compile regex for database and table names")
+	}
+
+	database := reg.ReplaceAllString(s.options.Database, "_")
+	if len(database) == 0 {
+		database = defaultDatabase
+	}
+
+	table := s.options.Table
+	if len(table) == 0 {
+		table = defaultTable
+	}
+
+	dir := defaultDirectory
+	if len(s.options.Nodes) > 0 && len(s.options.Nodes[0]) > 0 {
+		dir = s.options.Nodes[0]
+	}
+
+	s.path = filepath.Join(dir, database+".db")
+
+	db, err := open(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.db = db
+
+	s.bucket = []byte(table)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+
+		return revise(b)
+	})
+}
+
+// revise starts the revision of a bucket that has none after the
+// versions of its records, which were counted one record at a time
+// before the bucket kept a revision
+func revise(b *bolt.Bucket) error {
+	if b.Sequence() > 0 {
+		return nil
+	}
+
+	var revision uint64
+
+	b.ForEach(func(k, v []byte) error {
+		// records that cannot be loaded have no version
+		if r, err := load(string(k), v); err == nil && r.Version > revision {
+			revision = r.Version
+		}
+
+		return nil
+	})
+
+	return b.SetSequence(revision)
+}
+
+func open(path string) (*bolt.DB, error) {
+	dbsMtx.Lock()
+	defer dbsMtx.Unlock()
+
+	if h, ok := dbs[path]; ok {
+		h.refs++
+		return h.db, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+
+	dbs[path] = &handle{db: db, refs: 1}
+
+	return db, nil
+}
+
+func release(path string) error {
+	dbsMtx.Lock()
+	defer dbsMtx.Unlock()
+
+	h, ok := dbs[path]
+	if !ok {
+		return nil
+	}
+
+	h.refs--
+
+	if h.refs > 0 {
+		return nil
+	}
+
+	delete(dbs, path)
+
+	return h.db.Close()
+}
+
+// stamp encodes the record as the next revision of the bucket, which
+// grows with every write of one of its records
+func stamp(b *bolt.Bucket, rec *store.Record) ([]byte, error) {
+	var prev *record
+
+	if v := b.Get([]byte(rec.Key)); v != nil {
+		r, err := load(rec.Key, v)
+		if err != nil {
+			return nil, err
+		}
+		prev = r
+	}
+
+	version, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	return encode(rec, prev, version)
+}
+
+// a record that replaces an unexpired record keeps when it was created;
+// records written before there was metadata are stamped as if they
+// were created now
+func encode(rec *store.Record, prev *record, version uint64) ([]byte, error) {
+	now := time.Now()
+
+	r := &record{
+		Value:     rec.Value,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   version,
+	}
+
+	if rec.Expiry != 0 {
+		r.ExpiresAt = now.Add(rec.Expiry)
+	}
+
+	if prev != nil && !prev.expired() && prev.Version > 0 {
+		r.CreatedAt = prev.CreatedAt
+	}
+
+	return json.Marshal(r)
+}
+
+func decode(key string, bs []byte) (*store.Record, bool, error) {
+	r, err := load(key, bs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if r.expired() {
+		return nil, true, nil
+	}
+
+	return r.record(key), false, nil
+}
+
+func load(key string, bs []byte) (*record, error) {
+	r := &record{}
+
+	if err := json.Unmarshal(bs, r); err != nil {
+		return nil, fmt.Errorf("failed to decode record %s: %v", key, err)
+	}
+
+	return r, nil
+}
+
+func (r *record) expired() bool {
+	return !r.ExpiresAt.IsZero() && r.ExpiresAt.Before(time.Now())
+}
+
+// meta returns the metadata of the record, which records that were
+// written before there was metadata do not have
+func (r *record) meta() *state.Meta {
+	if r.Version == 0 {
+		return nil
+	}
+
+	return &state.Meta{
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+		Version:   r.Version,
+	}
+}
+
+func (r *record) record(key string) *store.Record {
+	rec := &store.Record{
+		Key:   key,
+		Value: r.Value,
+	}
+
+	if !r.ExpiresAt.IsZero() {
+		rec.Expiry = time.Until(r.ExpiresAt)
+	}
+
+	return rec
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	options := store.NewStoreOptions(opts...)
+
+	s := &fileStore{
+		options: options,
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
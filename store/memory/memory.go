@@ -0,0 +1,514 @@
+// Package memory is a store that keeps records in a map in memory.
+// Unlike the memory store of pkg, it reads pages of records in key
+// order, swaps records in place, applies transactions, reaps its
+// expired records, keeps the metadata of its records, and keeps an
+// outbox of events.
+package memory
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/state"
+)
+
+type memoryStore struct {
+	options store.StoreOptions
+	records map[string]*record
+	// the outbox is nil until it is opened
+	outbox      []*event
+	lastEventId uint64
+	// the revision grows with every write and is
+	// the version of the record that is written
+	revision uint64
+	mtx      sync.RWMutex
+}
+
+type record struct {
+	value     []byte
+	expiresAt time.Time
+	createdAt time.Time
+	updatedAt time.Time
+	version   uint64
+}
+
+type event struct {
+	id           uint64
+	eventName    string
+	payload      []byte
+	sentAt       time.Time
+	claimedUntil time.Time
+	attempts     uint
+	failedAt     time.Time
+}
+
+func (e *event) pending() bool {
+	return e.sentAt.IsZero() && e.failedAt.IsZero()
+}
+
+func (s *memoryStore) Options() store.StoreOptions {
+	return s.options
+}
+
+func (s *memoryStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.records[rec.Key] = s.encode(rec, s.records[rec.Key])
+
+	return nil
+}
+
+func (s *memoryStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	options := store.NewReadOptions(opts...)
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	// read many; otherwise, read one
+	if options.Prefix || options.Suffix {
+		return s.read(key, options), nil
+	}
+
+	records := []*store.Record{}
+
+	r, ok := s.records[key]
+	if !ok || r.expired() {
+		return records, store.ErrRecordNotFound
+	}
+
+	return append(records, decode(key, r)), nil
+}
+
+func (s *memoryStore) read(key string, options store.ReadOptions) []*store.Record {
+	prefix := ""
+
+	if options.Prefix {
+		prefix = key
+	}
+
+	suffix := ""
+
+	if options.Suffix {
+		suffix = key
+	}
+
+	records := []*store.Record{}
+
+	for _, k := range page(s.keys(prefix, suffix), options.Limit, options.Offset) {
+		records = append(records, decode(k, s.records[k]))
+	}
+
+	return records
+}
+
+func (s *memoryStore) List(opts ...store.ListOption) ([]string, error) {
+	options := store.NewListOptions(opts...)
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return page(s.keys(options.Prefix, options.Suffix), options.Limit, options.Offset), nil
+}
+
+func (s *memoryStore) Page(prefix, after string, limit uint) ([]*store.Record, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	keys := s.keys(prefix, "")
+
+	i := sort.SearchStrings(keys, after)
+	if i < len(keys) && keys[i] == after {
+		i++
+	}
+
+	records := []*store.Record{}
+
+	for _, k := range page(keys[i:], limit, 0) {
+		records = append(records, decode(k, s.records[k]))
+	}
+
+	return records, nil
+}
+
+func (s *memoryStore) CompareAndSwap(rec *store.Record, old *state.Meta) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.holds(rec.Key, old) {
+		return false, nil
+	}
+
+	s.records[rec.Key] = s.encode(rec, s.records[rec.Key])
+
+	return true, nil
+}
+
+func (s *memoryStore) CompareAndDelete(key string, old *state.Meta) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.holds(key, old) {
+		return false, nil
+	}
+
+	delete(s.records, key)
+
+	return true, nil
+}
+
+// Transact applies the operations to a copy of the records they touch
+// and only keeps the copy once every etag has matched
+func (s *memoryStore) Transact(ops []state.Operation) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.transact(ops, nil)
+}
+
+func (s *memoryStore) OpenOutbox() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.outbox == nil {
+		s.outbox = []*event{}
+	}
+
+	return nil
+}
+
+// TransactWithEvents applies the operations like Transact and puts the
+// events in the outbox when they apply
+func (s *memoryStore) TransactWithEvents(ops []state.Operation, events []*state.Event) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.outbox == nil {
+		return state.ErrNoOutbox
+	}
+
+	return s.transact(ops, events)
+}
+
+// Claim reads the events of the outbox that are neither sent nor failed
+// and holds them for the lease
+func (s *memoryStore) Claim(limit uint, lease time.Duration) ([]*state.Event, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.outbox == nil {
+		return nil, state.ErrNoOutbox
+	}
+
+	now := time.Now()
+
+	for _, ev := range s.outbox {
+		if ev.pending() && ev.claimedUntil.After(now) {
+			return []*state.Event{}, nil
+		}
+	}
+
+	events := []*state.Event{}
+
+	for _, ev := range s.outbox {
+		if !ev.pending() {
+			continue
+		}
+
+		ev.claimedUntil = now.Add(lease)
+
+		events = append(events, &state.Event{
+			Id:        ev.id,
+			EventName: ev.eventName,
+			Payload:   bytes.Clone(ev.payload),
+		})
+
+		if limit > 0 && uint(len(events)) >= limit {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+func (s *memoryStore) MarkSent(ids []uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sent := map[uint64]bool{}
+
+	for _, id := range ids {
+		sent[id] = true
+	}
+
+	now := time.Now()
+
+	for _, ev := range s.outbox {
+		if sent[ev.id] && ev.sentAt.IsZero() {
+			ev.sentAt = now
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) MarkFailed(id uint64, maxAttempts uint) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, ev := range s.outbox {
+		if ev.id != id || !ev.pending() {
+			continue
+		}
+
+		ev.claimedUntil = time.Time{}
+		ev.attempts++
+
+		if ev.attempts >= maxAttempts {
+			ev.failedAt = time.Now()
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Release(ids []uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	released := map[uint64]bool{}
+
+	for _, id := range ids {
+		released[id] = true
+	}
+
+	for _, ev := range s.outbox {
+		if released[ev.id] {
+			ev.claimedUntil = time.Time{}
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) transact(ops []state.Operation, events []*state.Event) error {
+	// a staged key without a record is deleted
+	staged := map[string]*record{}
+
+	for _, op := range ops {
+		key := op.Record.Key
+
+		r, ok := staged[key]
+		if !ok {
+			r = s.records[key]
+		}
+
+		if len(op.Etag) > 0 {
+			if r == nil || r.expired() || !state.Matches(r.value, r.meta(), op.Etag) {
+				return state.ErrEtagMismatch
+			}
+		}
+
+		if op.Delete {
+			staged[key] = nil
+		} else {
+			staged[key] = s.encode(op.Record, r)
+		}
+	}
+
+	for key, r := range staged {
+		if r == nil {
+			delete(s.records, key)
+		} else {
+			s.records[key] = r
+		}
+	}
+
+	for _, ev := range events {
+		s.lastEventId++
+
+		s.outbox = append(s.outbox, &event{
+			id:        s.lastEventId,
+			eventName: ev.EventName,
+			payload:   bytes.Clone(ev.Payload),
+		})
+	}
+
+	return nil
+}
+
+// ReadStamped reads the unexpired records of the keys with their metadata
+func (s *memoryStore) ReadStamped(keys []string) ([]*state.Stamped, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	stamped := []*state.Stamped{}
+
+	for _, key := range keys {
+		r, ok := s.records[key]
+		if !ok || r.expired() {
+			continue
+		}
+
+		stamped = append(stamped, &state.Stamped{
+			Record: decode(key, r),
+			Meta:   r.meta(),
+		})
+	}
+
+	return stamped, nil
+}
+
+// Reap deletes the expired records and returns how many there were.
+// The events of the outbox that were sent are deleted with them, while
+// the events that failed are kept.
+func (s *memoryStore) Reap() (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	reaped := 0
+
+	for k, r := range s.records {
+		if r.expired() {
+			delete(s.records, k)
+			reaped++
+		}
+	}
+
+	if s.outbox != nil {
+		kept := []*event{}
+
+		for _, ev := range s.outbox {
+			if ev.sentAt.IsZero() {
+				kept = append(kept, ev)
+			}
+		}
+
+		s.outbox = kept
+	}
+
+	return reaped, nil
+}
+
+func (s *memoryStore) Delete(key string, opts ...store.DeleteOption) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.records, key)
+
+	return nil
+}
+
+func (s *memoryStore) String() string {
+	return "memory"
+}
+
+// keys returns the sorted keys of the unexpired records that have
+// the prefix and the suffix
+func (s *memoryStore) keys(prefix, suffix string) []string {
+	keys := []string{}
+
+	for k, r := range s.records {
+		if r.expired() || !strings.HasPrefix(k, prefix) || !strings.HasSuffix(k, suffix) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// holds tells whether the unexpired record of the key has the version
+func (s *memoryStore) holds(key string, old *state.Meta) bool {
+	r, ok := s.records[key]
+	return ok && !r.expired() && old != nil && r.version == old.Version
+}
+
+func (r *record) expired() bool {
+	return !r.expiresAt.IsZero() && r.expiresAt.Before(time.Now())
+}
+
+func (r *record) meta() *state.Meta {
+	return &state.Meta{
+		CreatedAt: r.createdAt,
+		UpdatedAt: r.updatedAt,
+		Version:   r.version,
+	}
+}
+
+// records are copied in and out so that callers cannot change them.
+// A record that replaces an unexpired record keeps when it was created.
+func (s *memoryStore) encode(rec *store.Record, prev *record) *record {
+	now := time.Now()
+
+	s.revision++
+
+	r := &record{
+		value:     bytes.Clone(rec.Value),
+		createdAt: now,
+		updatedAt: now,
+		version:   s.revision,
+	}
+
+	if rec.Expiry != 0 {
+		r.expiresAt = now.Add(rec.Expiry)
+	}
+
+	if prev != nil && !prev.expired() {
+		r.createdAt = prev.createdAt
+	}
+
+	return r
+}
+
+func decode(key string, r *record) *store.Record {
+	rec := &store.Record{
+		Key:   key,
+		Value: bytes.Clone(r.value),
+	}
+
+	if !r.expiresAt.IsZero() {
+		rec.Expiry = time.Until(r.expiresAt)
+	}
+
+	return rec
+}
+
+func page(keys []string, limit, offset uint) []string {
+	if offset >= uint(len(keys)) {
+		return []string{}
+	}
+
+	keys = keys[offset:]
+
+	if limit > 0 && limit < uint(len(keys)) {
+		keys = keys[:limit]
+	}
+
+	return keys
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	options := store.NewStoreOptions(opts...)
+
+	s := &memoryStore{
+		options: options,
+		records: map[string]*record{},
+		mtx:     sync.RWMutex{},
+	}
+
+	for _, rec := range options.Seed {
+		if err := s.Write(rec); err != nil {
+			log.Fatalf("failed to seed database: %v", err)
+		}
+	}
+
+	return s
+}
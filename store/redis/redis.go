@@ -0,0 +1,617 @@
+// Package redis is a store that keeps records in redis. Each table
+// is a namespace of keys of form <database>:<table>:<key>, where each
+// key is a hash of the value of its record with when the record was
+// created and updated and its version. The version is taken from a
+// revision of the namespace that is kept beside it. Values that were
+// written as strings before the store kept metadata are read without.
+// The keys of the namespace are also kept in a sorted set beside it,
+// which pages read in key order. A key that expires stays in the set
+// until a page that reads past it finds it gone.
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/state"
+)
+
+const (
+	scanCount      = 100
+	pageBatchSize  = 100
+	requestTimeout = 10 * time.Second
+)
+
+var (
+	globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+	// current reads the version of a key, which is empty for a string
+	// written before the store kept metadata, and stamp writes a value
+	// with its metadata, keeping when an unexpired record was created
+	functions = `
+local function current(key)
+	local t = redis.call("TYPE", key)["ok"]
+	if t == "hash" then
+		return redis.call("HGET", key, "version")
+	elseif t == "string" then
+		return ""
+	end
+	return false
+end
+
+local function stamp(key, revision, index, member, value, px, now)
+	local created = now
+	if redis.call("TYPE", key)["ok"] == "hash" then
+		created = redis.call("HGET", key, "created") or now
+	end
+	local version = redis.call("INCR", revision)
+	redis.call("DEL", key)
+	redis.call("HSET", key, "value", value, "created", created, "updated", now, "version", version)
+	if px ~= "0" then
+		redis.call("PEXPIRE", key, px)
+	end
+	redis.call("ZADD", index, 0, member)
+end
+`
+
+	writeScript = goredis.NewScript(functions + `
+stamp(KEYS[1], KEYS[2], KEYS[3], ARGV[1], ARGV[2], ARGV[3], ARGV[4])
+return 1
+`)
+
+	// the scripts compare the version and then write or delete in one step
+	swapScript = goredis.NewScript(functions + `
+if current(KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+stamp(KEYS[1], KEYS[2], KEYS[3], ARGV[2], ARGV[3], ARGV[4], ARGV[5])
+return 1
+`)
+
+	deleteScript = goredis.NewScript(functions + `
+if current(KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+redis.call("ZREM", KEYS[2], ARGV[2])
+return 1
+`)
+
+	// pruneScript removes the keys of the index whose records are gone,
+	// which is checked in the script so that a key that is written in
+	// between stays
+	pruneScript = goredis.NewScript(`
+for i, member in ipairs(ARGV) do
+	if redis.call("EXISTS", KEYS[1] .. member) == 0 then
+		redis.call("ZREM", KEYS[2], member)
+	end
+end
+return 1
+`)
+
+	// readScript reads the value, metadata, and ttl of every key and
+	// false for the keys that do not exist
+	readScript = goredis.NewScript(`
+local records = {}
+for i, key in ipairs(KEYS) do
+	local t = redis.call("TYPE", key)["ok"]
+	if t == "hash" then
+		local fields = redis.call("HMGET", key, "value", "created", "updated", "version")
+		records[i] = {fields[1], fields[2], fields[3], fields[4], redis.call("PTTL", key)}
+	elseif t == "string" then
+		records[i] = {redis.call("GET", key), false, false, false, redis.call("PTTL", key)}
+	else
+		records[i] = false
+	end
+end
+return records
+`)
+)
+
+type redisStore struct {
+	options   store.StoreOptions
+	client    *goredis.Client
+	namespace string
+	// the key of the revision of the namespace
+	revision string
+	// the key of the sorted set of the keys of the namespace
+	index string
+}
+
+func (s *redisStore) Options() store.StoreOptions {
+	return s.options
+}
+
+func (s *redisStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	return writeScript.Run(ctx, s.client, []string{s.namespace + rec.Key, s.revision, s.index}, rec.Key, rec.Value, px(rec.Expiry), now()).Err()
+}
+
+func (s *redisStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	options := store.NewReadOptions(opts...)
+
+	// read many; otherwise, read one
+	if options.Prefix || options.Suffix {
+		return s.read(key, options)
+	}
+
+	records, err := s.get([]string{key})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return records, store.ErrRecordNotFound
+	}
+
+	return records, nil
+}
+
+func (s *redisStore) read(key string, options store.ReadOptions) ([]*store.Record, error) {
+	prefix := ""
+
+	if options.Prefix {
+		prefix = key
+	}
+
+	suffix := ""
+
+	if options.Suffix {
+		suffix = key
+	}
+
+	keys, err := s.scan(prefix, suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.get(page(keys, options.Limit, options.Offset))
+}
+
+func (s *redisStore) List(opts ...store.ListOption) ([]string, error) {
+	options := store.NewListOptions(opts...)
+
+	keys, err := s.scan(options.Prefix, options.Suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return page(keys, options.Limit, options.Offset), nil
+}
+
+// Page reads the records whose keys have the prefix in key order after
+// a key from the sorted set of the keys of the namespace, so that only
+// the keys of the page are read. The keys of records that are gone are
+// removed from the set as the page reads past them.
+func (s *redisStore) Page(prefix, after string, limit uint) ([]*store.Record, error) {
+	min := "[" + prefix
+
+	if after >= prefix {
+		min = "(" + after
+	}
+
+	max := lexEnd(prefix)
+
+	records := []*store.Record{}
+
+	for {
+		n := uint(pageBatchSize)
+
+		if limit > 0 && limit-uint(len(records)) < n {
+			n = limit - uint(len(records))
+		}
+
+		keys, err := s.rangeKeys(min, max, n)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keys) == 0 {
+			return records, nil
+		}
+
+		batch, err := s.get(keys)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(batch) < len(keys) {
+			if err := s.prune(keys, batch); err != nil {
+				return nil, err
+			}
+		}
+
+		records = append(records, batch...)
+
+		if uint(len(keys)) < n || (limit > 0 && uint(len(records)) >= limit) {
+			return records, nil
+		}
+
+		min = "(" + keys[len(keys)-1]
+	}
+}
+
+func (s *redisStore) CompareAndSwap(rec *store.Record, old *state.Meta) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	n, err := swapScript.Run(ctx, s.client, []string{s.namespace + rec.Key, s.revision, s.index}, version(old), rec.Key, rec.Value, px(rec.Expiry), now()).Int()
+
+	return n == 1, err
+}
+
+func (s *redisStore) CompareAndDelete(key string, old *state.Meta) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	n, err := deleteScript.Run(ctx, s.client, []string{s.namespace + key, s.index}, version(old), key).Int()
+
+	return n == 1, err
+}
+
+func (s *redisStore) Delete(key string, opts ...store.DeleteOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := s.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Del(ctx, s.namespace+key)
+		pipe.ZRem(ctx, s.index, key)
+		return nil
+	})
+
+	return err
+}
+
+func (s *redisStore) String() string {
+	return "redis"
+}
+
+// Close closes the connection pool of the store
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+// ReadStamped reads the unexpired records of the keys with their
+// metadata
+func (s *redisStore) ReadStamped(keys []string) ([]*state.Stamped, error) {
+	return s.load(keys)
+}
+
+// get reads the records of keys in one round trip and skips the
+// keys that no longer exist
+func (s *redisStore) get(keys []string) ([]*store.Record, error) {
+	stamped, err := s.load(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*store.Record{}
+
+	for _, stamp := range stamped {
+		records = append(records, stamp.Record)
+	}
+
+	return records, nil
+}
+
+// load reads the records of keys with their metadata in one round
+// trip and skips the keys that no longer exist
+func (s *redisStore) load(keys []string) ([]*state.Stamped, error) {
+	stamped := []*state.Stamped{}
+
+	if len(keys) == 0 {
+		return stamped, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	namespaced := make([]string, len(keys))
+
+	for i, k := range keys {
+		namespaced[i] = s.namespace + k
+	}
+
+	rsp, err := readScript.Run(ctx, s.client, namespaced).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range rsp {
+		fields, ok := r.([]interface{})
+		if !ok || len(fields) != 5 {
+			continue
+		}
+
+		value, ok := fields[0].(string)
+		if !ok {
+			continue
+		}
+
+		record := &store.Record{
+			Key:   keys[i],
+			Value: []byte(value),
+		}
+
+		// a negative ttl means the key does not expire
+		if ttl, ok := fields[4].(int64); ok && ttl > 0 {
+			record.Expiry = time.Duration(ttl) * time.Millisecond
+		}
+
+		meta, err := decodeMeta(fields[1], fields[2], fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("record %s has invalid metadata: %v", keys[i], err)
+		}
+
+		stamped = append(stamped, &state.Stamped{
+			Record: record,
+			Meta:   meta,
+		})
+	}
+
+	return stamped, nil
+}
+
+// rangeKeys reads at most n keys of the sorted set of the keys of the
+// namespace within a range
+func (s *redisStore) rangeKeys(min, max string, n uint) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	return s.client.ZRangeByLex(ctx, s.index, &goredis.ZRangeBy{
+		Min:   min,
+		Max:   max,
+		Count: int64(n),
+	}).Result()
+}
+
+// prune removes the keys whose records were not read from the sorted
+// set of the keys of the namespace when the records are gone
+func (s *redisStore) prune(keys []string, records []*store.Record) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	read := map[string]bool{}
+
+	for _, rec := range records {
+		read[rec.Key] = true
+	}
+
+	gone := []interface{}{}
+
+	for _, key := range keys {
+		if !read[key] {
+			gone = append(gone, key)
+		}
+	}
+
+	return pruneScript.Run(ctx, s.client, []string{s.namespace, s.index}, gone...).Err()
+}
+
+// scan returns the sorted keys of the namespace that have the prefix
+// and the suffix
+func (s *redisStore) scan(prefix, suffix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	match := globEscaper.Replace(s.namespace+prefix) + "*" + globEscaper.Replace(suffix)
+
+	keys := []string{}
+
+	iter := s.client.Scan(ctx, 0, match, scanCount).Iterator()
+
+	for iter.Next(ctx) {
+		if iter.Val() == s.revision || iter.Val() == s.index {
+			continue
+		}
+
+		keys = append(keys, strings.TrimPrefix(iter.Val(), s.namespace))
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (s *redisStore) configure() error {
+	address := ""
+
+	if len(s.options.Nodes) > 0 {
+		address = s.options.Nodes[0]
+	}
+
+	opts := &goredis.Options{
+		Addr: address,
+	}
+
+	if strings.Contains(address, "://") {
+		var err error
+
+		opts, err = goredis.ParseURL(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.client = goredis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		return err
+	}
+
+	for _, part := range []string{s.options.Database, s.options.Table} {
+		if len(part) > 0 {
+			s.namespace += part + ":"
+		}
+	}
+
+	// the revision and the index sit outside of the namespace so
+	// that they are not scanned with the keys of the records
+	s.revision = strings.TrimSuffix(s.namespace, ":") + "$revision"
+	s.index = strings.TrimSuffix(s.namespace, ":") + "$keys"
+
+	return s.initIndex()
+}
+
+// initIndex adds the keys of the namespace to its sorted set when there
+// is none, such as when the records were written before there was one
+func (s *redisStore) initIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if n, err := s.client.Exists(ctx, s.index).Result(); err != nil || n > 0 {
+		return err
+	}
+
+	keys, err := s.scan("", "")
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(keys); start += scanCount {
+		end := start + scanCount
+
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		if err := s.addKeys(keys[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addKeys adds the keys to the sorted set of the keys of the namespace
+// with a deadline of its own so that a large namespace does not time
+// out partway through
+func (s *redisStore) addKeys(keys []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	members := []goredis.Z{}
+
+	for _, key := range keys {
+		members = append(members, goredis.Z{Member: key})
+	}
+
+	return s.client.ZAdd(ctx, s.index, members...).Err()
+}
+
+// decodeMeta returns the metadata of the fields of a hash or nil when
+// the record was written before the store kept metadata
+func decodeMeta(created, updated, version interface{}) (*state.Meta, error) {
+	c, ok := created.(string)
+	if !ok {
+		return nil, nil
+	}
+
+	u, _ := updated.(string)
+	v, _ := version.(string)
+
+	createdAt, err := strconv.ParseInt(c, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	updatedAt, err := strconv.ParseInt(u, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state.Meta{
+		CreatedAt: time.Unix(0, createdAt),
+		UpdatedAt: time.Unix(0, updatedAt),
+		Version:   n,
+	}, nil
+}
+
+// version is the version of the metadata of a record that was read,
+// which is empty for a record that was read without metadata
+func version(meta *state.Meta) string {
+	if meta == nil {
+		return ""
+	}
+
+	return strconv.FormatUint(meta.Version, 10)
+}
+
+// px is the expiry in milliseconds, where an expiry of less than a
+// millisecond still expires and 0 never does
+func px(expiry time.Duration) string {
+	if expiry > 0 && expiry < time.Millisecond {
+		expiry = time.Millisecond
+	}
+
+	return strconv.FormatInt(expiry.Milliseconds(), 10)
+}
+
+// now is the time of a write in nanoseconds since the epoch
+func now() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// lexEnd is the end of the range of the keys that have the prefix,
+// which is the prefix with its last byte that can grow grown
+func lexEnd(prefix string) string {
+	end := []byte(prefix)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return "(" + string(end[:i+1])
+		}
+	}
+
+	return "+"
+}
+
+func page(keys []string, limit, offset uint) []string {
+	if offset >= uint(len(keys)) {
+		return []string{}
+	}
+
+	keys = keys[offset:]
+
+	if limit > 0 && limit < uint(len(keys)) {
+		keys = keys[:limit]
+	}
+
+	return keys
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	options := store.NewStoreOptions(opts...)
+
+	s := &redisStore{
+		options: options,
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
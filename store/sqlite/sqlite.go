@@ -0,0 +1,873 @@
+// Package sqlite is a store that keeps records in a sqlite database file.
+// The address of the store is the path to the file and each table holds
+// the records of one store in the same key, value, expiry, and metadata
+// shape as the cockroach store so that it can be queried with the usual
+// tooling. The outbox of a table is the table of its name suffixed by
+// _outbox and its revision, which is the version of the record that is
+// written, is kept in the table of its name suffixed by _revision.
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/sidecar/state"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	defaultPath    = "sidecar.db"
+	defaultTable   = "records"
+	busyTimeout    = 5 * time.Second
+	outboxSuffix   = "_outbox"
+	revisionSuffix = "_revision"
+)
+
+var (
+	// the stores that share a file share its pool so that
+	// writers queue up rather than fail on a locked file, and
+	// the pool is closed once the last of them is closed
+	clients    = map[string]*pool{}
+	clientsMtx sync.Mutex
+
+	likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+)
+
+type pool struct {
+	client *sql.DB
+	refs   int
+}
+
+type sqliteStore struct {
+	options   store.StoreOptions
+	path      string
+	client    *sql.DB
+	table     string
+	write     *sql.Stmt
+	readOne   *sql.Stmt
+	readMeta  *sql.Stmt
+	readMany  *sql.Stmt
+	page      *sql.Stmt
+	pageSince *sql.Stmt
+	list      *sql.Stmt
+	delete    *sql.Stmt
+	swap      *sql.Stmt
+	cad       *sql.Stmt
+	reap      *sql.Stmt
+	// the outbox is nil until it is opened
+	outbox    *outbox
+	outboxMtx sync.RWMutex
+}
+
+type outbox struct {
+	insert     *sql.Stmt
+	claim      *sql.Stmt
+	markSent   *sql.Stmt
+	markFailed *sql.Stmt
+	release    *sql.Stmt
+	reap       *sql.Stmt
+}
+
+func (s *sqliteStore) Options() store.StoreOptions {
+	return s.options
+}
+
+func (s *sqliteStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	var expiry sql.NullTime
+
+	if rec.Expiry != 0 {
+		expiry = sql.NullTime{Time: time.Now().Add(rec.Expiry).UTC(), Valid: true}
+	}
+
+	_, err := s.write.Exec(rec.Key, rec.Value, expiry, time.Now().UTC())
+
+	return err
+}
+
+func (s *sqliteStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	options := store.NewReadOptions(opts...)
+
+	// read many; otherwise, read one
+	if options.Prefix || options.Suffix {
+		return s.read(key, options)
+	}
+
+	records := []*store.Record{}
+
+	var expiry sql.NullTime
+
+	record := &store.Record{}
+
+	if err := s.readOne.QueryRow(key).Scan(&record.Key, &record.Value, &expiry); err != nil {
+		if err == sql.ErrNoRows {
+			return records, store.ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	// if the record has expired, then delete it instead
+	if expiry.Valid {
+		if expiry.Time.Before(time.Now()) {
+			go s.Delete(record.Key)
+			return records, store.ErrRecordNotFound
+		}
+		record.Expiry = time.Until(expiry.Time)
+	}
+
+	return append(records, record), nil
+}
+
+func (s *sqliteStore) read(key string, options store.ReadOptions) ([]*store.Record, error) {
+	pattern := "%"
+
+	if options.Prefix {
+		pattern = likeEscaper.Replace(key) + pattern
+	}
+
+	if options.Suffix {
+		pattern = pattern + likeEscaper.Replace(key)
+	}
+
+	rows, err := s.readMany.Query(pattern, limit(options.Limit), options.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scan(rows)
+}
+
+func (s *sqliteStore) Page(prefix, after string, l uint) ([]*store.Record, error) {
+	rows, err := s.page.Query(likeEscaper.Replace(prefix)+"%", after, limit(l))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scan(rows)
+}
+
+// PageSince reads a page of the records that were updated at or after
+// the time
+func (s *sqliteStore) PageSince(prefix, after string, updatedSince time.Time, l uint) ([]*store.Record, error) {
+	rows, err := s.pageSince.Query(likeEscaper.Replace(prefix)+"%", after, updatedSince.UTC(), time.Now().UTC(), limit(l))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scan(rows)
+}
+
+func (s *sqliteStore) List(opts ...store.ListOption) ([]string, error) {
+	options := store.NewListOptions(opts...)
+
+	pattern := likeEscaper.Replace(options.Prefix) + "%" + likeEscaper.Replace(options.Suffix)
+
+	rows, err := s.list.Query(pattern, time.Now().UTC(), limit(options.Limit), options.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+
+	for rows.Next() {
+		var key string
+
+		if err := rows.Scan(&key); err != nil {
+			return keys, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) CompareAndSwap(rec *store.Record, old *state.Meta) (bool, error) {
+	var expiry sql.NullTime
+
+	if rec.Expiry != 0 {
+		expiry = sql.NullTime{Time: time.Now().Add(rec.Expiry).UTC(), Valid: true}
+	}
+
+	res, err := s.swap.Exec(rec.Key, rec.Value, expiry, version(old), time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return n == 1, err
+}
+
+func (s *sqliteStore) CompareAndDelete(key string, old *state.Meta) (bool, error) {
+	res, err := s.cad.Exec(key, version(old))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return n == 1, err
+}
+
+// Transact applies the operations in one transaction, which takes the
+// write lock of the file up front so that it cannot deadlock with
+// another transaction that read before writing
+func (s *sqliteStore) Transact(ops []state.Operation) error {
+	return s.transact(ops, nil)
+}
+
+func (s *sqliteStore) OpenOutbox() error {
+	s.outboxMtx.Lock()
+	defer s.outboxMtx.Unlock()
+
+	if s.outbox != nil {
+		return nil
+	}
+
+	table := s.table + outboxSuffix
+
+	if _, err := s.client.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+	(
+		id integer PRIMARY KEY AUTOINCREMENT,
+		event_name text NOT NULL,
+		payload blob,
+		created_at timestamp,
+		sent_at timestamp,
+		claimed_until timestamp,
+		attempts integer NOT NULL DEFAULT 0,
+		failed_at timestamp
+	);`, table)); err != nil {
+		return err
+	}
+
+	// outboxes that were created before events were claimed get the columns
+	if err := s.migrate(table, []string{"claimed_until timestamp", "attempts integer NOT NULL DEFAULT 0", "failed_at timestamp"}); err != nil {
+		return err
+	}
+
+	if _, err := s.client.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_pending ON %s (id) WHERE sent_at IS NULL;", table, table)); err != nil {
+		return err
+	}
+
+	ob := &outbox{}
+
+	var err error
+
+	if ob.insert, err = s.client.Prepare(fmt.Sprintf("INSERT INTO %s(event_name, payload, created_at) VALUES ($1, $2, $3);", table)); err != nil {
+		return err
+	}
+
+	// one statement claims the events so that no other claim comes in between
+	if ob.claim, err = s.client.Prepare(fmt.Sprintf(`UPDATE %s SET claimed_until = $2
+		WHERE id IN (SELECT id FROM %s WHERE sent_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT $3)
+		AND NOT EXISTS (SELECT 1 FROM %s WHERE sent_at IS NULL AND failed_at IS NULL AND claimed_until > $1)
+		RETURNING id, event_name, payload;`, table, table, table)); err != nil {
+		return err
+	}
+
+	if ob.markSent, err = s.client.Prepare(fmt.Sprintf("UPDATE %s SET sent_at = $2 WHERE id = $1 AND sent_at IS NULL;", table)); err != nil {
+		return err
+	}
+
+	if ob.markFailed, err = s.client.Prepare(fmt.Sprintf(`UPDATE %s SET claimed_until = NULL, attempts = attempts + 1,
+		failed_at = CASE WHEN attempts + 1 >= $2 THEN $3 END
+		WHERE id = $1 AND sent_at IS NULL AND failed_at IS NULL;`, table)); err != nil {
+		return err
+	}
+
+	if ob.release, err = s.client.Prepare(fmt.Sprintf("UPDATE %s SET claimed_until = NULL WHERE id = $1;", table)); err != nil {
+		return err
+	}
+
+	if ob.reap, err = s.client.Prepare(fmt.Sprintf("DELETE FROM %s WHERE sent_at IS NOT NULL;", table)); err != nil {
+		return err
+	}
+
+	s.outbox = ob
+
+	return nil
+}
+
+// TransactWithEvents applies the operations like Transact and inserts
+// the events into the outbox in the same transaction
+func (s *sqliteStore) TransactWithEvents(ops []state.Operation, events []*state.Event) error {
+	if s.getOutbox() == nil {
+		return state.ErrNoOutbox
+	}
+
+	return s.transact(ops, events)
+}
+
+// Claim reads the events of the outbox that are neither sent nor failed
+// and holds them for the lease
+func (s *sqliteStore) Claim(l uint, lease time.Duration) ([]*state.Event, error) {
+	ob := s.getOutbox()
+	if ob == nil {
+		return nil, state.ErrNoOutbox
+	}
+
+	now := time.Now().UTC()
+
+	rows, err := ob.claim.Query(now, now.Add(lease), limit(l))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*state.Event{}
+
+	for rows.Next() {
+		ev := &state.Event{}
+
+		if err := rows.Scan(&ev.Id, &ev.EventName, &ev.Payload); err != nil {
+			return nil, err
+		}
+
+		events = append(events, ev)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the rows that are returned are not in any order
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id < events[j].Id
+	})
+
+	return events, nil
+}
+
+func (s *sqliteStore) MarkSent(ids []uint64) error {
+	ob := s.getOutbox()
+	if ob == nil {
+		return state.ErrNoOutbox
+	}
+
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	for _, id := range ids {
+		if _, err := tx.Stmt(ob.markSent).Exec(id, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) MarkFailed(id uint64, maxAttempts uint) error {
+	ob := s.getOutbox()
+	if ob == nil {
+		return state.ErrNoOutbox
+	}
+
+	_, err := ob.markFailed.Exec(id, maxAttempts, time.Now().UTC())
+
+	return err
+}
+
+func (s *sqliteStore) Release(ids []uint64) error {
+	ob := s.getOutbox()
+	if ob == nil {
+		return state.ErrNoOutbox
+	}
+
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.Stmt(ob.release).Exec(id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) getOutbox() *outbox {
+	s.outboxMtx.RLock()
+	defer s.outboxMtx.RUnlock()
+
+	return s.outbox
+}
+
+func (s *sqliteStore) transact(ops []state.Operation, events []*state.Event) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, op := range ops {
+		key := op.Record.Key
+
+		if len(op.Etag) > 0 {
+			if ok, err := s.tagged(tx, key, op.Etag); err != nil {
+				return err
+			} else if !ok {
+				return state.ErrEtagMismatch
+			}
+		}
+
+		if op.Delete {
+			_, err = tx.Stmt(s.delete).Exec(key)
+		} else {
+			var expiry sql.NullTime
+
+			if op.Record.Expiry != 0 {
+				expiry = sql.NullTime{Time: time.Now().Add(op.Record.Expiry).UTC(), Valid: true}
+			}
+
+			_, err = tx.Stmt(s.write).Exec(key, op.Record.Value, expiry, time.Now().UTC())
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(events) > 0 {
+		insert := tx.Stmt(s.getOutbox().insert)
+
+		for _, ev := range events {
+			if _, err := insert.Exec(ev.EventName, ev.Payload, time.Now().UTC()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// tagged tells whether the unexpired record of the key has the etag
+func (s *sqliteStore) tagged(tx *sql.Tx, key, etag string) (bool, error) {
+	stamp, err := s.stamped(tx, key)
+	if err != nil || stamp == nil {
+		return false, err
+	}
+
+	return state.Matches(stamp.Record.Value, stamp.Meta, etag), nil
+}
+
+// ReadStamped reads the unexpired records of the keys with their
+// metadata in one transaction
+func (s *sqliteStore) ReadStamped(keys []string) ([]*state.Stamped, error) {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stamped := []*state.Stamped{}
+
+	for _, key := range keys {
+		stamp, err := s.stamped(tx, key)
+		if err != nil {
+			return nil, err
+		} else if stamp == nil {
+			continue
+		}
+
+		stamped = append(stamped, stamp)
+	}
+
+	return stamped, tx.Commit()
+}
+
+// stamped reads the unexpired record of the key with its metadata or
+// nil when there is none
+func (s *sqliteStore) stamped(tx *sql.Tx, key string) (*state.Stamped, error) {
+	var expiry, createdAt, updatedAt sql.NullTime
+
+	var version sql.NullInt64
+
+	record := &store.Record{}
+
+	if err := tx.Stmt(s.readMeta).QueryRow(key).Scan(&record.Key, &record.Value, &expiry, &createdAt, &updatedAt, &version); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if expiry.Valid {
+		if expiry.Time.Before(time.Now()) {
+			return nil, nil
+		}
+		record.Expiry = time.Until(expiry.Time)
+	}
+
+	stamp := &state.Stamped{
+		Record: record,
+	}
+
+	// records that were written before there was metadata have none
+	if version.Valid {
+		stamp.Meta = &state.Meta{
+			CreatedAt: createdAt.Time,
+			UpdatedAt: updatedAt.Time,
+			Version:   uint64(version.Int64),
+		}
+	}
+
+	return stamp, nil
+}
+
+// Reap deletes the expired records and returns how many there were.
+// The events of the outbox that were sent are deleted with them, while
+// the events that failed are kept.
+func (s *sqliteStore) Reap() (int, error) {
+	res, err := s.reap.Exec(time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if ob := s.getOutbox(); ob != nil {
+		if _, err := ob.reap.Exec(); err != nil {
+			return int(n), err
+		}
+	}
+
+	return int(n), nil
+}
+
+func (s *sqliteStore) Delete(key string, opts ...store.DeleteOption) error {
+	_, err := s.delete.Exec(key)
+	return err
+}
+
+func (s *sqliteStore) String() string {
+	return "sqlite"
+}
+
+// Close closes the statements of the store and releases the pool of
+// its file
+func (s *sqliteStore) Close() error {
+	stmts := []*sql.Stmt{s.write, s.readOne, s.readMeta, s.readMany, s.page, s.pageSince, s.list, s.delete, s.swap, s.cad, s.reap}
+
+	if ob := s.getOutbox(); ob != nil {
+		stmts = append(stmts, ob.insert, ob.claim, ob.markSent, ob.markFailed, ob.release, ob.reap)
+	}
+
+	for _, stmt := range stmts {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+
+	return release(s.path)
+}
+
+func (s *sqliteStore) configure() error {
+	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		return errors.New("failed to compile regex for table names")
+	}
+
+	s.table = reg.ReplaceAllString(s.options.Table, "_")
+	if len(s.table) == 0 {
+		s.table = defaultTable
+	}
+
+	s.path = defaultPath
+	if len(s.options.Nodes) > 0 && len(s.options.Nodes[0]) > 0 {
+		s.path = s.options.Nodes[0]
+	}
+
+	client, err := open(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.client = client
+
+	return s.initDB()
+}
+
+func (s *sqliteStore) initDB() error {
+	if _, err := s.client.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+	(
+		key text NOT NULL,
+		value blob,
+		expiry timestamp,
+		created_at timestamp,
+		updated_at timestamp,
+		version integer,
+		CONSTRAINT %s_pkey PRIMARY KEY (key)
+	);`, s.table, s.table)); err != nil {
+		return err
+	}
+
+	if err := s.migrate(s.table, []string{"created_at timestamp", "updated_at timestamp", "version integer"}); err != nil {
+		return err
+	}
+
+	if err := s.revise(); err != nil {
+		return err
+	}
+
+	revision := s.table + revisionSuffix
+
+	// a record that replaces an unexpired record keeps when it was
+	// created and every record that is written is the next revision
+	write, err := s.client.Prepare(fmt.Sprintf(`INSERT INTO %s(key, value, expiry, created_at, updated_at, version)
+		VALUES ($1, $2, $3, $4, $4, (SELECT revision + 1 FROM %s))
+		ON CONFLICT (key)
+		DO UPDATE
+		SET value = EXCLUDED.value, expiry = EXCLUDED.expiry, updated_at = EXCLUDED.updated_at, version = EXCLUDED.version,
+			created_at = CASE WHEN %s.expiry IS NOT NULL AND %s.expiry <= EXCLUDED.updated_at THEN EXCLUDED.created_at ELSE COALESCE(%s.created_at, EXCLUDED.created_at) END;`,
+		s.table, revision, s.table, s.table, s.table))
+	if err != nil {
+		return err
+	}
+	s.write = write
+
+	readOne, err := s.client.Prepare(fmt.Sprintf("SELECT key, value, expiry FROM %s WHERE key = $1;", s.table))
+	if err != nil {
+		return err
+	}
+	s.readOne = readOne
+
+	readMeta, err := s.client.Prepare(fmt.Sprintf("SELECT key, value, expiry, created_at, updated_at, version FROM %s WHERE key = $1;", s.table))
+	if err != nil {
+		return err
+	}
+	s.readMeta = readMeta
+
+	readMany, err := s.client.Prepare(fmt.Sprintf(`SELECT key, value, expiry FROM %s WHERE key LIKE $1 ESCAPE '\' ORDER BY key LIMIT $2 OFFSET $3;`, s.table))
+	if err != nil {
+		return err
+	}
+	s.readMany = readMany
+
+	page, err := s.client.Prepare(fmt.Sprintf(`SELECT key, value, expiry FROM %s WHERE key LIKE $1 ESCAPE '\' AND key > $2 ORDER BY key LIMIT $3;`, s.table))
+	if err != nil {
+		return err
+	}
+	s.page = page
+
+	pageSince, err := s.client.Prepare(fmt.Sprintf(`SELECT key, value, expiry FROM %s WHERE key LIKE $1 ESCAPE '\' AND key > $2 AND updated_at >= $3 AND (expiry IS NULL OR expiry > $4) ORDER BY key LIMIT $5;`, s.table))
+	if err != nil {
+		return err
+	}
+	s.pageSince = pageSince
+
+	list, err := s.client.Prepare(fmt.Sprintf(`SELECT key FROM %s WHERE key LIKE $1 ESCAPE '\' AND (expiry IS NULL OR expiry > $2) ORDER BY key LIMIT $3 OFFSET $4;`, s.table))
+	if err != nil {
+		return err
+	}
+	s.list = list
+
+	delete, err := s.client.Prepare(fmt.Sprintf("DELETE FROM %s WHERE key = $1;", s.table))
+	if err != nil {
+		return err
+	}
+	s.delete = delete
+
+	swap, err := s.client.Prepare(fmt.Sprintf("UPDATE %s SET value = $2, expiry = $3, updated_at = $5, created_at = COALESCE(created_at, $5), version = (SELECT revision + 1 FROM %s) WHERE key = $1 AND version IS $4;", s.table, revision))
+	if err != nil {
+		return err
+	}
+	s.swap = swap
+
+	cad, err := s.client.Prepare(fmt.Sprintf("DELETE FROM %s WHERE key = $1 AND version IS $2;", s.table))
+	if err != nil {
+		return err
+	}
+	s.cad = cad
+
+	reap, err := s.client.Prepare(fmt.Sprintf("DELETE FROM %s WHERE expiry IS NOT NULL AND expiry <= $1;", s.table))
+	if err != nil {
+		return err
+	}
+	s.reap = reap
+
+	return nil
+}
+
+// migrate adds the columns that the table is missing, such as the
+// metadata columns of tables that were created before there was metadata
+func (s *sqliteStore) migrate(table string, columns []string) error {
+	for _, column := range columns {
+		name, _, _ := strings.Cut(column, " ")
+
+		var n int
+
+		if err := s.client.QueryRow("SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2;", table, name).Scan(&n); err != nil {
+			return err
+		}
+
+		if n > 0 {
+			continue
+		}
+
+		if _, err := s.client.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", table, column)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revise keeps the revision of the table, which starts after the
+// versions of its records that were counted one record at a time
+// before there was a revision, and moves it to the version of every
+// record that is written
+func (s *sqliteStore) revise() error {
+	revision := s.table + revisionSuffix
+
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (revision integer NOT NULL);", revision),
+		fmt.Sprintf("INSERT INTO %s (revision) SELECT COALESCE(MAX(version), 0) FROM %s WHERE NOT EXISTS (SELECT 1 FROM %s);", revision, s.table, revision),
+		fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS %s_insert AFTER INSERT ON %s BEGIN UPDATE %s SET revision = NEW.version WHERE NEW.version > revision; END;", revision, s.table, revision),
+		fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS %s_update AFTER UPDATE OF version ON %s BEGIN UPDATE %s SET revision = NEW.version WHERE NEW.version > revision; END;", revision, s.table, revision),
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func open(path string) (*sql.DB, error) {
+	clientsMtx.Lock()
+	defer clientsMtx.Unlock()
+
+	if p, ok := clients[path]; ok {
+		p.refs++
+		return p.client, nil
+	}
+
+	if dir := filepath.Dir(path); len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	// like matches case sensitively on every connection so
+	// that a prefix only matches the keys that start with it
+	client, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_pragma=case_sensitive_like(1)&_time_format=sqlite&_txlock=immediate", path, busyTimeout.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(); err != nil {
+		return nil, err
+	}
+
+	clients[path] = &pool{client: client, refs: 1}
+
+	return client, nil
+}
+
+func release(path string) error {
+	clientsMtx.Lock()
+	defer clientsMtx.Unlock()
+
+	p, ok := clients[path]
+	if !ok {
+		return nil
+	}
+
+	p.refs--
+
+	if p.refs > 0 {
+		return nil
+	}
+
+	delete(clients, path)
+
+	return p.client.Close()
+}
+
+func (s *sqliteStore) scan(rows *sql.Rows) ([]*store.Record, error) {
+	defer rows.Close()
+
+	records := []*store.Record{}
+
+	for rows.Next() {
+		var expiry sql.NullTime
+
+		record := &store.Record{}
+
+		if err := rows.Scan(&record.Key, &record.Value, &expiry); err != nil {
+			return records, err
+		}
+
+		if expiry.Valid {
+			if expiry.Time.Before(time.Now()) {
+				go s.Delete(record.Key)
+				continue
+			}
+			record.Expiry = time.Until(expiry.Time)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// limit maps no limit to the -1 that sqlite expects
+// version is the version of the metadata of a record that was read,
+// which is null for a record that was read without metadata
+func version(meta *state.Meta) sql.NullInt64 {
+	if meta == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: int64(meta.Version), Valid: true}
+}
+
+func limit(l uint) int64 {
+	if l == 0 {
+		return -1
+	}
+
+	return int64(l)
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	options := store.NewStoreOptions(opts...)
+
+	s := &sqliteStore{
+		options: options,
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
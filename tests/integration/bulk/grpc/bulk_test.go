@@ -0,0 +1,241 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test bulk-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "bulk")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir)), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+			"BULK_PARALLELISM": "4",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("bulk"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestBulkGetGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		t.Logf("bulk get with store %s", storeName)
+
+		keys := []string{}
+
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key%02d", i)
+
+			err := post(grpcClient, storeName, key, fmt.Sprintf("%d", i), "")
+			require.NoError(t, err)
+
+			keys = append(keys, key)
+		}
+
+		// every other key is missing and the first key is asked for twice
+		asked := []string{}
+
+		for i := len(keys) - 1; i >= 0; i-- {
+			asked = append(asked, keys[i], fmt.Sprintf("missing%02d", i))
+		}
+
+		asked = append(asked, keys[len(keys)-1])
+
+		rsp, err := bulkGet(grpcClient, storeName, asked)
+		require.NoError(t, err)
+		require.Len(t, rsp.Records, len(keys))
+		require.Len(t, rsp.Missing, len(keys))
+
+		for i, record := range rsp.Records {
+			n := len(keys) - 1 - i
+			require.Equal(t, keys[n], record.Key)
+			require.Equal(t, fmt.Sprintf("%d", n), string(record.Value.Value))
+			require.NotEmpty(t, record.Etag)
+			require.Equal(t, fmt.Sprintf("missing%02d", n), rsp.Missing[i])
+		}
+
+		rsp, err = bulkGet(grpcClient, storeName, []string{})
+		require.NoError(t, err)
+		require.Empty(t, rsp.Records)
+		require.Empty(t, rsp.Missing)
+
+		_, err = bulkGet(grpcClient, storeName, []string{"key00", ""})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	_, err := bulkGet(grpcClient, "nosuchtable", []string{"key00"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func bulkGet(grpcClient client.Client, storeName string, keys []string) (*pbState.BulkGetStateResponse, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.BulkGet"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.BulkGetStateRequest{
+				StoreId: storeName,
+				Keys:    keys,
+			},
+		),
+	)
+
+	rsp := &pbState.BulkGetStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+func post(grpcClient client.Client, storeName, key, value, etag string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: []*pbState.KeyVal{
+					{
+						Key: key,
+						Value: &anypb.Any{
+							Value: []byte(value),
+						},
+						Etag: etag,
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
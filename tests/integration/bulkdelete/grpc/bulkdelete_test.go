@@ -0,0 +1,325 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+  - name: redistable
+    type: redis
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test bulkdelete-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "bulkdelete")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir, redisServer.Addr())), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("bulkdelete"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	redisServer.Close()
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestBulkDeleteGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable", "redistable"} {
+		records := []*pbState.KeyVal{}
+
+		for i := 0; i < 250; i++ {
+			records = append(records, &pbState.KeyVal{
+				Key:   fmt.Sprintf("tenant:a:%03d", i),
+				Value: &anypb.Any{Value: []byte(`{}`)},
+			})
+		}
+
+		for i := 0; i < 5; i++ {
+			records = append(records, &pbState.KeyVal{
+				Key:   fmt.Sprintf("tenant:b:%03d", i),
+				Value: &anypb.Any{Value: []byte(`{}`)},
+			})
+		}
+
+		err := post(grpcClient, storeName, records)
+		require.NoError(t, err)
+
+		t.Logf("streamed delete by prefix with store %s", storeName)
+
+		progress, err := bulkDeleteStream(grpcClient, &pbState.BulkDeleteStateRequest{
+			StoreId: storeName,
+			Prefix:  "tenant:a:",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []int64{100, 200, 250, 250}, progress)
+
+		rsp, err := list(grpcClient, storeName, "tenant:")
+		require.NoError(t, err)
+		require.Len(t, rsp.Records, 5)
+
+		t.Logf("delete by keys with store %s", storeName)
+
+		deleted, err := bulkDelete(grpcClient, &pbState.BulkDeleteStateRequest{
+			StoreId: storeName,
+			Keys:    []string{"tenant:b:000", "tenant:b:001", "tenant:b:001", "tenant:b:002", "tenant:b:999"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(3), deleted)
+
+		rsp, err = list(grpcClient, storeName, "tenant:")
+		require.NoError(t, err)
+		require.Len(t, rsp.Records, 2)
+
+		t.Logf("invalid deletes with store %s", storeName)
+
+		_, err = bulkDelete(grpcClient, &pbState.BulkDeleteStateRequest{
+			StoreId: storeName,
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = bulkDelete(grpcClient, &pbState.BulkDeleteStateRequest{
+			StoreId: storeName,
+			Keys:    []string{"tenant:b:003"},
+			Prefix:  "tenant:",
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = bulkDeleteStream(grpcClient, &pbState.BulkDeleteStateRequest{
+			StoreId: storeName,
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	_, err := bulkDelete(grpcClient, &pbState.BulkDeleteStateRequest{
+		StoreId: "nosuchtable",
+		Prefix:  "tenant:",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func post(grpcClient client.Client, storeName string, records []*pbState.KeyVal) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: records,
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func list(grpcClient client.Client, storeName, prefix string) (*pbState.ListStateResponse, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.List"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.ListStateRequest{
+				StoreId: storeName,
+				Prefix:  prefix,
+			},
+		),
+	)
+
+	rsp := &pbState.ListStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+func bulkDelete(grpcClient client.Client, bulkDeleteReq *pbState.BulkDeleteStateRequest) (int64, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.BulkDelete"),
+		client.RequestWithUnmarshaledRequest(bulkDeleteReq),
+	)
+
+	rsp := &pbState.BulkDeleteStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return 0, err
+	}
+
+	return rsp.Deleted, nil
+}
+
+// bulkDeleteStream returns every count that the stream sends until it is done
+func bulkDeleteStream(grpcClient client.Client, bulkDeleteReq *pbState.BulkDeleteStateRequest) ([]int64, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.BulkDeleteStream"),
+		client.RequestWithUnmarshaledRequest(bulkDeleteReq),
+	)
+
+	stream, err := grpcClient.Stream(context.Background(), req, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	if err := stream.Send(bulkDeleteReq); err != nil {
+		return nil, err
+	}
+
+	progress := []int64{}
+
+	for {
+		rsp := &pbState.BulkDeleteStateResponse{}
+
+		if err := stream.Recv(rsp); err == io.EOF {
+			return progress, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		progress = append(progress, rsp.Deleted)
+
+		if rsp.Done {
+			return progress, nil
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	gohttp "net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+  - name: redistable
+    type: redis
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test bulkdelete-http"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "bulkdelete")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir, redisServer.Addr())), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("bulkdelete"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	redisServer.Close()
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestBulkDeleteHttp(t *testing.T) {
+	require.Eventually(t, func() bool {
+		rsp, err := gohttp.Get(fmt.Sprintf("http://127.0.0.1:%d/health/check", httpPort))
+		if err != nil {
+			return false
+		}
+
+		rsp.Body.Close()
+
+		return rsp.StatusCode == gohttp.StatusOK
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable", "redistable"} {
+		t.Logf("streamed bulk delete of a prefix with store %s", storeName)
+
+		records := []map[string]interface{}{}
+
+		for i := 0; i < 250; i++ {
+			records = append(records, map[string]interface{}{
+				"key":   fmt.Sprintf("tenant:%03d", i),
+				"value": i,
+			})
+		}
+
+		records = append(records, map[string]interface{}{
+			"key":   "other:1",
+			"value": 1,
+		})
+
+		bs, err := json.Marshal(records)
+		require.NoError(t, err)
+
+		rsp, err := gohttp.Post(fmt.Sprintf("http://127.0.0.1:%d/state/%s", httpPort, storeName), "application/json", bytes.NewBuffer(bs))
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, gohttp.StatusOK, rsp.StatusCode)
+
+		counts := bulkDelete(t, storeName, map[string]interface{}{"prefix": "tenant:"}, true)
+
+		require.Equal(t, []deleted{
+			{Deleted: 100},
+			{Deleted: 200},
+			{Deleted: 250},
+			{Deleted: 250, Done: true},
+		}, counts)
+
+		require.Equal(t, []string{"other:1"}, list(t, storeName))
+
+		t.Logf("bulk delete of keys with store %s", storeName)
+
+		counts = bulkDelete(t, storeName, map[string]interface{}{"keys": []string{"other:1", "missing"}}, false)
+
+		require.Equal(t, []deleted{{Deleted: 1, Done: true}}, counts)
+
+		require.Empty(t, list(t, storeName))
+
+		t.Logf("bulk delete without keys or a prefix with store %s", storeName)
+
+		bs, err = json.Marshal(map[string]interface{}{})
+		require.NoError(t, err)
+
+		rsp, err = gohttp.Post(fmt.Sprintf("http://127.0.0.1:%d/state/%s/bulk/delete", httpPort, storeName), "application/json", bytes.NewBuffer(bs))
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, gohttp.StatusBadRequest, rsp.StatusCode)
+	}
+}
+
+type deleted struct {
+	Deleted int    `json:"deleted"`
+	Done    bool   `json:"done,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bulkDelete returns every count that the bulk delete answers with,
+// which is one for a response that is not streamed
+func bulkDelete(t *testing.T, storeName string, body map[string]interface{}, stream bool) []deleted {
+	bs, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req, err := gohttp.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d/state/%s/bulk/delete", httpPort, storeName), bytes.NewBuffer(bs))
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if stream {
+		req.Header.Set("Accept", "application/x-ndjson")
+	}
+
+	rsp, err := gohttp.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	require.Equal(t, gohttp.StatusOK, rsp.StatusCode)
+
+	if stream {
+		require.Equal(t, "application/x-ndjson", rsp.Header.Get("Content-Type"))
+	}
+
+	counts := []deleted{}
+
+	scanner := bufio.NewScanner(rsp.Body)
+
+	for scanner.Scan() {
+		var count deleted
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &count))
+		counts = append(counts, count)
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return counts
+}
+
+func list(t *testing.T, storeName string) []string {
+	rsp, err := gohttp.Get(fmt.Sprintf("http://127.0.0.1:%d/state/%s", httpPort, storeName))
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	require.Equal(t, gohttp.StatusOK, rsp.StatusCode)
+
+	records := []map[string]interface{}{}
+
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&records))
+
+	keys := []string{}
+
+	for _, record := range records {
+		keys = append(keys, record["key"].(string))
+	}
+
+	return keys
+}
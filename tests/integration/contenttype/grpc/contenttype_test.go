@@ -0,0 +1,290 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test contenttype-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "contenttype")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir)), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("contenttype"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestContentTypeGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	png := []byte{0x89, 'P', 'N', 'G', 0x00, 0x01, 0xff}
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		t.Logf("content types with store %s", storeName)
+
+		err := post(grpcClient, storeName, "image", png, "image/png")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "document", []byte(`{"kind":"document"}`), "application/json")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "note", []byte(`{"kind":"note"}`), "text/plain")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "plain", []byte(`{"kind":"plain"}`), "")
+		require.NoError(t, err)
+
+		// values of a json content type must be json
+		err = post(grpcClient, storeName, "broken", []byte(`{"kind":`), "application/json")
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = get(grpcClient, storeName, "broken")
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		// values that are stored as they are cannot be read as envelopes
+		for _, contentType := range []string{"", "application/json"} {
+			err = post(grpcClient, storeName, "reserved", []byte(`{"$sidecar":{"contentType":"image/png"},"data":"iVBORw=="}`), contentType)
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+		}
+
+		_, err = get(grpcClient, storeName, "reserved")
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		// unless they are enveloped themselves
+		err = post(grpcClient, storeName, "enveloped", []byte(`{"$sidecar":{"contentType":"image/png"}}`), "text/plain")
+		require.NoError(t, err)
+
+		records, err := get(grpcClient, storeName, "enveloped")
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, `{"$sidecar":{"contentType":"image/png"}}`, string(records[0].Value.Value))
+		require.Equal(t, "text/plain", records[0].ContentType)
+
+		// values are read back with the content types they were written with
+		records, err = get(grpcClient, storeName, "image")
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, png, records[0].Value.Value)
+		require.Equal(t, "image/png", records[0].ContentType)
+
+		records, err = get(grpcClient, storeName, "note")
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, `{"kind":"note"}`, string(records[0].Value.Value))
+		require.Equal(t, "text/plain", records[0].ContentType)
+
+		// json is json whether or not it was written with a content type
+		for _, key := range []string{"document", "plain"} {
+			records, err = get(grpcClient, storeName, key)
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+			require.Equal(t, "application/json", records[0].ContentType)
+		}
+
+		// and only json is queried
+		rsp, err := query(grpcClient, storeName)
+		require.NoError(t, err)
+
+		kinds := []string{}
+
+		for _, record := range rsp.Records {
+			kinds = append(kinds, record.Key)
+		}
+
+		require.Equal(t, []string{"document", "plain"}, kinds)
+	}
+}
+
+func get(grpcClient client.Client, storeName, key string) ([]*pbState.KeyVal, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: storeName,
+				Key:     key,
+			},
+		),
+	)
+
+	rsp := &pbState.GetStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	return rsp.Records, nil
+}
+
+func query(grpcClient client.Client, storeName string) (*pbState.QueryStateResponse, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Query"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.QueryStateRequest{
+				StoreId: storeName,
+			},
+		),
+	)
+
+	rsp := &pbState.QueryStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+func post(grpcClient client.Client, storeName, key string, value []byte, contentType string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: []*pbState.KeyVal{
+					{
+						Key: key,
+						Value: &anypb.Any{
+							Value: value,
+						},
+						ContentType: contentType,
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
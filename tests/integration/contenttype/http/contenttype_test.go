@@ -0,0 +1,266 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	gohttp "net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test contenttype-http"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "contenttype")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir)), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("contenttype"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestContentTypeHttp(t *testing.T) {
+	require.Eventually(t, func() bool {
+		rsp, err := gohttp.Get(fmt.Sprintf("http://127.0.0.1:%d/health/check", httpPort))
+		if err != nil {
+			return false
+		}
+
+		rsp.Body.Close()
+
+		return rsp.StatusCode == gohttp.StatusOK
+	}, 10*time.Second, 10*time.Millisecond)
+
+	png := []byte{0x89, 'P', 'N', 'G', 0x00, 0x01, 0xff}
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		t.Logf("puts of content types with store %s", storeName)
+
+		require.Equal(t, gohttp.StatusOK, put(t, storeName, "image", png, "image/png"))
+		require.Equal(t, gohttp.StatusOK, put(t, storeName, "document", []byte(`{"kind":"document"}`), "application/json"))
+		require.Equal(t, gohttp.StatusOK, put(t, storeName, "note", []byte("a note"), "text/plain"))
+
+		t.Logf("raw reads with store %s", storeName)
+
+		code, value, contentType := getRaw(t, storeName, "image")
+		require.Equal(t, gohttp.StatusOK, code)
+		require.Equal(t, png, value)
+		require.Equal(t, "image/png", contentType)
+
+		code, value, contentType = getRaw(t, storeName, "document")
+		require.Equal(t, gohttp.StatusOK, code)
+		require.Equal(t, `{"kind":"document"}`, string(value))
+		require.Equal(t, "application/json", contentType)
+
+		code, _, _ = getRaw(t, storeName, "missing")
+		require.Equal(t, gohttp.StatusNotFound, code)
+
+		t.Logf("reads of records with store %s", storeName)
+
+		record := get(t, storeName, "image")
+		require.Equal(t, base64.StdEncoding.EncodeToString(png), record["value"])
+		require.Equal(t, "image/png", record["contentType"])
+		require.Equal(t, "base64", record["encoding"])
+
+		record = get(t, storeName, "document")
+		require.Equal(t, map[string]interface{}{"kind": "document"}, record["value"])
+		require.Nil(t, record["contentType"])
+
+		record = get(t, storeName, "note")
+		require.Equal(t, "a note", record["value"])
+		require.Equal(t, "text/plain", record["contentType"])
+
+		t.Logf("values of a json content type that are not json with store %s", storeName)
+
+		require.Equal(t, gohttp.StatusBadRequest, put(t, storeName, "broken", []byte(`{"kind":`), "application/json"))
+		require.Equal(t, gohttp.StatusBadRequest, put(t, storeName, "broken", []byte(`{"kind":`), "application/problem+json"))
+
+		bs, err := json.Marshal([]map[string]interface{}{
+			{
+				"key":         "broken",
+				"value":       `{"kind":`,
+				"contentType": "application/json",
+			},
+		})
+		require.NoError(t, err)
+
+		rsp, err := gohttp.Post(fmt.Sprintf("http://127.0.0.1:%d/state/%s", httpPort, storeName), "application/json", bytes.NewBuffer(bs))
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, gohttp.StatusBadRequest, rsp.StatusCode)
+
+		code, _, _ = getRaw(t, storeName, "broken")
+		require.Equal(t, gohttp.StatusNotFound, code)
+
+		t.Logf("values that would be read as envelopes with store %s", storeName)
+
+		reserved := []byte(`{"$sidecar":{"contentType":"image/png"},"data":"iVBORw=="}`)
+
+		require.Equal(t, gohttp.StatusBadRequest, put(t, storeName, "reserved", reserved, "application/json"))
+
+		bs, err = json.Marshal([]map[string]interface{}{
+			{
+				"key":   "reserved",
+				"value": json.RawMessage(reserved),
+			},
+		})
+		require.NoError(t, err)
+
+		rsp, err = gohttp.Post(fmt.Sprintf("http://127.0.0.1:%d/state/%s", httpPort, storeName), "application/json", bytes.NewBuffer(bs))
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, gohttp.StatusBadRequest, rsp.StatusCode)
+
+		code, _, _ = getRaw(t, storeName, "reserved")
+		require.Equal(t, gohttp.StatusNotFound, code)
+
+		require.Equal(t, gohttp.StatusOK, put(t, storeName, "enveloped", reserved, "text/plain"))
+
+		code, value, contentType = getRaw(t, storeName, "enveloped")
+		require.Equal(t, gohttp.StatusOK, code)
+		require.Equal(t, reserved, value)
+		require.Equal(t, "text/plain", contentType)
+	}
+}
+
+func put(t *testing.T, storeName, key string, value []byte, contentType string) int {
+	req, err := gohttp.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/state/%s/%s", httpPort, storeName, key), bytes.NewBuffer(value))
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", contentType)
+
+	rsp, err := gohttp.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	return rsp.StatusCode
+}
+
+func getRaw(t *testing.T, storeName, key string) (int, []byte, string) {
+	rsp, err := gohttp.Get(fmt.Sprintf("http://127.0.0.1:%d/state/%s/%s?raw=true", httpPort, storeName, key))
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+
+	return rsp.StatusCode, body, rsp.Header.Get("Content-Type")
+}
+
+func get(t *testing.T, storeName, key string) map[string]interface{} {
+	rsp, err := gohttp.Get(fmt.Sprintf("http://127.0.0.1:%d/state/%s/%s", httpPort, storeName, key))
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	require.Equal(t, gohttp.StatusOK, rsp.StatusCode)
+
+	records := []map[string]interface{}{}
+
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&records))
+	require.Len(t, records, 1)
+
+	return records[0]
+}
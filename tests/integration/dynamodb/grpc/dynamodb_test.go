@@ -0,0 +1,559 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/proto/sidecar"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"github.com/w-h-a/sidecar/tests/integration/dynamodb/grpc/resources"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test dynamodb-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	// the stand-in has to be up before the sidecar
+	// is configured with its address
+	dynamoDbProcess := resources.NewDynamoDb(
+		runner.ProcessWithId("dynamodb"),
+	)
+
+	if err := dynamoDbProcess.Apply(); err != nil {
+		log.Fatal(err)
+	}
+
+	var err error
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":             "default",
+			"NAME":                  "sidecar",
+			"VERSION":               "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":          fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":          fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":          "localhost",
+			"SERVICE_PORT":          fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL":      "http",
+			"STORE":                 "dynamodb",
+			"STORE_ADDRESS":         dynamoDbProcess.Address(),
+			"AWS_ACCESS_KEY_ID":     "dummy",
+			"AWS_SECRET_ACCESS_KEY": "dummy",
+			"DB":                    "mydb",
+			"STORES":                "mytable1,mytable2",
+			"APP_DB":                "secretdb",
+			"SHARED_TABLE":          "records",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("dynamodb"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	dynamoDbProcess.Destroy()
+
+	os.Exit(code)
+}
+
+func TestDynamoDbGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	pt := runner.NewParallelTest(t)
+
+	for _, storeName := range []string{"mytable1", "mytable2"} {
+		pt.Add(func(c *assert.CollectT) {
+			t.Logf("state request with store %s in dynamodb", storeName)
+
+			postReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Post"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.PostStateRequest{
+						StoreId: storeName,
+						Records: []*sidecar.KeyVal{
+							{
+								Key: "key1",
+								Value: &anypb.Any{
+									Value: []byte(storeName),
+								},
+							},
+						},
+					},
+				),
+			)
+
+			postRsp := &sidecar.PostStateResponse{}
+
+			err := grpcClient.Call(context.Background(), postReq, postRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			getReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Get"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.GetStateRequest{
+						StoreId: storeName,
+						Key:     "key1",
+					},
+				),
+			)
+
+			getRsp := &sidecar.GetStateResponse{}
+
+			err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			require.Equal(c, []byte(storeName), getRsp.Records[0].Value.Value)
+
+			listReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.List"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.ListStateRequest{
+						StoreId: storeName,
+					},
+				),
+			)
+
+			listRsp := &sidecar.ListStateResponse{}
+
+			err = grpcClient.Call(context.Background(), listReq, listRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			require.Len(c, listRsp.Records, 1)
+
+			deleteReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Delete"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.DeleteStateRequest{
+						StoreId: storeName,
+						Key:     "key1",
+					},
+				),
+			)
+
+			deleteRsp := &sidecar.DeleteStateResponse{}
+
+			err = grpcClient.Call(context.Background(), deleteReq, deleteRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.Error(c, err)
+		})
+	}
+}
+
+func TestDynamoDbEtagGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	t.Log("checked writes and deletes in dynamodb")
+
+	post := func(value, etag string) error {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("State.Post"),
+			client.RequestWithUnmarshaledRequest(
+				&pbState.PostStateRequest{
+					StoreId: "mytable1",
+					Records: []*pbState.KeyVal{
+						{
+							Key: "checked",
+							Value: &anypb.Any{
+								Value: []byte(value),
+							},
+							Etag: etag,
+						},
+					},
+				},
+			),
+		)
+
+		return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	}
+
+	require.NoError(t, post("1", ""))
+
+	getReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: "mytable1",
+				Key:     "checked",
+			},
+		),
+	)
+
+	getRsp := &pbState.GetStateResponse{}
+
+	err := grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	etag := getRsp.Records[0].Etag
+
+	require.Equal(t, codes.Aborted, status.Code(post("2", "not-the-etag")))
+
+	require.NoError(t, post("2", etag))
+
+	deleteReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Delete"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.DeleteStateRequest{
+				StoreId: "mytable1",
+				Key:     "checked",
+				Etag:    etag,
+			},
+		),
+	)
+
+	err = grpcClient.Call(context.Background(), deleteReq, &pbState.DeleteStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	t.Log("checked writes of a record of dynamodb that had the value before")
+
+	require.NoError(t, post("1", ""))
+
+	require.Equal(t, codes.Aborted, status.Code(post("3", etag)))
+
+	t.Log("checked writes of a record of dynamodb that was created again")
+
+	err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	etag = getRsp.Records[0].Etag
+
+	deleteReq = grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Delete"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.DeleteStateRequest{
+				StoreId: "mytable1",
+				Key:     "checked",
+			},
+		),
+	)
+
+	err = grpcClient.Call(context.Background(), deleteReq, &pbState.DeleteStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	require.NoError(t, post("1", ""))
+	require.NoError(t, post("1", ""))
+	require.NoError(t, post("1", ""))
+
+	require.Equal(t, codes.Aborted, status.Code(post("3", etag)))
+}
+
+func TestDynamoDbScanGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	t.Log("listing a table that takes more than one page of a scan in dynamodb")
+
+	records := []*pbState.KeyVal{}
+
+	for i := 0; i < 7; i++ {
+		records = append(records, &pbState.KeyVal{
+			Key:   fmt.Sprintf("scan:%d", i),
+			Value: &anypb.Any{Value: []byte(`{}`)},
+		})
+	}
+
+	postReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: "mytable2",
+				Records: records,
+			},
+		),
+	)
+
+	err := grpcClient.Call(context.Background(), postReq, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	listReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.List"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.ListStateRequest{
+				StoreId: "mytable2",
+				Prefix:  "scan:",
+			},
+		),
+	)
+
+	listRsp := &pbState.ListStateResponse{}
+
+	err = grpcClient.Call(context.Background(), listReq, listRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	require.Len(t, listRsp.Records, 7)
+}
+
+func TestDynamoDbMetadataGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	t.Log("records of dynamodb have metadata and can be listed since a time")
+
+	err := post(grpcClient, "meta", `{}`)
+	require.NoError(t, err)
+
+	first, err := get(grpcClient, "meta")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first.Version)
+	require.NotNil(t, first.CreatedAt)
+	require.Equal(t, first.CreatedAt.AsTime(), first.UpdatedAt.AsTime())
+
+	time.Sleep(10 * time.Millisecond)
+
+	since := time.Now()
+
+	err = post(grpcClient, "meta", `{"a":1}`)
+	require.NoError(t, err)
+
+	updated, err := get(grpcClient, "meta")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), updated.Version)
+	require.Equal(t, first.CreatedAt.AsTime(), updated.CreatedAt.AsTime())
+	require.True(t, updated.UpdatedAt.AsTime().After(since))
+
+	listReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.List"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.ListStateRequest{
+				StoreId:      "mytable2",
+				UpdatedSince: timestamppb.New(since),
+			},
+		),
+	)
+
+	listRsp := &pbState.ListStateResponse{}
+
+	err = grpcClient.Call(context.Background(), listReq, listRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+	require.Len(t, listRsp.Records, 1)
+	require.Equal(t, "meta", listRsp.Records[0].Key)
+	require.Equal(t, updated.Version, listRsp.Records[0].Version)
+
+	t.Log("a record of dynamodb that is deleted is created again with a version of its own")
+
+	deleteReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Delete"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.DeleteStateRequest{
+				StoreId: "mytable2",
+				Key:     "meta",
+			},
+		),
+	)
+
+	err = grpcClient.Call(context.Background(), deleteReq, &pbState.DeleteStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	err = post(grpcClient, "meta", `{}`)
+	require.NoError(t, err)
+
+	recreated, err := get(grpcClient, "meta")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), recreated.Version)
+	require.True(t, recreated.CreatedAt.AsTime().After(updated.CreatedAt.AsTime()))
+}
+
+func post(grpcClient client.Client, key, value string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: "mytable2",
+				Records: []*pbState.KeyVal{
+					{
+						Key:   key,
+						Value: &anypb.Any{Value: []byte(value)},
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func get(grpcClient client.Client, key string) (*pbState.KeyVal, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: "mytable2",
+				Key:     key,
+			},
+		),
+	)
+
+	rsp := &pbState.GetStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	if len(rsp.Records) != 1 {
+		return nil, fmt.Errorf("expected one record of key %s but got %d", key, len(rsp.Records))
+	}
+
+	return rsp.Records[0], nil
+}
@@ -0,0 +1,428 @@
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/w-h-a/pkg/runner"
+)
+
+const (
+	targetPrefix = "DynamoDB_20120810."
+	errorPrefix  = "com.amazonaws.dynamodb.v20120810#"
+	// scans are served in pages this small so
+	// that every scan reads more than one page
+	scanPageSize = 2
+)
+
+type item map[string]map[string]interface{}
+
+var (
+	assignments = regexp.MustCompile(`(#\w+) = (?:(if_not_exists)\(#\w+, (:\w+)\)|(:\w+))`)
+)
+
+// DynamoDb is a stand-in for dynamodb that serves just enough of its
+// json protocol for the dynamodb store in the way that localstack
+// serves it for the e2e tests
+type DynamoDb struct {
+	options runner.ProcessOptions
+	server  *http.Server
+	address string
+	tables  map[string]map[string]item
+	mtx     sync.Mutex
+}
+
+func (p *DynamoDb) Options() runner.ProcessOptions {
+	return p.options
+}
+
+func (p *DynamoDb) Apply() error {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	p.address = "http://" + lis.Addr().String()
+
+	p.server = &http.Server{Handler: http.HandlerFunc(p.handle)}
+
+	go p.server.Serve(lis)
+
+	return nil
+}
+
+func (p *DynamoDb) Destroy() error {
+	return p.server.Close()
+}
+
+func (p *DynamoDb) String() string {
+	return "DynamoDb"
+}
+
+// Address returns the endpoint once the process has been applied
+func (p *DynamoDb) Address() string {
+	return p.address
+}
+
+func (p *DynamoDb) handle(w http.ResponseWriter, r *http.Request) {
+	req := map[string]interface{}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		p.fail(w, "SerializationException", err.Error())
+		return
+	}
+
+	table, _ := req["TableName"].(string)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), targetPrefix)
+
+	// a batch names its tables in its request items
+	if operation == "BatchGetItem" {
+		for t := range decodeRequests(req["RequestItems"]) {
+			table = t
+		}
+	}
+
+	if operation == "CreateTable" {
+		if _, ok := p.tables[table]; ok {
+			p.fail(w, "ResourceInUseException", "table already exists")
+			return
+		}
+		p.tables[table] = map[string]item{}
+		p.ok(w, map[string]interface{}{"TableDescription": p.describe(table)})
+		return
+	}
+
+	items, ok := p.tables[table]
+	if !ok {
+		p.fail(w, "ResourceNotFoundException", fmt.Sprintf("table %s not found", table))
+		return
+	}
+
+	switch operation {
+	case "DescribeTable":
+		p.ok(w, map[string]interface{}{"Table": p.describe(table)})
+	case "UpdateTimeToLive":
+		p.ok(w, map[string]interface{}{"TimeToLiveSpecification": req["TimeToLiveSpecification"]})
+	case "PutItem":
+		i := decode(req["Item"])
+		if !holds(req, items[key(i)]) {
+			p.fail(w, "ConditionalCheckFailedException", "the conditional request failed")
+			return
+		}
+		items[key(i)] = i
+		p.ok(w, map[string]interface{}{})
+	case "UpdateItem":
+		k := key(decode(req["Key"]))
+		if !holds(req, items[k]) {
+			p.fail(w, "ConditionalCheckFailedException", "the conditional request failed")
+			return
+		}
+		items[k] = updated(req, items[k])
+		p.ok(w, map[string]interface{}{})
+	case "BatchGetItem":
+		p.ok(w, p.batchGet(req))
+	case "GetItem":
+		rsp := map[string]interface{}{}
+		if i, ok := items[key(decode(req["Key"]))]; ok {
+			rsp["Item"] = i
+		}
+		p.ok(w, rsp)
+	case "DeleteItem":
+		k := key(decode(req["Key"]))
+		if !holds(req, items[k]) {
+			p.fail(w, "ConditionalCheckFailedException", "the conditional request failed")
+			return
+		}
+		delete(items, k)
+		p.ok(w, map[string]interface{}{})
+	case "Scan":
+		p.ok(w, p.scan(req, items))
+	default:
+		p.fail(w, "UnknownOperationException", operation)
+	}
+}
+
+// scan serves the page of the items in key order that starts after
+// the exclusive start key of the request
+func (p *DynamoDb) scan(req map[string]interface{}, items map[string]item) map[string]interface{} {
+	keys := []string{}
+
+	for k := range items {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	start := key(decode(req["ExclusiveStartKey"]))
+
+	scanned := []item{}
+
+	rsp := map[string]interface{}{}
+
+	for _, k := range keys {
+		if len(start) > 0 && k <= start {
+			continue
+		}
+
+		if len(scanned) == scanPageSize {
+			rsp["LastEvaluatedKey"] = map[string]interface{}{"key": map[string]string{"S": key(scanned[len(scanned)-1])}}
+			break
+		}
+
+		scanned = append(scanned, items[k])
+	}
+
+	// like dynamodb, the filter applies to the items of
+	// the page after they are scanned
+	page := []item{}
+
+	for _, i := range scanned {
+		if filtered(req, i) {
+			page = append(page, i)
+		}
+	}
+
+	rsp["Items"] = page
+	rsp["Count"] = len(page)
+	rsp["ScannedCount"] = len(scanned)
+
+	return rsp
+}
+
+// batchGet serves the items of the keys that exist and never leaves
+// keys unprocessed
+func (p *DynamoDb) batchGet(req map[string]interface{}) map[string]interface{} {
+	responses := map[string][]item{}
+
+	for table, requested := range decodeRequests(req["RequestItems"]) {
+		responses[table] = []item{}
+
+		for _, k := range requested.Keys {
+			if i, ok := p.tables[table][key(k)]; ok {
+				responses[table] = append(responses[table], i)
+			}
+		}
+	}
+
+	return map[string]interface{}{"Responses": responses, "UnprocessedKeys": map[string]interface{}{}}
+}
+
+func (p *DynamoDb) describe(table string) map[string]interface{} {
+	return map[string]interface{}{
+		"TableName":   table,
+		"TableStatus": "ACTIVE",
+		"KeySchema":   []map[string]string{{"AttributeName": "key", "KeyType": "HASH"}},
+	}
+}
+
+func (p *DynamoDb) ok(w http.ResponseWriter, rsp interface{}) {
+	p.write(w, http.StatusOK, rsp)
+}
+
+func (p *DynamoDb) fail(w http.ResponseWriter, typ, message string) {
+	p.write(w, http.StatusBadRequest, map[string]string{"__type": errorPrefix + typ, "message": message})
+}
+
+func (p *DynamoDb) write(w http.ResponseWriter, status int, rsp interface{}) {
+	bs, _ := json.Marshal(rsp)
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+	w.WriteHeader(status)
+	w.Write(bs)
+}
+
+func decode(v interface{}) item {
+	bs, _ := json.Marshal(v)
+
+	i := item{}
+
+	json.Unmarshal(bs, &i)
+
+	return i
+}
+
+func decodeRequests(v interface{}) map[string]struct{ Keys []item } {
+	bs, _ := json.Marshal(v)
+
+	requests := map[string]struct{ Keys []item }{}
+
+	json.Unmarshal(bs, &requests)
+
+	return requests
+}
+
+func key(i item) string {
+	k, _ := i["key"]["S"].(string)
+	return k
+}
+
+// holds evaluates a condition of terms of form #name = :value,
+// attribute_exists(#name), or attribute_not_exists(#name) joined by
+// AND against the item, which are the only forms of condition that
+// the store uses
+func holds(req map[string]interface{}, i item) bool {
+	condition, _ := req["ConditionExpression"].(string)
+	if len(condition) == 0 {
+		return true
+	}
+
+	names, _ := req["ExpressionAttributeNames"].(map[string]interface{})
+
+	values := decode(req["ExpressionAttributeValues"])
+
+	for _, term := range strings.Split(condition, " AND ") {
+		if name, ok := strings.CutPrefix(term, "attribute_exists("); ok {
+			attribute, _ := names[strings.TrimSuffix(name, ")")].(string)
+			if _, exists := i[attribute]; !exists {
+				return false
+			}
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(term, "attribute_not_exists("); ok {
+			attribute, _ := names[strings.TrimSuffix(name, ")")].(string)
+			if _, exists := i[attribute]; exists {
+				return false
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(term, " = ")
+		if !ok {
+			return false
+		}
+
+		attribute, _ := names[name].(string)
+
+		if i == nil || !reflect.DeepEqual(i[attribute], values[value]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// updated applies an update of form SET #name = :value or
+// #name = if_not_exists(#name, :value), REMOVE #name, and ADD #name
+// :value to a copy of the item, which are the only forms of update
+// that the store uses
+func updated(req map[string]interface{}, i item) item {
+	expression, _ := req["UpdateExpression"].(string)
+
+	names, _ := req["ExpressionAttributeNames"].(map[string]interface{})
+
+	values := decode(req["ExpressionAttributeValues"])
+
+	u := item{"key": decode(req["Key"])["key"]}
+
+	for name, value := range i {
+		u[name] = value
+	}
+
+	attribute := func(name string) string {
+		a, _ := names[strings.TrimSpace(name)].(string)
+		return a
+	}
+
+	for action, clause := range actions(expression) {
+		switch action {
+		case "SET":
+			for _, set := range assignments.FindAllStringSubmatch(clause, -1) {
+				name := attribute(set[1])
+				if len(set[2]) > 0 {
+					if _, ok := i[name]; !ok {
+						u[name] = values[set[3]]
+					}
+				} else {
+					u[name] = values[set[4]]
+				}
+			}
+		case "REMOVE":
+			for _, name := range strings.Split(clause, ",") {
+				delete(u, attribute(name))
+			}
+		case "ADD":
+			name, value, _ := strings.Cut(clause, " ")
+			current, _ := strconv.ParseInt(fmt.Sprint(u[attribute(name)]["N"]), 10, 64)
+			add, _ := strconv.ParseInt(fmt.Sprint(values[value]["N"]), 10, 64)
+			u[attribute(name)] = map[string]interface{}{"N": strconv.FormatInt(current+add, 10)}
+		}
+	}
+
+	return u
+}
+
+// actions splits an update expression into its clauses by action
+func actions(expression string) map[string]string {
+	clauses := map[string]string{}
+
+	action := ""
+
+	for _, word := range strings.Fields(expression) {
+		switch word {
+		case "SET", "REMOVE", "ADD":
+			action = word
+		default:
+			clauses[action] = strings.TrimSpace(clauses[action] + " " + word)
+		}
+	}
+
+	return clauses
+}
+
+// filtered evaluates a filter of terms of form begins_with(#name, :value)
+// or #name > :value joined by AND against the string attributes of the
+// item, which are the only forms of filter that the store uses
+func filtered(req map[string]interface{}, i item) bool {
+	filter, _ := req["FilterExpression"].(string)
+	if len(filter) == 0 {
+		return true
+	}
+
+	names, _ := req["ExpressionAttributeNames"].(map[string]interface{})
+
+	values := decode(req["ExpressionAttributeValues"])
+
+	for _, term := range strings.Split(filter, " AND ") {
+		var name, value string
+
+		if args, ok := strings.CutPrefix(term, "begins_with("); ok {
+			name, value, _ = strings.Cut(strings.TrimSuffix(args, ")"), ", ")
+		} else {
+			name, value, _ = strings.Cut(term, " > ")
+		}
+
+		attribute, _ := names[name].(string)
+
+		got, _ := i[attribute]["S"].(string)
+		want, _ := values[value]["S"].(string)
+
+		if strings.HasPrefix(term, "begins_with(") && !strings.HasPrefix(got, want) {
+			return false
+		} else if !strings.HasPrefix(term, "begins_with(") && got <= want {
+			return false
+		}
+	}
+
+	return true
+}
+
+func NewDynamoDb(opts ...runner.ProcessOption) *DynamoDb {
+	return &DynamoDb{
+		options: runner.NewProcessOptions(opts...),
+		tables:  map[string]map[string]item{},
+	}
+}
@@ -0,0 +1,438 @@
+package grpc
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+    encryption:
+      key: keys:KEY1
+  - name: sqltable
+    type: sqlite
+    address: %[1]s
+    table: records
+    encryption:
+      key: keys:KEY1
+  - name: filetable
+    type: file
+    address: %[2]s
+    database: mydb
+    table: records
+    encryption:
+      key: keys:KEY1
+  - name: rotatedtable
+    type: sqlite
+    address: %[1]s
+    table: records
+    encryption:
+      key: keys:KEY2
+      previousKeys:
+        - keys:KEY1
+  - name: plaintable
+    type: sqlite
+    address: %[1]s
+    table: plain
+  - name: lockedtable
+    type: sqlite
+    address: %[1]s
+    table: plain
+    encryption:
+      key: keys:KEY1
+  - name: migratingtable
+    type: sqlite
+    address: %[1]s
+    table: plain
+    encryption:
+      key: keys:KEY1
+      plaintext: true
+secrets:
+  - name: keys
+    type: env
+    options:
+      prefix: ENCRYPTION_
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+	dbPath      string
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test encryption-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "encryption")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbPath = filepath.Join(dir, "state.db")
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, dbPath, dir)), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+			"ENCRYPTION_KEY1":  newKey(),
+			"ENCRYPTION_KEY2":  newKey(),
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("encryption"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestEncryptionGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		t.Logf("encrypted values with store %s", storeName)
+
+		err := post(grpcClient, storeName, "card", `{"number":"4111111111111111","brand":"visa"}`, "")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "other", `{"number":"5500000000000004","brand":"mastercard"}`, "")
+		require.NoError(t, err)
+
+		value, etag, err := get(grpcClient, storeName, "card")
+		require.NoError(t, err)
+		require.Equal(t, `{"number":"4111111111111111","brand":"visa"}`, value)
+
+		t.Logf("etags of encrypted values with store %s", storeName)
+
+		err = post(grpcClient, storeName, "card", `{"number":"4111111111111111","brand":"amex"}`, etag)
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "card", `{"number":"4111111111111111","brand":"discover"}`, etag)
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		value, etag, err = get(grpcClient, storeName, "card")
+		require.NoError(t, err)
+		require.Equal(t, `{"number":"4111111111111111","brand":"amex"}`, value)
+
+		t.Logf("transactions of encrypted values with store %s", storeName)
+
+		err = transact(grpcClient, storeName,
+			upsert("card", `{"number":"4111111111111111","brand":"visa"}`, etag),
+			upsert("card", `{"number":"4111111111111111","brand":"jcb"}`, ""),
+		)
+		require.NoError(t, err)
+
+		err = transact(grpcClient, storeName, upsert("card", `{}`, etag))
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		value, _, err = get(grpcClient, storeName, "card")
+		require.NoError(t, err)
+		require.Equal(t, `{"number":"4111111111111111","brand":"jcb"}`, value)
+
+		t.Logf("queries of encrypted values with store %s", storeName)
+
+		rsp, err := query(grpcClient, storeName, "brand", "mastercard")
+		require.NoError(t, err)
+		require.Len(t, rsp.Records, 1)
+		require.Equal(t, "other", rsp.Records[0].Key)
+	}
+
+	t.Log("values of store sqltable are encrypted at rest")
+
+	raw, err := readRaw("records", "card")
+	require.NoError(t, err)
+	require.NotContains(t, raw, "4111111111111111")
+	require.Contains(t, raw, `"keyId":"keys:KEY1"`)
+
+	t.Log("values of store rotatedtable are read with the previous key and written with the new key")
+
+	value, _, err := get(grpcClient, "rotatedtable", "card")
+	require.NoError(t, err)
+	require.Equal(t, `{"number":"4111111111111111","brand":"jcb"}`, value)
+
+	err = post(grpcClient, "rotatedtable", "card", `{"number":"4111111111111111","brand":"unionpay"}`, "")
+	require.NoError(t, err)
+
+	raw, err = readRaw("records", "card")
+	require.NoError(t, err)
+	require.NotContains(t, raw, "4111111111111111")
+	require.Contains(t, raw, `"keyId":"keys:KEY2"`)
+
+	value, _, err = get(grpcClient, "rotatedtable", "card")
+	require.NoError(t, err)
+	require.Equal(t, `{"number":"4111111111111111","brand":"unionpay"}`, value)
+
+	// the store without the new key cannot read what it encrypted
+	_, _, err = get(grpcClient, "sqltable", "card")
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	t.Log("values of store plaintable are not encrypted")
+
+	err = post(grpcClient, "plaintable", "card", `{"number":"4111111111111111"}`, "")
+	require.NoError(t, err)
+
+	raw, err = readRaw("plain", "card")
+	require.NoError(t, err)
+	require.Equal(t, `{"number":"4111111111111111"}`, raw)
+
+	t.Log("values of store lockedtable that are not encrypted fail to be read")
+
+	_, _, err = get(grpcClient, "lockedtable", "card")
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	t.Log("values of store migratingtable that are not encrypted are read as they are and encrypted when written")
+
+	value, _, err = get(grpcClient, "migratingtable", "card")
+	require.NoError(t, err)
+	require.Equal(t, `{"number":"4111111111111111"}`, value)
+
+	// values that only start like encrypted values are read as they are
+	err = post(grpcClient, "plaintable", "legacy", `{"$encrypted":{"keyId":"keys:KEY1","note":"not encrypted"}}`, "")
+	require.NoError(t, err)
+
+	value, _, err = get(grpcClient, "migratingtable", "legacy")
+	require.NoError(t, err)
+	require.Equal(t, `{"$encrypted":{"keyId":"keys:KEY1","note":"not encrypted"}}`, value)
+
+	_, _, err = get(grpcClient, "lockedtable", "legacy")
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	err = post(grpcClient, "migratingtable", "card", `{"number":"4111111111111111","brand":"visa"}`, "")
+	require.NoError(t, err)
+
+	raw, err = readRaw("plain", "card")
+	require.NoError(t, err)
+	require.NotContains(t, raw, "4111111111111111")
+
+	value, _, err = get(grpcClient, "lockedtable", "card")
+	require.NoError(t, err)
+	require.Equal(t, `{"number":"4111111111111111","brand":"visa"}`, value)
+}
+
+func newKey() string {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func readRaw(table, key string) (string, error) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var value []byte
+
+	if err := db.QueryRow(fmt.Sprintf("SELECT value FROM %s WHERE key = $1", table), key).Scan(&value); err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+func upsert(key, value, etag string) *pbState.TransactionOperation {
+	return &pbState.TransactionOperation{
+		Operation: "upsert",
+		Record: &pbState.KeyVal{
+			Key: key,
+			Value: &anypb.Any{
+				Value: []byte(value),
+			},
+			Etag: etag,
+		},
+	}
+}
+
+func transact(grpcClient client.Client, storeName string, ops ...*pbState.TransactionOperation) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Transact"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.TransactStateRequest{
+				StoreId:    storeName,
+				Operations: ops,
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.TransactStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func query(grpcClient client.Client, storeName, path, value string) (*pbState.QueryStateResponse, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Query"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.QueryStateRequest{
+				StoreId: storeName,
+				Filter: &pbState.QueryFilter{
+					Op:     "EQ",
+					Path:   path,
+					Values: []*structpb.Value{structpb.NewStringValue(value)},
+				},
+			},
+		),
+	)
+
+	rsp := &pbState.QueryStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+func post(grpcClient client.Client, storeName, key, value, etag string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: []*pbState.KeyVal{
+					{
+						Key: key,
+						Value: &anypb.Any{
+							Value: []byte(value),
+						},
+						Etag: etag,
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func get(grpcClient client.Client, storeName, key string) (string, string, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: storeName,
+				Key:     key,
+			},
+		),
+	)
+
+	rsp := &pbState.GetStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return "", "", err
+	}
+
+	return string(rsp.Records[0].Value.Value), rsp.Records[0].Etag, nil
+}
@@ -0,0 +1,372 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+  - name: redistable
+    type: redis
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test etag-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "etag")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir, redisServer.Addr())), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("etag"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	redisServer.Close()
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestEtagGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable", "redistable"} {
+		t.Logf("checked writes with store %s", storeName)
+
+		err := post(grpcClient, storeName, "key1", "1", "")
+		require.NoError(t, err)
+
+		_, etag, err := get(grpcClient, storeName, "key1")
+		require.NoError(t, err)
+		require.NotEmpty(t, etag)
+
+		err = post(grpcClient, storeName, "key1", "2", "not-the-etag")
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		err = post(grpcClient, storeName, "key1", "2", etag)
+		require.NoError(t, err)
+
+		value, next, err := get(grpcClient, storeName, "key1")
+		require.NoError(t, err)
+		require.Equal(t, "2", value)
+		require.NotEqual(t, etag, next)
+
+		t.Logf("checked writes of a value that the record had before with store %s", storeName)
+
+		err = post(grpcClient, storeName, "key1", "1", "")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "key1", "2", "")
+		require.NoError(t, err)
+
+		_, next, err = get(grpcClient, storeName, "key1")
+		require.NoError(t, err)
+		require.NotEqual(t, etag, next)
+
+		err = post(grpcClient, storeName, "key1", "1", etag)
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		t.Logf("checked deletes with store %s", storeName)
+
+		err = remove(grpcClient, storeName, "key1", etag)
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		err = remove(grpcClient, storeName, "key1", next)
+		require.NoError(t, err)
+
+		_, _, err = get(grpcClient, storeName, "key1")
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		err = post(grpcClient, storeName, "key1", "3", next)
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		t.Logf("checked writes of any record with store %s", storeName)
+
+		err = post(grpcClient, storeName, "key1", "3", "*")
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		err = post(grpcClient, storeName, "key1", "3", "")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "key1", "4", "*")
+		require.NoError(t, err)
+
+		value, _, err = get(grpcClient, storeName, "key1")
+		require.NoError(t, err)
+		require.Equal(t, "4", value)
+
+		err = remove(grpcClient, storeName, "key1", "*")
+		require.NoError(t, err)
+
+		err = remove(grpcClient, storeName, "key1", "*")
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		t.Logf("checked writes of many records with store %s", storeName)
+
+		err = postRecords(grpcClient, storeName, []*pbState.KeyVal{
+			{Key: "key2", Value: &anypb.Any{Value: []byte("2")}, TtlInSeconds: 60},
+			{Key: "key3", Value: &anypb.Any{Value: []byte("3")}, Etag: "not-the-etag"},
+		})
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		// transactors write every record or none of them
+		_, _, err = get(grpcClient, storeName, "key2")
+		if storeName == "redistable" {
+			require.NoError(t, err)
+		} else {
+			require.Equal(t, codes.NotFound, status.Code(err))
+		}
+
+		// records are checked before any is written
+		err = postRecords(grpcClient, storeName, []*pbState.KeyVal{
+			{Key: "key4", Value: &anypb.Any{Value: []byte("4")}, TtlInSeconds: 60},
+			{Key: "key5", Value: &anypb.Any{Value: []byte(`{"broken":`)}, ContentType: "application/json"},
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, _, err = get(grpcClient, storeName, "key4")
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		t.Logf("concurrent increments with store %s", storeName)
+
+		err = post(grpcClient, storeName, "counter", "0", "")
+		require.NoError(t, err)
+
+		increments := 10
+
+		wg := &sync.WaitGroup{}
+
+		for i := 0; i < increments; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					value, etag, err := get(grpcClient, storeName, "counter")
+					if err != nil {
+						continue
+					}
+
+					n, _ := strconv.Atoi(value)
+
+					if err := post(grpcClient, storeName, "counter", strconv.Itoa(n+1), etag); err == nil {
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		value, _, err = get(grpcClient, storeName, "counter")
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(increments), value)
+	}
+}
+
+func post(grpcClient client.Client, storeName, key, value, etag string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: []*pbState.KeyVal{
+					{
+						Key: key,
+						Value: &anypb.Any{
+							Value: []byte(value),
+						},
+						Etag: etag,
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func postRecords(grpcClient client.Client, storeName string, records []*pbState.KeyVal) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: records,
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func get(grpcClient client.Client, storeName, key string) (string, string, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: storeName,
+				Key:     key,
+			},
+		),
+	)
+
+	rsp := &pbState.GetStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return "", "", err
+	}
+
+	return string(rsp.Records[0].Value.Value), rsp.Records[0].Etag, nil
+}
+
+func remove(grpcClient client.Client, storeName, key, etag string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Delete"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.DeleteStateRequest{
+				StoreId: storeName,
+				Key:     key,
+				Etag:    etag,
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.DeleteStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
@@ -0,0 +1,297 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	gohttp "net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+  - name: redistable
+    type: redis
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test etag-http"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "etag")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir, redisServer.Addr())), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("etag"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	redisServer.Close()
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestEtagHttp(t *testing.T) {
+	require.Eventually(t, func() bool {
+		rsp, err := gohttp.Get(fmt.Sprintf("http://127.0.0.1:%d/health/check", httpPort))
+		if err != nil {
+			return false
+		}
+
+		rsp.Body.Close()
+
+		return rsp.StatusCode == gohttp.StatusOK
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable", "redistable"} {
+		t.Logf("checked puts with store %s", storeName)
+
+		code, _ := put(t, storeName, "key1", "1", "")
+		require.Equal(t, gohttp.StatusOK, code)
+
+		code, value, etag := get(t, storeName, "key1")
+		require.Equal(t, gohttp.StatusOK, code)
+		require.Equal(t, "1", value)
+		require.NotEmpty(t, etag)
+
+		code, _ = put(t, storeName, "key1", "2", `"not-the-etag"`)
+		require.Equal(t, gohttp.StatusConflict, code)
+
+		code, next := put(t, storeName, "key1", "2", etag)
+		require.Equal(t, gohttp.StatusOK, code)
+		require.NotEqual(t, etag, next)
+
+		code, value, got := get(t, storeName, "key1")
+		require.Equal(t, gohttp.StatusOK, code)
+		require.Equal(t, "2", value)
+		require.Equal(t, next, got)
+
+		t.Logf("checked puts of a value that the record had before with store %s", storeName)
+
+		code, _ = put(t, storeName, "key1", "1", "")
+		require.Equal(t, gohttp.StatusOK, code)
+
+		code, next = put(t, storeName, "key1", "2", "")
+		require.Equal(t, gohttp.StatusOK, code)
+		require.NotEqual(t, etag, next)
+
+		code, _ = put(t, storeName, "key1", "1", etag)
+		require.Equal(t, gohttp.StatusConflict, code)
+
+		t.Logf("checked deletes with store %s", storeName)
+
+		code = remove(t, storeName, "key1", etag)
+		require.Equal(t, gohttp.StatusConflict, code)
+
+		code = remove(t, storeName, "key1", next)
+		require.Equal(t, gohttp.StatusOK, code)
+
+		code, _, _ = get(t, storeName, "key1")
+		require.Equal(t, gohttp.StatusNotFound, code)
+
+		t.Logf("checked puts of any record with store %s", storeName)
+
+		code, _ = put(t, storeName, "key1", "3", "*")
+		require.Equal(t, gohttp.StatusConflict, code)
+
+		code, _ = put(t, storeName, "key1", "3", "")
+		require.Equal(t, gohttp.StatusOK, code)
+
+		code, _ = put(t, storeName, "key1", "4", "*")
+		require.Equal(t, gohttp.StatusOK, code)
+
+		code, value, _ = get(t, storeName, "key1")
+		require.Equal(t, gohttp.StatusOK, code)
+		require.Equal(t, "4", value)
+
+		code = remove(t, storeName, "key1", "*")
+		require.Equal(t, gohttp.StatusOK, code)
+
+		code = remove(t, storeName, "key1", "*")
+		require.Equal(t, gohttp.StatusConflict, code)
+
+		t.Logf("checked posts of many records with store %s", storeName)
+
+		code = post(t, storeName, []map[string]interface{}{
+			{"key": "key2", "value": "2", "ttlInSeconds": 60},
+			{"key": "key3", "value": "3", "etag": "not-the-etag"},
+		})
+		require.Equal(t, gohttp.StatusConflict, code)
+
+		// transactors write every record or none of them
+		code, _, _ = get(t, storeName, "key2")
+		if storeName == "redistable" {
+			require.Equal(t, gohttp.StatusOK, code)
+		} else {
+			require.Equal(t, gohttp.StatusNotFound, code)
+		}
+
+		// records are checked before any is written
+		code = post(t, storeName, []map[string]interface{}{
+			{"key": "key4", "value": "4", "ttlInSeconds": 60},
+			{"key": "key5", "value": "5", "encoding": "base32"},
+		})
+		require.Equal(t, gohttp.StatusBadRequest, code)
+
+		code, _, _ = get(t, storeName, "key4")
+		require.Equal(t, gohttp.StatusNotFound, code)
+	}
+}
+
+func post(t *testing.T, storeName string, records []map[string]interface{}) int {
+	bs, err := json.Marshal(records)
+	require.NoError(t, err)
+
+	rsp, err := gohttp.Post(fmt.Sprintf("http://127.0.0.1:%d/state/%s", httpPort, storeName), "application/json", bytes.NewBuffer(bs))
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	return rsp.StatusCode
+}
+
+func put(t *testing.T, storeName, key, value, ifMatch string) (int, string) {
+	req, err := gohttp.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/state/%s/%s", httpPort, storeName, key), bytes.NewBufferString(value))
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", "text/plain")
+
+	if len(ifMatch) > 0 {
+		req.Header.Set("If-Match", ifMatch)
+	}
+
+	rsp, err := gohttp.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	return rsp.StatusCode, rsp.Header.Get("ETag")
+}
+
+func get(t *testing.T, storeName, key string) (int, string, string) {
+	rsp, err := gohttp.Get(fmt.Sprintf("http://127.0.0.1:%d/state/%s/%s?raw=true", httpPort, storeName, key))
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+
+	return rsp.StatusCode, string(body), rsp.Header.Get("ETag")
+}
+
+func remove(t *testing.T, storeName, key, ifMatch string) int {
+	req, err := gohttp.NewRequest("DELETE", fmt.Sprintf("http://127.0.0.1:%d/state/%s/%s", httpPort, storeName, key), nil)
+	require.NoError(t, err)
+
+	if len(ifMatch) > 0 {
+		req.Header.Set("If-Match", ifMatch)
+	}
+
+	rsp, err := gohttp.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	defer rsp.Body.Close()
+
+	return rsp.StatusCode
+}
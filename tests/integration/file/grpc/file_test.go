@@ -0,0 +1,215 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/proto/sidecar"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var (
+	servicePort    int
+	httpPort       int
+	grpcPort       int
+	sidecarProcess runner.Process
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test file-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "file")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess = binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"STORE":            "file",
+			"STORE_ADDRESS":    dir,
+			"DB":               "mydb",
+			"STORES":           "mytable1,mytable2,scratch",
+			"APP_DB":           "secretdb",
+			"SHARED_TABLE":     "records",
+			// a store of another backend beside the file stores
+			"SIDECAR_STORE_SCRATCH_TYPE": "memory",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("file"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestFileGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		return healthy(grpcClient)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"mytable1", "mytable2", "scratch"} {
+		t.Logf("state request with store %s", storeName)
+
+		postReq := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("State.Post"),
+			client.RequestWithUnmarshaledRequest(
+				&sidecar.PostStateRequest{
+					StoreId: storeName,
+					Records: []*sidecar.KeyVal{
+						{
+							Key: "key1",
+							Value: &anypb.Any{
+								Value: []byte(storeName),
+							},
+						},
+					},
+				},
+			),
+		)
+
+		postRsp := &sidecar.PostStateResponse{}
+
+		err := grpcClient.Call(context.Background(), postReq, postRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+		require.NoError(t, err)
+	}
+
+	t.Log("restarting the sidecar")
+
+	require.NoError(t, sidecarProcess.Destroy())
+
+	require.Eventually(t, func() bool {
+		return !healthy(grpcClient)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, sidecarProcess.Apply())
+
+	require.Eventually(t, func() bool {
+		return healthy(grpcClient)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"mytable1", "mytable2"} {
+		t.Logf("state request with file store %s after restart", storeName)
+
+		getReq := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("State.Get"),
+			client.RequestWithUnmarshaledRequest(
+				&sidecar.GetStateRequest{
+					StoreId: storeName,
+					Key:     "key1",
+				},
+			),
+		)
+
+		getRsp := &sidecar.GetStateResponse{}
+
+		err := grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+		require.NoError(t, err)
+
+		require.Equal(t, []byte(storeName), getRsp.Records[0].Value.Value)
+	}
+
+	t.Log("state request with memory store scratch after restart")
+
+	getReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&sidecar.GetStateRequest{
+				StoreId: "scratch",
+				Key:     "key1",
+			},
+		),
+	)
+
+	err := grpcClient.Call(context.Background(), getReq, &sidecar.GetStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func healthy(grpcClient client.Client) bool {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("Health.Check"),
+		client.RequestWithUnmarshaledRequest(
+			&health.HealthRequest{},
+		),
+	)
+
+	rsp := &health.HealthResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return false
+	}
+
+	return rsp.Status == "ok"
+}
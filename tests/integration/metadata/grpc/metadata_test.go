@@ -0,0 +1,157 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	"github.com/w-h-a/sidecar/proto/metadata"
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test metadata-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	var err error
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"STORE":            "memory",
+			"STORES":           "mytable1,mytable2",
+			"BROKER":           "memory",
+			"PRODUCERS":        "mytopic",
+			"CONSUMERS":        "mygroup-mytopic",
+			"SECRET":           "env",
+			"APP_DB":           "secretdb",
+			"SHARED_TABLE":     "records",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("metadata"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	os.Exit(r.Start(m))
+}
+
+func TestMetadataGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	t.Log("metadata request")
+
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("Metadata.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&metadata.GetMetadataRequest{},
+		),
+	)
+
+	rsp := &metadata.GetMetadataResponse{}
+
+	err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	require.Equal(t, "default", rsp.Metadata.Namespace)
+	require.Equal(t, "sidecar", rsp.Metadata.Name)
+	require.Equal(t, "v0.1.0-alpha.0", rsp.Metadata.Version)
+	require.Equal(t, fmt.Sprintf("%d", servicePort), rsp.Metadata.App.Port)
+	require.Equal(t, "http", rsp.Metadata.App.Protocol)
+
+	require.Len(t, rsp.Metadata.Stores, 2)
+	require.Equal(t, "mytable1", rsp.Metadata.Stores[0].Name)
+	require.Equal(t, "memory", rsp.Metadata.Stores[0].Type)
+	require.Equal(t, "mytable2", rsp.Metadata.Stores[1].Name)
+
+	require.Len(t, rsp.Metadata.Producers, 1)
+	require.Equal(t, "mytopic", rsp.Metadata.Producers[0].Topic)
+
+	require.Len(t, rsp.Metadata.Consumers, 1)
+	require.Equal(t, "mygroup", rsp.Metadata.Consumers[0].Group)
+	require.Equal(t, "mytopic", rsp.Metadata.Consumers[0].Topic)
+
+	require.Len(t, rsp.Metadata.Secrets, 1)
+	require.Equal(t, "env", rsp.Metadata.Secrets[0].Type)
+
+	require.Equal(t, "memory", rsp.Metadata.TraceExporter)
+}
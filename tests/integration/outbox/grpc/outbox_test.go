@@ -0,0 +1,311 @@
+package grpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/httputils"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"github.com/w-h-a/sidecar/tests/integration/outbox/grpc/resources"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: orders
+    outbox: true
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: orders
+    outbox: true
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: orders
+    outbox: true
+  - name: plaintable
+    type: memory
+    database: mydb
+    table: orders
+consumers:
+  - name: orders-updated
+    type: memory
+`
+
+	// an outbox that was created before events were claimed, with an
+	// event that can never be published at its front
+	outbox = `CREATE TABLE orders_outbox
+(
+	id integer PRIMARY KEY AUTOINCREMENT,
+	event_name text NOT NULL,
+	payload blob,
+	created_at timestamp,
+	sent_at timestamp
+);
+INSERT INTO orders_outbox(event_name, payload) VALUES ('orders-updated', '"broken"');`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+
+	dbPath string
+
+	httpSubscriber *resources.HttpSubscriber
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test outbox-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "outbox")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbPath = filepath.Join(dir, "state.db")
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := db.Exec(outbox); err != nil {
+		log.Fatal(err)
+	}
+
+	db.Close()
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, dbPath, dir)), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	httpSubscriber = resources.NewHttpSubscriber(
+		runner.ProcessWithId("http-subscriber"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+			"OUTBOX_INTERVAL":  "100ms",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("outbox"),
+		runner.RunnerWithProcesses(httpSubscriber, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestOutboxGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		rsp, err := httputils.HttpGet(fmt.Sprintf("127.0.0.1:%d/health/check", servicePort))
+		if err != nil {
+			return false
+		}
+
+		return string(rsp) == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		t.Logf("events of a transaction that applies with store %s", storeName)
+
+		err := transact(grpcClient, storeName,
+			[]*pbState.TransactionOperation{upsert("order1", `{"status":"paid"}`, "")},
+			event(storeName, "order1", "paid"),
+			event(storeName, "order1", "shipped"),
+		)
+		require.NoError(t, err)
+
+		received := httpSubscriber.Receive()
+		require.NotNil(t, received)
+		require.Equal(t, "/orders/updated", received.Route)
+		require.Equal(t, storeName, received.Event.Payload["store"])
+		require.Equal(t, "paid", received.Event.Payload["status"])
+
+		received = httpSubscriber.Receive()
+		require.NotNil(t, received)
+		require.Equal(t, "shipped", received.Event.Payload["status"])
+
+		t.Logf("events of a transaction that does not apply with store %s", storeName)
+
+		err = transact(grpcClient, storeName,
+			[]*pbState.TransactionOperation{upsert("order1", `{"status":"refunded"}`, "stale")},
+			event(storeName, "order1", "refunded"),
+		)
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		require.Nil(t, httpSubscriber.Receive())
+
+		t.Logf("invalid events with store %s", storeName)
+
+		err = transact(grpcClient, storeName,
+			[]*pbState.TransactionOperation{upsert("order1", `{"status":"refunded"}`, "")},
+			&pbState.OutboxEvent{EventName: "orders-deleted", Payload: []byte(`{}`)},
+		)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		err = transact(grpcClient, storeName,
+			[]*pbState.TransactionOperation{upsert("order1", `{"status":"refunded"}`, "")},
+			&pbState.OutboxEvent{EventName: "orders-updated", Payload: []byte(`"refunded"`)},
+		)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		require.Nil(t, httpSubscriber.Receive())
+	}
+
+	t.Log("events that cannot be published with store sqltable")
+
+	db, err := sql.Open("sqlite", dbPath)
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	var attempts int
+	var failed, sent bool
+
+	err = db.QueryRow("SELECT attempts, failed_at IS NOT NULL, sent_at IS NOT NULL FROM orders_outbox WHERE id = 1").Scan(&attempts, &failed, &sent)
+	require.NoError(t, err)
+	require.Equal(t, 1, attempts)
+	require.True(t, failed)
+	require.False(t, sent)
+
+	t.Log("events of a transaction with store plaintable")
+
+	err = transact(grpcClient, "plaintable",
+		[]*pbState.TransactionOperation{upsert("order1", `{"status":"paid"}`, "")},
+		event("plaintable", "order1", "paid"),
+	)
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	err = transact(grpcClient, "plaintable",
+		[]*pbState.TransactionOperation{upsert("order1", `{"status":"paid"}`, "")},
+	)
+	require.NoError(t, err)
+}
+
+func event(storeName, order, status string) *pbState.OutboxEvent {
+	return &pbState.OutboxEvent{
+		EventName: "orders-updated",
+		Payload:   []byte(fmt.Sprintf(`{"store":%q,"order":%q,"status":%q}`, storeName, order, status)),
+	}
+}
+
+func upsert(key, value, etag string) *pbState.TransactionOperation {
+	return &pbState.TransactionOperation{
+		Operation: "upsert",
+		Record: &pbState.KeyVal{
+			Key: key,
+			Value: &anypb.Any{
+				Value: []byte(value),
+			},
+			Etag: etag,
+		},
+	}
+}
+
+func transact(grpcClient client.Client, storeName string, ops []*pbState.TransactionOperation, events ...*pbState.OutboxEvent) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Transact"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.TransactStateRequest{
+				StoreId:    storeName,
+				Operations: ops,
+				Events:     events,
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.TransactStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
@@ -0,0 +1,283 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/proto/sidecar"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"github.com/w-h-a/sidecar/tests/integration/dynamodb/grpc/resources"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: redistable
+    type: redis
+    address: %s
+    database: mydb
+    table: records
+  - name: dynamotable
+    type: dynamodb
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test paging-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the stand-in has to be up before the sidecar
+	// is configured with its address
+	dynamoDbProcess := resources.NewDynamoDb(
+		runner.ProcessWithId("dynamodb"),
+	)
+
+	if err := dynamoDbProcess.Apply(); err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "paging")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), redisServer.Addr(), dynamoDbProcess.Address())), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":             "default",
+			"NAME":                  "sidecar",
+			"VERSION":               "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":          fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":          fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":          "localhost",
+			"SERVICE_PORT":          fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL":      "http",
+			"COMPONENTS":            path,
+			"AWS_ACCESS_KEY_ID":     "dummy",
+			"AWS_SECRET_ACCESS_KEY": "dummy",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("paging"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	dynamoDbProcess.Destroy()
+
+	redisServer.Close()
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestPagingGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "redistable", "dynamotable"} {
+		t.Logf("paging through store %s", storeName)
+
+		records := []*sidecar.KeyVal{}
+
+		for _, key := range []string{"user:3", "user:1", "order:1", "user:5", "user:2", "user:4"} {
+			records = append(records, &sidecar.KeyVal{
+				Key: key,
+				Value: &anypb.Any{
+					Value: []byte(fmt.Sprintf(`"%s"`, key)),
+				},
+			})
+		}
+
+		postReq := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("State.Post"),
+			client.RequestWithUnmarshaledRequest(
+				&sidecar.PostStateRequest{
+					StoreId: storeName,
+					Records: records,
+				},
+			),
+		)
+
+		postRsp := &sidecar.PostStateResponse{}
+
+		err := grpcClient.Call(context.Background(), postReq, postRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+		require.NoError(t, err)
+
+		keys := []string{}
+
+		cursor := ""
+
+		for pages := 0; ; pages++ {
+			require.Less(t, pages, 3)
+
+			listReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.List"),
+				client.RequestWithUnmarshaledRequest(
+					&pbState.ListStateRequest{
+						StoreId: storeName,
+						Prefix:  "user:",
+						Limit:   2,
+						Cursor:  cursor,
+					},
+				),
+			)
+
+			listRsp := &pbState.ListStateResponse{}
+
+			err = grpcClient.Call(context.Background(), listReq, listRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(t, err)
+
+			for _, record := range listRsp.Records {
+				keys = append(keys, record.Key)
+			}
+
+			if len(listRsp.NextCursor) == 0 {
+				break
+			}
+
+			cursor = listRsp.NextCursor
+		}
+
+		require.Equal(t, []string{"user:1", "user:2", "user:3", "user:4", "user:5"}, keys)
+
+		t.Logf("listing store %s without paging", storeName)
+
+		listReq := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("State.List"),
+			client.RequestWithUnmarshaledRequest(
+				&pbState.ListStateRequest{
+					StoreId: storeName,
+				},
+			),
+		)
+
+		listRsp := &pbState.ListStateResponse{}
+
+		err = grpcClient.Call(context.Background(), listReq, listRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+		require.NoError(t, err)
+
+		require.Len(t, listRsp.Records, 6)
+		require.Empty(t, listRsp.NextCursor)
+
+		t.Logf("bad cursor with store %s", storeName)
+
+		listReq = grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("State.List"),
+			client.RequestWithUnmarshaledRequest(
+				&pbState.ListStateRequest{
+					StoreId: storeName,
+					Limit:   2,
+					Cursor:  "not a cursor!",
+				},
+			),
+		)
+
+		err = grpcClient.Call(context.Background(), listReq, &pbState.ListStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,356 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/proto/sidecar"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	logmemory "github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	"github.com/w-h-a/sidecar/pluggable"
+	"github.com/w-h-a/sidecar/pluggable/memory"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"github.com/w-h-a/sidecar/registry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := logmemory.NewLog(
+		log.LogWithPrefix("integration test pluggable-grpc"),
+		logmemory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	// unix socket paths are limited in length, so
+	// the sockets live in a short temporary directory
+	dir, err := os.MkdirTemp("", "pluggable")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv, err := memory.Serve(filepath.Join(dir, "memstore.sock"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":                "default",
+			"NAME":                     "sidecar",
+			"VERSION":                  "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":             fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":             fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":             "localhost",
+			"SERVICE_PORT":             fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL":         "http",
+			"PLUGGABLE_COMPONENTS_DIR": dir,
+			"STORE":                    "memstore",
+			"DB":                       "mydb",
+			"STORES":                   "mytable1,mytable2",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("pluggable"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	srv.Stop()
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestPluggableGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	pt := runner.NewParallelTest(t)
+
+	for _, storeName := range []string{"mytable1", "mytable2"} {
+		pt.Add(func(c *assert.CollectT) {
+			t.Logf("state request with store %s served by a pluggable component", storeName)
+
+			postReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Post"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.PostStateRequest{
+						StoreId: storeName,
+						Records: []*sidecar.KeyVal{
+							{
+								Key: "key1",
+								Value: &anypb.Any{
+									Value: []byte(storeName),
+								},
+							},
+						},
+					},
+				),
+			)
+
+			postRsp := &sidecar.PostStateResponse{}
+
+			err := grpcClient.Call(context.Background(), postReq, postRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			getReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Get"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.GetStateRequest{
+						StoreId: storeName,
+						Key:     "key1",
+					},
+				),
+			)
+
+			getRsp := &sidecar.GetStateResponse{}
+
+			err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			require.Equal(c, []byte(storeName), getRsp.Records[0].Value.Value)
+		})
+	}
+}
+
+func TestPluggableEtag(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	t.Log("checked writes to a pluggable component that cannot swap records")
+
+	postReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: "mytable1",
+				Records: []*pbState.KeyVal{
+					{
+						Key: "checked",
+						Value: &anypb.Any{
+							Value: []byte("1"),
+						},
+						Etag: "*",
+					},
+				},
+			},
+		),
+	)
+
+	err := grpcClient.Call(context.Background(), postReq, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	deleteReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Delete"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.DeleteStateRequest{
+				StoreId: "mytable1",
+				Key:     "checked",
+				Etag:    "*",
+			},
+		),
+	)
+
+	err = grpcClient.Call(context.Background(), deleteReq, &pbState.DeleteStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestPluggableMetadata(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	t.Log("records of a pluggable component have no metadata and cannot be listed since a time")
+
+	postReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: "mytable1",
+				Records: []*pbState.KeyVal{
+					{
+						Key:   "meta",
+						Value: &anypb.Any{Value: []byte(`{}`)},
+					},
+				},
+			},
+		),
+	)
+
+	err := grpcClient.Call(context.Background(), postReq, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	getReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: "mytable1",
+				Key:     "meta",
+			},
+		),
+	)
+
+	getRsp := &pbState.GetStateResponse{}
+
+	err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+	require.Len(t, getRsp.Records, 1)
+	require.Zero(t, getRsp.Records[0].Version)
+	require.Nil(t, getRsp.Records[0].UpdatedAt)
+
+	listReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.List"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.ListStateRequest{
+				StoreId:      "mytable1",
+				UpdatedSince: timestamppb.New(time.Now().Add(-time.Minute)),
+			},
+		),
+	)
+
+	err = grpcClient.Call(context.Background(), listReq, &pbState.ListStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestPluggableBuiltInName(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pluggable")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	srv, err := memory.Serve(filepath.Join(dir, "memory.sock"))
+	require.NoError(t, err)
+
+	defer srv.Stop()
+
+	t.Log("discovery of a pluggable component with the name of a built-in store")
+
+	err = pluggable.Discover(dir)
+	require.ErrorContains(t, err, "pluggable component memory cannot replace the built-in backend")
+
+	builder, ok := registry.Store("memory")
+	require.True(t, ok)
+	require.Equal(t, "memory", builder().String())
+}
@@ -0,0 +1,315 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test query-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "query")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir)), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+			"QUERY_SCAN_LIMIT": "5",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("query"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestQueryGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	people := map[string]string{
+		"p1":  `{"name":"ann","org":"dev","age":30,"address":{"state":"CA"}}`,
+		"p2":  `{"name":"bob","org":"ops","age":25,"address":{"state":"WA"}}`,
+		"p3":  `{"name":"cat","org":"dev","age":41,"address":{"state":"WA"}}`,
+		"p4":  `{"name":"dan","org":"qa","age":25.0,"address":{"state":"NY"}}`,
+		"raw": `not json`,
+	}
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		for key, value := range people {
+			err := post(grpcClient, storeName, key, value, "")
+			require.NoError(t, err)
+		}
+
+		t.Logf("query by equality with store %s", storeName)
+
+		rsp, err := query(grpcClient, storeName, eq("org", "dev"), nil, 0, "")
+		require.NoError(t, err)
+		require.Equal(t, []string{"p1", "p3"}, keys(rsp))
+
+		t.Logf("query by disjunction with store %s", storeName)
+
+		rsp, err = query(grpcClient, storeName,
+			or(eq("address.state", "WA"), in("age", 41, 30)),
+			[]*pbState.QuerySort{{Path: "age", Order: "DESC"}},
+			0, "",
+		)
+		require.NoError(t, err)
+		require.Equal(t, []string{"p3", "p1", "p2"}, keys(rsp))
+
+		t.Logf("query by conjunction with store %s", storeName)
+
+		rsp, err = query(grpcClient, storeName,
+			and(in("org", "dev", "ops"), eq("address.state", "WA")),
+			nil, 0, "",
+		)
+		require.NoError(t, err)
+		require.Equal(t, []string{"p2", "p3"}, keys(rsp))
+
+		t.Logf("query in pages with store %s", storeName)
+
+		sorts := []*pbState.QuerySort{{Path: "age"}}
+
+		rsp, err = query(grpcClient, storeName, nil, sorts, 2, "")
+		require.NoError(t, err)
+		require.Equal(t, []string{"p2", "p4"}, keys(rsp))
+		require.NotEmpty(t, rsp.NextCursor)
+
+		rsp, err = query(grpcClient, storeName, nil, sorts, 2, rsp.NextCursor)
+		require.NoError(t, err)
+		require.Equal(t, []string{"p1", "p3"}, keys(rsp))
+		require.Empty(t, rsp.NextCursor)
+
+		t.Logf("invalid queries with store %s", storeName)
+
+		_, err = query(grpcClient, storeName, &pbState.QueryFilter{Op: "LIKE", Path: "name"}, nil, 0, "")
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = query(grpcClient, storeName, &pbState.QueryFilter{Op: "AND"}, nil, 0, "")
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = query(grpcClient, storeName, nil, []*pbState.QuerySort{{Path: "age", Order: "UP"}}, 0, "")
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = query(grpcClient, storeName, nil, nil, 2, "not a cursor")
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		err := post(grpcClient, storeName, "p5", `{"name":"eve","org":"dev","age":52}`, "")
+		require.NoError(t, err)
+	}
+
+	t.Log("query stores that hold more records than the scan limit")
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		_, err := query(grpcClient, storeName, eq("org", "dev"), nil, 0, "")
+		require.Equal(t, codes.Unimplemented, status.Code(err))
+	}
+}
+
+func eq(path string, value interface{}) *pbState.QueryFilter {
+	filter := in(path, value)
+	filter.Op = "EQ"
+	return filter
+}
+
+func in(path string, values ...interface{}) *pbState.QueryFilter {
+	filter := &pbState.QueryFilter{
+		Op:   "IN",
+		Path: path,
+	}
+
+	for _, value := range values {
+		v, _ := structpb.NewValue(value)
+		filter.Values = append(filter.Values, v)
+	}
+
+	return filter
+}
+
+func and(filters ...*pbState.QueryFilter) *pbState.QueryFilter {
+	return &pbState.QueryFilter{Op: "AND", Filters: filters}
+}
+
+func or(filters ...*pbState.QueryFilter) *pbState.QueryFilter {
+	return &pbState.QueryFilter{Op: "OR", Filters: filters}
+}
+
+func keys(rsp *pbState.QueryStateResponse) []string {
+	keys := []string{}
+
+	for _, record := range rsp.Records {
+		keys = append(keys, record.Key)
+	}
+
+	return keys
+}
+
+func query(grpcClient client.Client, storeName string, filter *pbState.QueryFilter, sorts []*pbState.QuerySort, limit uint32, cursor string) (*pbState.QueryStateResponse, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Query"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.QueryStateRequest{
+				StoreId: storeName,
+				Filter:  filter,
+				Sort:    sorts,
+				Limit:   limit,
+				Cursor:  cursor,
+			},
+		),
+	)
+
+	rsp := &pbState.QueryStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+func post(grpcClient client.Client, storeName, key, value, etag string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: []*pbState.KeyVal{
+					{
+						Key: key,
+						Value: &anypb.Any{
+							Value: []byte(value),
+						},
+						Etag: etag,
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
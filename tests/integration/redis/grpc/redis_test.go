@@ -0,0 +1,318 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/proto/sidecar"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+	redisServer *miniredis.Miniredis
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test redis-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	var err error
+
+	redisServer, err = miniredis.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// records that were written before the store kept an index of
+	// their keys are added to it when the store starts
+	for _, key := range []string{"page/0", "page/1", "page/2"} {
+		if err := redisServer.Set("mydb:mytable3:"+key, key); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"STORE":            "redis",
+			"STORE_ADDRESS":    redisServer.Addr(),
+			"DB":               "mydb",
+			"STORES":           "mytable1,mytable2,mytable3",
+			"APP_DB":           "secretdb",
+			"SHARED_TABLE":     "records",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("redis"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	redisServer.Close()
+
+	os.Exit(code)
+}
+
+func TestRedisGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	pt := runner.NewParallelTest(t)
+
+	for _, storeName := range []string{"mytable1", "mytable2"} {
+		pt.Add(func(c *assert.CollectT) {
+			t.Logf("state request with store %s in redis", storeName)
+
+			postReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Post"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.PostStateRequest{
+						StoreId: storeName,
+						Records: []*sidecar.KeyVal{
+							{
+								Key: "key1",
+								Value: &anypb.Any{
+									Value: []byte(storeName),
+								},
+							},
+						},
+					},
+				),
+			)
+
+			postRsp := &sidecar.PostStateResponse{}
+
+			err := grpcClient.Call(context.Background(), postReq, postRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			getReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Get"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.GetStateRequest{
+						StoreId: storeName,
+						Key:     "key1",
+					},
+				),
+			)
+
+			getRsp := &sidecar.GetStateResponse{}
+
+			err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			require.Equal(c, []byte(storeName), getRsp.Records[0].Value.Value)
+
+			listReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.List"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.ListStateRequest{
+						StoreId: storeName,
+					},
+				),
+			)
+
+			listRsp := &sidecar.ListStateResponse{}
+
+			err = grpcClient.Call(context.Background(), listReq, listRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			require.Len(c, listRsp.Records, 1)
+
+			deleteReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Delete"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.DeleteStateRequest{
+						StoreId: storeName,
+						Key:     "key1",
+					},
+				),
+			)
+
+			deleteRsp := &sidecar.DeleteStateResponse{}
+
+			err = grpcClient.Call(context.Background(), deleteReq, deleteRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.Error(c, err)
+		})
+	}
+}
+
+func TestRedisPagingGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	t.Log("pages of records of redis in key order")
+
+	for _, key := range []string{"page/4", "page/3", "other/0"} {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("State.Post"),
+			client.RequestWithUnmarshaledRequest(
+				&pbState.PostStateRequest{
+					StoreId: "mytable3",
+					Records: []*pbState.KeyVal{
+						{
+							Key:   key,
+							Value: &anypb.Any{Value: []byte(key)},
+						},
+					},
+				},
+			),
+		)
+
+		err := grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+		require.NoError(t, err)
+	}
+
+	// a record that expires stays in the index until a page reads past it
+	redisServer.Del("mydb:mytable3:page/1")
+
+	keys := []string{}
+
+	cursor := ""
+
+	for {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("State.List"),
+			client.RequestWithUnmarshaledRequest(
+				&pbState.ListStateRequest{
+					StoreId: "mytable3",
+					Prefix:  "page/",
+					Limit:   2,
+					Cursor:  cursor,
+				},
+			),
+		)
+
+		rsp := &pbState.ListStateResponse{}
+
+		err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+		require.NoError(t, err)
+
+		for _, record := range rsp.Records {
+			keys = append(keys, record.Key)
+		}
+
+		if len(rsp.NextCursor) == 0 {
+			break
+		}
+
+		cursor = rsp.NextCursor
+	}
+
+	require.Equal(t, []string{"page/0", "page/2", "page/3", "page/4"}, keys)
+
+	members, err := redisServer.ZMembers("mydb:mytable3$keys")
+	require.NoError(t, err)
+	require.Equal(t, []string{"other/0", "page/0", "page/2", "page/3", "page/4"}, members)
+}
@@ -0,0 +1,321 @@
+package grpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/proto/sidecar"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/protobuf/types/known/anypb"
+	_ "modernc.org/sqlite"
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+	dbPath      string
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test sqlite-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "sqlite")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbPath = filepath.Join(dir, "state.db")
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"STORE":            "sqlite",
+			"STORE_ADDRESS":    dbPath,
+			"DB":               "mydb",
+			"STORES":           "mytable1,mytable2",
+			"APP_DB":           "secretdb",
+			"SHARED_TABLE":     "records",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("sqlite"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestSqliteGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	pt := runner.NewParallelTest(t)
+
+	for _, storeName := range []string{"mytable1", "mytable2"} {
+		pt.Add(func(c *assert.CollectT) {
+			t.Logf("state request with store %s in sqlite", storeName)
+
+			postReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Post"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.PostStateRequest{
+						StoreId: storeName,
+						Records: []*sidecar.KeyVal{
+							{
+								Key: "key1",
+								Value: &anypb.Any{
+									Value: []byte(storeName),
+								},
+							},
+						},
+					},
+				),
+			)
+
+			postRsp := &sidecar.PostStateResponse{}
+
+			err := grpcClient.Call(context.Background(), postReq, postRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			getReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Get"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.GetStateRequest{
+						StoreId: storeName,
+						Key:     "key1",
+					},
+				),
+			)
+
+			getRsp := &sidecar.GetStateResponse{}
+
+			err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			require.Equal(c, []byte(storeName), getRsp.Records[0].Value.Value)
+
+			listReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.List"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.ListStateRequest{
+						StoreId: storeName,
+					},
+				),
+			)
+
+			listRsp := &sidecar.ListStateResponse{}
+
+			err = grpcClient.Call(context.Background(), listReq, listRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			require.Len(c, listRsp.Records, 1)
+
+			deleteReq := grpcClient.NewRequest(
+				client.RequestWithNamespace("default"),
+				client.RequestWithName("sidecar"),
+				client.RequestWithMethod("State.Delete"),
+				client.RequestWithUnmarshaledRequest(
+					&sidecar.DeleteStateRequest{
+						StoreId: storeName,
+						Key:     "key1",
+					},
+				),
+			)
+
+			deleteRsp := &sidecar.DeleteStateResponse{}
+
+			err = grpcClient.Call(context.Background(), deleteReq, deleteRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.NoError(c, err)
+
+			err = grpcClient.Call(context.Background(), getReq, getRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+			require.Error(c, err)
+		})
+	}
+
+}
+
+func TestSqlitePrefixCase(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	records := []*pbState.KeyVal{}
+
+	for _, key := range []string{"Tenant:1", "tenant:1", "tenant:2", "TENANT:3"} {
+		records = append(records, &pbState.KeyVal{
+			Key:   key,
+			Value: &anypb.Any{Value: []byte(`{}`)},
+		})
+	}
+
+	postReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: "mytable1",
+				Records: records,
+			},
+		),
+	)
+
+	err := grpcClient.Call(context.Background(), postReq, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	t.Log("a prefix only matches keys of the same case")
+
+	keys, err := listKeys(grpcClient, "mytable1", "tenant:")
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant:1", "tenant:2"}, keys)
+
+	bulkDeleteReq := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.BulkDelete"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.BulkDeleteStateRequest{
+				StoreId: "mytable1",
+				Prefix:  "tenant:",
+			},
+		),
+	)
+
+	bulkDeleteRsp := &pbState.BulkDeleteStateResponse{}
+
+	err = grpcClient.Call(context.Background(), bulkDeleteReq, bulkDeleteRsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), bulkDeleteRsp.Deleted)
+
+	keys, err = listKeys(grpcClient, "mytable1", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"TENANT:3", "Tenant:1"}, keys)
+}
+
+func listKeys(grpcClient client.Client, storeName, prefix string) ([]string, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.List"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.ListStateRequest{
+				StoreId: storeName,
+				Prefix:  prefix,
+			},
+		),
+	)
+
+	rsp := &pbState.ListStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+
+	for _, rec := range rsp.Records {
+		keys = append(keys, rec.Key)
+	}
+
+	return keys, nil
+}
+
+func TestSqliteTables(t *testing.T) {
+	t.Log("each store is a table of the database file")
+
+	db, err := sql.Open("sqlite", dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, table := range []string{"mytable1", "mytable2"} {
+		var name string
+
+		err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = $1", table).Scan(&name)
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,334 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+  - name: redistable
+    type: redis
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test stamp-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "stamp")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir, redisServer.Addr())), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("stamp"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	redisServer.Close()
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestStampGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable", "redistable"} {
+		t.Logf("metadata with store %s", storeName)
+
+		for i := 0; i < 5; i++ {
+			err := post(grpcClient, storeName, fmt.Sprintf("key%d", i), "1")
+			require.NoError(t, err)
+		}
+
+		first, err := get(grpcClient, storeName, "key0")
+		require.NoError(t, err)
+		require.NotZero(t, first.Version)
+		require.NotNil(t, first.CreatedAt)
+		require.Equal(t, first.CreatedAt.AsTime(), first.UpdatedAt.AsTime())
+
+		time.Sleep(10 * time.Millisecond)
+
+		since := time.Now()
+
+		// the odd keys are written again after the time
+		err = post(grpcClient, storeName, "key1", "2")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "key3", "2")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "key3", "3")
+		require.NoError(t, err)
+
+		updated, err := get(grpcClient, storeName, "key3")
+		require.NoError(t, err)
+		require.Greater(t, updated.Version, first.Version)
+		require.True(t, updated.UpdatedAt.AsTime().After(updated.CreatedAt.AsTime()))
+
+		rsp, err := list(grpcClient, storeName, since, 0, "")
+		require.NoError(t, err)
+		require.Equal(t, []string{"key1", "key3"}, keys(rsp.Records))
+		require.Greater(t, rsp.Records[0].Version, first.Version)
+		require.Equal(t, updated.Version, rsp.Records[1].Version)
+		require.Greater(t, rsp.Records[1].Version, rsp.Records[0].Version)
+
+		// pages of a list since a time only hold the records that were updated
+		rsp, err = list(grpcClient, storeName, since, 1, "")
+		require.NoError(t, err)
+		require.Equal(t, []string{"key1"}, keys(rsp.Records))
+		require.NotEmpty(t, rsp.NextCursor)
+
+		rsp, err = list(grpcClient, storeName, since, 1, rsp.NextCursor)
+		require.NoError(t, err)
+		require.Equal(t, []string{"key3"}, keys(rsp.Records))
+
+		// a record that is deleted is created again when it is written
+		// again and its version still grows
+		err = remove(grpcClient, storeName, "key3")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "key3", "4")
+		require.NoError(t, err)
+
+		recreated, err := get(grpcClient, storeName, "key3")
+		require.NoError(t, err)
+		require.Greater(t, recreated.Version, updated.Version)
+		require.True(t, recreated.CreatedAt.AsTime().After(updated.CreatedAt.AsTime()))
+
+		// every record of a plain list has its metadata
+		rsp, err = list(grpcClient, storeName, time.Time{}, 0, "")
+		require.NoError(t, err)
+		require.Len(t, rsp.Records, 5)
+
+		for _, record := range rsp.Records {
+			require.NotZero(t, record.Version)
+			require.NotNil(t, record.UpdatedAt)
+		}
+	}
+}
+
+func keys(records []*pbState.KeyVal) []string {
+	ks := []string{}
+
+	for _, record := range records {
+		ks = append(ks, record.Key)
+	}
+
+	return ks
+}
+
+func list(grpcClient client.Client, storeName string, since time.Time, limit uint32, cursor string) (*pbState.ListStateResponse, error) {
+	listReq := &pbState.ListStateRequest{
+		StoreId: storeName,
+		Limit:   limit,
+		Cursor:  cursor,
+	}
+
+	if !since.IsZero() {
+		listReq.UpdatedSince = timestamppb.New(since)
+	}
+
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.List"),
+		client.RequestWithUnmarshaledRequest(listReq),
+	)
+
+	rsp := &pbState.ListStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+func get(grpcClient client.Client, storeName, key string) (*pbState.KeyVal, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: storeName,
+				Key:     key,
+			},
+		),
+	)
+
+	rsp := &pbState.GetStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return nil, err
+	}
+
+	if len(rsp.Records) != 1 {
+		return nil, fmt.Errorf("expected one record of key %s but got %d", key, len(rsp.Records))
+	}
+
+	return rsp.Records[0], nil
+}
+
+func remove(grpcClient client.Client, storeName, key string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Delete"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.DeleteStateRequest{
+				StoreId: storeName,
+				Key:     key,
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.DeleteStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func post(grpcClient client.Client, storeName, key, value string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: []*pbState.KeyVal{
+					{
+						Key: key,
+						Value: &anypb.Any{
+							Value: []byte(value),
+						},
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
@@ -0,0 +1,396 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+  - name: redistable
+    type: redis
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test transaction-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "transaction")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, filepath.Join(dir, "state.db"), dir, redisServer.Addr())), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("transaction"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	redisServer.Close()
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestTransactionGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		t.Logf("transaction that applies with store %s", storeName)
+
+		err := post(grpcClient, storeName, "a", "1", "")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "b", "2", "")
+		require.NoError(t, err)
+
+		_, etag, err := get(grpcClient, storeName, "a")
+		require.NoError(t, err)
+
+		err = transact(grpcClient, storeName,
+			upsert("a", "10", etag),
+			remove("b", ""),
+			upsert("c", "3", ""),
+		)
+		require.NoError(t, err)
+
+		value, etag, err := get(grpcClient, storeName, "a")
+		require.NoError(t, err)
+		require.Equal(t, "10", value)
+
+		_, _, err = get(grpcClient, storeName, "b")
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		value, _, err = get(grpcClient, storeName, "c")
+		require.NoError(t, err)
+		require.Equal(t, "3", value)
+
+		t.Logf("transaction that does not apply with store %s", storeName)
+
+		err = transact(grpcClient, storeName,
+			upsert("a", "20", etag),
+			upsert("d", "4", ""),
+			remove("c", "not-the-etag"),
+		)
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		value, _, err = get(grpcClient, storeName, "a")
+		require.NoError(t, err)
+		require.Equal(t, "10", value)
+
+		_, _, err = get(grpcClient, storeName, "d")
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		value, _, err = get(grpcClient, storeName, "c")
+		require.NoError(t, err)
+		require.Equal(t, "3", value)
+
+		t.Logf("transaction that checks its own writes with store %s", storeName)
+
+		err = transact(grpcClient, storeName,
+			remove("a", etag),
+			upsert("a", "30", etag),
+		)
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		value, _, err = get(grpcClient, storeName, "a")
+		require.NoError(t, err)
+		require.Equal(t, "10", value)
+
+		t.Logf("transaction that checks that records exist with store %s", storeName)
+
+		err = transact(grpcClient, storeName,
+			upsert("a", "40", "*"),
+			upsert("e", "5", "*"),
+		)
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		err = transact(grpcClient, storeName,
+			upsert("a", "40", "*"),
+			remove("c", "*"),
+		)
+		require.NoError(t, err)
+
+		value, _, err = get(grpcClient, storeName, "a")
+		require.NoError(t, err)
+		require.Equal(t, "40", value)
+
+		_, _, err = get(grpcClient, storeName, "c")
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		t.Logf("invalid transaction with store %s", storeName)
+
+		err = transact(grpcClient, storeName, &pbState.TransactionOperation{
+			Operation: "merge",
+			Record:    &pbState.KeyVal{Key: "a"},
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		t.Logf("concurrent transfers with store %s", storeName)
+
+		err = post(grpcClient, storeName, "from", "10", "")
+		require.NoError(t, err)
+
+		err = post(grpcClient, storeName, "to", "0", "")
+		require.NoError(t, err)
+
+		transfers := 10
+
+		wg := &sync.WaitGroup{}
+
+		for i := 0; i < transfers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					from, fromEtag, err := get(grpcClient, storeName, "from")
+					if err != nil {
+						continue
+					}
+
+					to, toEtag, err := get(grpcClient, storeName, "to")
+					if err != nil {
+						continue
+					}
+
+					f, _ := strconv.Atoi(from)
+					n, _ := strconv.Atoi(to)
+
+					if err := transact(grpcClient, storeName,
+						upsert("from", strconv.Itoa(f-1), fromEtag),
+						upsert("to", strconv.Itoa(n+1), toEtag),
+					); err == nil {
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		value, _, err = get(grpcClient, storeName, "from")
+		require.NoError(t, err)
+		require.Equal(t, "0", value)
+
+		value, _, err = get(grpcClient, storeName, "to")
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(transfers), value)
+	}
+
+	t.Logf("transaction with a store that cannot apply one")
+
+	err := transact(grpcClient, "redistable", upsert("a", "1", ""))
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	err = transact(grpcClient, "nosuchtable", upsert("a", "1", ""))
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func upsert(key, value, etag string) *pbState.TransactionOperation {
+	return &pbState.TransactionOperation{
+		Operation: "upsert",
+		Record: &pbState.KeyVal{
+			Key: key,
+			Value: &anypb.Any{
+				Value: []byte(value),
+			},
+			Etag: etag,
+		},
+	}
+}
+
+func remove(key, etag string) *pbState.TransactionOperation {
+	return &pbState.TransactionOperation{
+		Operation: "delete",
+		Record: &pbState.KeyVal{
+			Key:  key,
+			Etag: etag,
+		},
+	}
+}
+
+func transact(grpcClient client.Client, storeName string, ops ...*pbState.TransactionOperation) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Transact"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.TransactStateRequest{
+				StoreId:    storeName,
+				Operations: ops,
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.TransactStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func post(grpcClient client.Client, storeName, key, value, etag string) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: []*pbState.KeyVal{
+					{
+						Key: key,
+						Value: &anypb.Any{
+							Value: []byte(value),
+						},
+						Etag: etag,
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func get(grpcClient client.Client, storeName, key string) (string, string, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: storeName,
+				Key:     key,
+			},
+		),
+	)
+
+	rsp := &pbState.GetStateResponse{}
+
+	if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+		return "", "", err
+	}
+
+	return string(rsp.Records[0].Value.Value), rsp.Records[0].Etag, nil
+}
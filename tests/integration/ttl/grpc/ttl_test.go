@@ -0,0 +1,271 @@
+package grpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/client"
+	"github.com/w-h-a/pkg/client/grpcclient"
+	"github.com/w-h-a/pkg/proto/health"
+	"github.com/w-h-a/pkg/runner"
+	"github.com/w-h-a/pkg/runner/binary"
+	"github.com/w-h-a/pkg/runner/http"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+	pbState "github.com/w-h-a/sidecar/proto/state"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	components = `stores:
+  - name: memtable
+    type: memory
+    database: mydb
+    table: records
+  - name: sqltable
+    type: sqlite
+    address: %s
+    table: records
+  - name: filetable
+    type: file
+    address: %s
+    database: mydb
+    table: records
+`
+)
+
+var (
+	servicePort int
+	httpPort    int
+	grpcPort    int
+	dbPath      string
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv("INTEGRATION")) == 0 {
+		os.Exit(0)
+	}
+
+	logger := memory.NewLog(
+		log.LogWithPrefix("integration test ttl-grpc"),
+		memory.LogWithBuffer(memoryutils.NewBuffer()),
+	)
+
+	log.SetLogger(logger)
+
+	dir, err := os.MkdirTemp("", "ttl")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbPath = filepath.Join(dir, "state.db")
+
+	path := filepath.Join(dir, "components.yml")
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(components, dbPath, dir)), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	servicePort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceProcess := http.NewProcess(
+		runner.ProcessWithId("focal-service"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"PORT": fmt.Sprintf("%d", servicePort),
+		}),
+	)
+
+	httpPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcPort, err = runner.GetFreePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecarProcess := binary.NewProcess(
+		runner.ProcessWithId("sidecar"),
+		runner.ProcessWithUpBinPath("sidecar"),
+		runner.ProcessWithUpArgs("sidecar"),
+		runner.ProcessWithEnvVars(map[string]string{
+			"NAMESPACE":        "default",
+			"NAME":             "sidecar",
+			"VERSION":          "v0.1.0-alpha.0",
+			"HTTP_ADDRESS":     fmt.Sprintf(":%d", httpPort),
+			"GRPC_ADDRESS":     fmt.Sprintf(":%d", grpcPort),
+			"SERVICE_NAME":     "localhost",
+			"SERVICE_PORT":     fmt.Sprintf("%d", servicePort),
+			"SERVICE_PROTOCOL": "http",
+			"COMPONENTS":       path,
+			"REAP_INTERVAL":    "500ms",
+		}),
+	)
+
+	r := runner.NewTestRunner(
+		runner.RunnerWithId("ttl"),
+		runner.RunnerWithProcesses(serviceProcess, sidecarProcess),
+	)
+
+	code := r.Start(m)
+
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+func TestTtlGrpc(t *testing.T) {
+	grpcClient := grpcclient.NewClient()
+
+	require.Eventually(t, func() bool {
+		req := grpcClient.NewRequest(
+			client.RequestWithNamespace("default"),
+			client.RequestWithName("sidecar"),
+			client.RequestWithMethod("Health.Check"),
+			client.RequestWithUnmarshaledRequest(
+				&health.HealthRequest{},
+			),
+		)
+
+		rsp := &health.HealthResponse{}
+
+		if err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort))); err != nil {
+			return false
+		}
+
+		return rsp.Status == "ok"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	db, err := sql.Open("sqlite", dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, storeName := range []string{"memtable", "sqltable", "filetable"} {
+		t.Logf("bad ttl with store %s", storeName)
+
+		err := post(grpcClient, storeName, "session", -1)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		t.Logf("records with ttls with store %s", storeName)
+
+		require.NoError(t, post(grpcClient, storeName, "session", 1))
+		require.NoError(t, post(grpcClient, storeName, "reaped", 1))
+		require.NoError(t, post(grpcClient, storeName, "marker", 0))
+
+		_, err = get(grpcClient, storeName, "session")
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"marker", "reaped", "session"}, list(t, grpcClient, storeName))
+
+		if storeName == "sqltable" {
+			t.Log("expired records are reaped without being read")
+
+			require.Eventually(t, func() bool {
+				var n int
+				if err := db.QueryRow("SELECT count(*) FROM records WHERE key = 'reaped'").Scan(&n); err != nil {
+					return false
+				}
+				return n == 0
+			}, 5*time.Second, 100*time.Millisecond)
+		}
+
+		t.Logf("expired records are gone with store %s", storeName)
+
+		require.Eventually(t, func() bool {
+			_, err := get(grpcClient, storeName, "session")
+			return status.Code(err) == codes.NotFound
+		}, 5*time.Second, 100*time.Millisecond)
+
+		require.Equal(t, []string{"marker"}, list(t, grpcClient, storeName))
+
+		require.Equal(t, []string{"marker"}, page(t, grpcClient, storeName))
+	}
+}
+
+func post(grpcClient client.Client, storeName, key string, ttl int64) error {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Post"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.PostStateRequest{
+				StoreId: storeName,
+				Records: []*pbState.KeyVal{
+					{
+						Key: key,
+						Value: &anypb.Any{
+							Value: []byte(key),
+						},
+						TtlInSeconds: ttl,
+					},
+				},
+			},
+		),
+	)
+
+	return grpcClient.Call(context.Background(), req, &pbState.PostStateResponse{}, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+}
+
+func get(grpcClient client.Client, storeName, key string) (*pbState.GetStateResponse, error) {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.Get"),
+		client.RequestWithUnmarshaledRequest(
+			&pbState.GetStateRequest{
+				StoreId: storeName,
+				Key:     key,
+			},
+		),
+	)
+
+	rsp := &pbState.GetStateResponse{}
+
+	err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+
+	return rsp, err
+}
+
+func list(t *testing.T, grpcClient client.Client, storeName string) []string {
+	return keys(t, grpcClient, &pbState.ListStateRequest{StoreId: storeName})
+}
+
+func page(t *testing.T, grpcClient client.Client, storeName string) []string {
+	return keys(t, grpcClient, &pbState.ListStateRequest{StoreId: storeName, Limit: 10})
+}
+
+func keys(t *testing.T, grpcClient client.Client, listReq *pbState.ListStateRequest) []string {
+	req := grpcClient.NewRequest(
+		client.RequestWithNamespace("default"),
+		client.RequestWithName("sidecar"),
+		client.RequestWithMethod("State.List"),
+		client.RequestWithUnmarshaledRequest(listReq),
+	)
+
+	rsp := &pbState.ListStateResponse{}
+
+	err := grpcClient.Call(context.Background(), req, rsp, client.CallWithAddress(fmt.Sprintf("127.0.0.1:%d", grpcPort)))
+	require.NoError(t, err)
+
+	keys := []string{}
+
+	for _, record := range rsp.Records {
+		keys = append(keys, record.Key)
+	}
+
+	return keys
+}